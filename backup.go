@@ -0,0 +1,349 @@
+package keynest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A backup directory holds the data files of every backup in its tables directory, and one manifest per backup. The
+// data files are never modified once written, so a file already copied by a previous backup is shared by the later
+// ones instead of being copied again.
+const (
+	backupTablesDir      = "tables"
+	backupManifestPrefix = "backup-"
+	backupManifestSuffix = ".manifest"
+)
+
+type BackupManifest struct {
+	ID        int
+	CreatedAt time.Time
+	Metadata  TableClusterMetadata
+}
+
+type BackupInfo struct {
+	ID          int
+	CreatedAt   time.Time
+	NTables     int
+	SizeInBytes int64
+	// NewTables and NewBytes count the data files copied by the backup, they are only set by the backup creation
+	NewTables int
+	NewBytes  int64
+}
+
+func backupManifestName(id int) string {
+	return fmt.Sprintf("%s%06d%s", backupManifestPrefix, id, backupManifestSuffix)
+}
+
+// CreateBackup backs up the tables and value log segments listed in the metadata file of dataDir into backupDir. The data directory must not
+// be modified meanwhile: point it at a stopped cluster or at a checkpoint, or use TableCluster.Backup on a live one.
+// The memtable backup is not part of the backup.
+func CreateBackup(dataDir, backupDir string) (BackupInfo, error) {
+	clusterMetadata, err := ReadTableClusterMetadata(dataDir)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return writeBackup(dataDir, backupDir, clusterMetadata)
+}
+
+// Backup flushes the memtables and backs up every table of the cluster into backupDir. Writes are not blocked, the
+// ones issued after the flush are not part of the backup.
+func (t *TableCluster) Backup(backupDir string) (BackupInfo, error) {
+	if t.closed.Load() {
+		return BackupInfo{}, ErrClosed
+	}
+	if err := t.flushMemTableToFTable(); err != nil {
+		return BackupInfo{}, err
+	}
+
+	var clusterMetadata TableClusterMetadata
+	release := t.pinFiles(func() {
+		clusterMetadata = t.getTableClusterMetadata()
+	})
+	defer release()
+	return writeBackup(t.cfg.DataDir, backupDir, clusterMetadata)
+}
+
+// writeBackup copies the data files missing from backupDir and then writes the manifest of the new backup. The
+// manifest is written last, so an interrupted backup leaves at most a few unreferenced data files behind.
+func writeBackup(dataDir, backupDir string, clusterMetadata TableClusterMetadata) (BackupInfo, error) {
+	tablesDir := filepath.Join(backupDir, backupTablesDir)
+	if err := os.MkdirAll(tablesDir, 0755); err != nil {
+		return BackupInfo{}, fmt.Errorf("%w: create backup directory: %w", ErrIO, err)
+	}
+	ids, err := backupIDs(backupDir)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	manifest := BackupManifest{
+		ID:        1,
+		CreatedAt: time.Now(),
+		Metadata:  clusterMetadata,
+	}
+	if len(ids) > 0 {
+		manifest.ID = ids[len(ids)-1] + 1
+	}
+	info := manifest.info()
+	for _, file := range clusterMetadata.dataFiles() {
+		dst := filepath.Join(tablesDir, file.FileName)
+		if _, err := os.Stat(dst); err == nil {
+			if err = verifyFileSize(dst, file.SizeInBytes); err != nil {
+				return BackupInfo{}, err
+			}
+			continue
+		}
+		if err = copyVerifiedFile(filepath.Join(dataDir, file.FileName), dst, file.SizeInBytes); err != nil {
+			return BackupInfo{}, err
+		}
+		info.NewTables++
+		info.NewBytes += file.SizeInBytes
+	}
+
+	bytes, err := msgpack.Marshal(manifest)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("marshal backup manifest: %w", err)
+	}
+	path := filepath.Join(backupDir, backupManifestName(manifest.ID))
+	if err = os.WriteFile(path+".tmp", bytes, 0644); err != nil {
+		return BackupInfo{}, fmt.Errorf("%w: write backup manifest: %w", ErrIO, err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return BackupInfo{}, fmt.Errorf("%w: rename backup manifest: %w", ErrIO, err)
+	}
+	log.Printf("[INFO] Backup %d written to %s, %d of %d tables copied\n", info.ID, backupDir, info.NewTables, info.NTables)
+	return info, nil
+}
+
+// copyVerifiedFile copies src to dst through a temporary file, which is only renamed to dst once its size matches
+// the one recorded in the table metadata.
+func copyVerifiedFile(src, dst string, sizeInBytes int64) error {
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	if err := copyFile(src, tmp); err != nil {
+		return err
+	}
+	if err := verifyFileSize(tmp, sizeInBytes); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%w: rename %s: %w", ErrIO, tmp, err)
+	}
+	return nil
+}
+
+func verifyFileSize(path string, sizeInBytes int64) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%w: stat %s: %w", ErrIO, path, err)
+	}
+	if stat.Size() != sizeInBytes {
+		return fmt.Errorf("%w: %s holds %d bytes, its metadata claims %d", ErrCorruption, path, stat.Size(), sizeInBytes)
+	}
+	return nil
+}
+
+// backupIDs returns the ids of the backups of backupDir in increasing order.
+func backupIDs(backupDir string) ([]int, error) {
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: read backup directory: %w", ErrIO, err)
+	}
+	ids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, backupManifestPrefix) || !strings.HasSuffix(name, backupManifestSuffix) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, backupManifestPrefix), backupManifestSuffix))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func readBackupManifest(backupDir string, id int) (BackupManifest, error) {
+	manifest := BackupManifest{}
+	bytes, err := os.ReadFile(filepath.Join(backupDir, backupManifestName(id)))
+	if err != nil {
+		return manifest, fmt.Errorf("%w: read backup manifest %d: %w", ErrIO, id, err)
+	}
+	if err = msgpack.Unmarshal(bytes, &manifest); err != nil {
+		return manifest, fmt.Errorf("%w: decode backup manifest %d: %w", ErrCorruption, id, err)
+	}
+	return manifest, nil
+}
+
+func (m BackupManifest) info() BackupInfo {
+	info := BackupInfo{
+		ID:        m.ID,
+		CreatedAt: m.CreatedAt,
+	}
+	for i := range m.Metadata.FTableMetadata {
+		for _, metadata := range m.Metadata.FTableMetadata[i] {
+			info.NTables++
+			info.SizeInBytes += metadata.SizeInBytes
+		}
+	}
+	return info
+}
+
+// ListBackups describes the backups of backupDir, from the oldest to the newest.
+func ListBackups(backupDir string) ([]BackupInfo, error) {
+	ids, err := backupIDs(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]BackupInfo, 0, len(ids))
+	for _, id := range ids {
+		manifest, err := readBackupManifest(backupDir, id)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, manifest.info())
+	}
+	return infos, nil
+}
+
+// latestBackupID resolves id 0 to the newest backup of backupDir.
+func latestBackupID(backupDir string, id int) (int, error) {
+	if id != 0 {
+		return id, nil
+	}
+	ids, err := backupIDs(backupDir)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, fmt.Errorf("no backup in %s", backupDir)
+	}
+	return ids[len(ids)-1], nil
+}
+
+// VerifyBackup checks that every data file of the backup id, or of the newest backup when id is 0, exists with the
+// size recorded in the manifest.
+func VerifyBackup(backupDir string, id int) error {
+	id, err := latestBackupID(backupDir, id)
+	if err != nil {
+		return err
+	}
+	manifest, err := readBackupManifest(backupDir, id)
+	if err != nil {
+		return err
+	}
+	for _, file := range manifest.Metadata.dataFiles() {
+		path := filepath.Join(backupDir, backupTablesDir, file.FileName)
+		if err = verifyFileSize(path, file.SizeInBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreBackup copies the backup id, or the newest backup when id is 0, into dataDir, which must be empty or not
+// exist yet. A TableCluster configured with dataDir as its DataDir can then load it.
+func RestoreBackup(backupDir string, id int, dataDir string) error {
+	id, err := latestBackupID(backupDir, id)
+	if err != nil {
+		return err
+	}
+	manifest, err := readBackupManifest(backupDir, id)
+	if err != nil {
+		return err
+	}
+	if err = checkFormatVersion(manifest.Metadata.FormatVersion); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("%w: create data directory: %w", ErrIO, err)
+	}
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return fmt.Errorf("%w: read data directory: %w", ErrIO, err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("data directory %s is not empty", dataDir)
+	}
+
+	restored := make([]string, 0)
+	for _, file := range manifest.Metadata.dataFiles() {
+		src := filepath.Join(backupDir, backupTablesDir, file.FileName)
+		dst := filepath.Join(dataDir, file.FileName)
+		if err = verifyFileSize(src, file.SizeInBytes); err == nil {
+			err = copyVerifiedFile(src, dst, file.SizeInBytes)
+		}
+		if err != nil {
+			for _, name := range restored {
+				os.Remove(name)
+			}
+			return err
+		}
+		restored = append(restored, dst)
+	}
+
+	if err = WriteTableClusterMetadata(dataDir, manifest.Metadata); err != nil {
+		return err
+	}
+	log.Printf("[INFO] Backup %d restored to %s\n", id, dataDir)
+	return nil
+}
+
+// PurgeOldBackups deletes every backup but the keep newest ones, along with the data files no remaining backup
+// refers to. It returns the ids of the deleted backups.
+func PurgeOldBackups(backupDir string, keep int) ([]int, error) {
+	if keep < 1 {
+		return nil, errors.New("at least one backup must be kept")
+	}
+	ids, err := backupIDs(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) <= keep {
+		return nil, nil
+	}
+	purged, kept := ids[:len(ids)-keep], ids[len(ids)-keep:]
+
+	// read every kept manifest before deleting anything, so an unreadable one doesn't lose its data files
+	referenced := make(map[string]bool)
+	for _, id := range kept {
+		manifest, err := readBackupManifest(backupDir, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range manifest.Metadata.dataFiles() {
+			referenced[file.FileName] = true
+		}
+	}
+	for _, id := range purged {
+		if err = os.Remove(filepath.Join(backupDir, backupManifestName(id))); err != nil {
+			return nil, fmt.Errorf("%w: remove backup manifest %d: %w", ErrIO, id, err)
+		}
+	}
+
+	tablesDir := filepath.Join(backupDir, backupTablesDir)
+	entries, err := os.ReadDir(tablesDir)
+	if err != nil {
+		return purged, fmt.Errorf("%w: read backup tables directory: %w", ErrIO, err)
+	}
+	for _, entry := range entries {
+		if referenced[entry.Name()] {
+			continue
+		}
+		if err = os.Remove(filepath.Join(tablesDir, entry.Name())); err != nil {
+			return purged, fmt.Errorf("%w: remove %s: %w", ErrIO, entry.Name(), err)
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,61 @@
+package keynest
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupIsIncrementalAndRestorable(t *testing.T) {
+	tc := newTestTableCluster(t, t.TempDir())
+	backupDir := t.TempDir()
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := tc.Put(fmt.Sprintf("key-%03d", i), i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	put(0, 50)
+	first, err := tc.Backup(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(50, 100)
+	second, err := tc.Backup(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID+1 || second.NTables != 2 || second.NewTables != 1 {
+		t.Fatalf("second backup = %+v, want only the new table copied", second)
+	}
+
+	purged, err := PurgeOldBackups(backupDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0] != first.ID {
+		t.Fatalf("purged %v, want [%d]", purged, first.ID)
+	}
+	if err = VerifyBackup(backupDir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dataDir := filepath.Join(t.TempDir(), "restored")
+	if err = RestoreBackup(backupDir, 0, dataDir); err != nil {
+		t.Fatal(err)
+	}
+	if err = RestoreBackup(backupDir, 0, dataDir); err == nil {
+		t.Fatal("restoring into a non empty data directory must fail")
+	}
+	restored := newTestTableCluster(t, dataDir)
+	if err = restored.LoadTableClusterMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 49, 99} {
+		if _, ok, err := restored.Get(fmt.Sprintf("key-%03d", i)); err != nil || !ok {
+			t.Fatalf("Get(key-%03d) = %v, %v", i, ok, err)
+		}
+	}
+}
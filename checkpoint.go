@@ -0,0 +1,178 @@
+package keynest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint writes a consistent copy of the cluster into dir, which can be opened by a TableCluster configured with
+// dir as its DataDir. The memtables are flushed first, then every data file and value log segment is hard linked into
+// dir, or copied when dir is on another file system, along with a matching metadata file. Writes are not blocked, the
+// ones issued after the flush are not part of the checkpoint.
+func (t *TableCluster) Checkpoint(dir string) error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("%w: create checkpoint directory: %w", ErrIO, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, MetadataFileName)); err == nil {
+		return fmt.Errorf("checkpoint directory %s already holds a metadata file", dir)
+	}
+
+	if err := t.flushMemTableToFTable(); err != nil {
+		return err
+	}
+
+	var clusterMetadata TableClusterMetadata
+	release := t.pinFiles(func() {
+		clusterMetadata = t.getTableClusterMetadata()
+	})
+	defer release()
+
+	linked := make([]string, 0)
+	for _, file := range clusterMetadata.dataFiles() {
+		src := filepath.Join(t.cfg.DataDir, file.FileName)
+		dst := filepath.Join(dir, file.FileName)
+		if err := linkOrCopyFile(src, dst); err != nil {
+			for _, name := range linked {
+				os.Remove(name)
+			}
+			return err
+		}
+		linked = append(linked, dst)
+	}
+
+	if err := WriteTableClusterMetadata(dir, clusterMetadata); err != nil {
+		return err
+	}
+	log.Printf("[INFO] Checkpoint of %d data files written to %s\n", len(linked), dir)
+	return nil
+}
+
+// replaceWithCheckpoint swaps the whole content of the cluster, memtables included, for the checkpoint Checkpoint
+// wrote into dir, which must be on the file system of the data directory since its files are moved there. The files
+// of the previous content are removed. It's how a follower catches up with its leader.
+func (t *TableCluster) replaceWithCheckpoint(dir string) error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+	clusterMetadata, err := ReadTableClusterMetadata(dir)
+	if err != nil {
+		return err
+	}
+	if err = t.cfg.checkComparator(clusterMetadata.Comparator); err != nil {
+		return err
+	}
+
+	t.valueLogGCLock.Lock()
+	defer t.valueLogGCLock.Unlock()
+	t.flushLock.Lock()
+	defer t.flushLock.Unlock()
+	t.compactionLock.Lock()
+	defer t.compactionLock.Unlock()
+
+	previous := make(map[string]int64)
+	for _, file := range t.getTableClusterMetadata().dataFiles() {
+		previous[file.FileName] = file.SizeInBytes
+	}
+	kept := make(map[string]bool)
+	for _, file := range clusterMetadata.dataFiles() {
+		// the files are named after the time they were written, one already in use comes from a previous checkpoint
+		// of the same leader
+		if size, ok := previous[file.FileName]; ok {
+			if size != file.SizeInBytes {
+				return fmt.Errorf("%w: %s of the checkpoint holds %d bytes, the one in use %d", ErrCorruption, file.FileName, file.SizeInBytes, size)
+			}
+			kept[file.FileName] = true
+			continue
+		}
+		if err = os.Rename(filepath.Join(dir, file.FileName), filepath.Join(t.cfg.DataDir, file.FileName)); err != nil {
+			return fmt.Errorf("%w: move checkpoint file: %w", ErrIO, err)
+		}
+	}
+	ftables, err := t.openFTables(clusterMetadata)
+	if err != nil {
+		return err
+	}
+
+	// the previous files are closed once the scans, backups and checkpoints reading them are over
+	t.whenUnpinned(func() {
+		t.memTableLock.Lock()
+		for i := range t.ftablesLock {
+			t.ftablesLock[i].Lock()
+		}
+		err = t.valueLog.load(clusterMetadata.ValueLogSegments)
+		previousFTables := t.ftables
+		if err == nil {
+			t.ftables = ftables
+			// the backed up memtables are dropped along with the memtables
+			t.flushedMemTableID.Store(t.lastMemTableID.Load())
+			t.immutables = nil
+			t.memtable = t.newMemTable()
+		}
+		for i := range t.ftablesLock {
+			t.ftablesLock[i].Unlock()
+		}
+		t.memTableLock.Unlock()
+		if err == nil {
+			closeFTables(previousFTables)
+		}
+	})
+	if err != nil {
+		closeFTables(ftables)
+		return err
+	}
+	defer t.notifyWriteStallChange()
+
+	if err = t.SnapshotTableClusterMetadata(); err != nil {
+		return err
+	}
+	for name := range previous {
+		if !kept[name] {
+			os.Remove(filepath.Join(t.cfg.DataDir, name))
+		}
+	}
+	log.Printf("[INFO] Content replaced by the checkpoint of %s\n", dir)
+	return nil
+}
+
+// linkOrCopyFile hard links src to dst. The data files are never modified once written, so sharing them is safe.
+// The file is copied when the link fails, e.g. when dst is on another file system.
+func linkOrCopyFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%w: link %s: %w", ErrIO, dst, err)
+	}
+
+	return copyFile(src, dst)
+}
+
+// copyFile copies src into a new file dst and syncs it, dst is removed if the copy fails.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("%w: open %s: %w", ErrIO, src, err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: create %s: %w", ErrIO, dst, err)
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("%w: copy %s to %s: %w", ErrIO, src, dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package keynest
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointCanBeOpened(t *testing.T) {
+	tc := newTestTableCluster(t, t.TempDir())
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 20; i++ {
+			if err := tc.Put(fmt.Sprintf("key-%03d", i*4+round), fmt.Sprintf("val-%d", round)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	// the memtable content must be part of the checkpoint too
+	if err := tc.Put("key-memtable", "in memory"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	if err := tc.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Checkpoint(dir); err == nil {
+		t.Fatal("expected a second checkpoint into the same directory to fail")
+	}
+
+	restored := newTestTableCluster(t, dir)
+	if err := restored.LoadTableClusterMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 80; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		val, ok, err := restored.Get(key)
+		if err != nil || !ok || val != fmt.Sprintf("val-%d", i%4) {
+			t.Errorf("unexpected %s: %v %v %v", key, val, ok, err)
+		}
+	}
+	if val, ok, err := restored.Get("key-memtable"); err != nil || !ok || val != "in memory" {
+		t.Errorf("unexpected key-memtable: %v %v %v", val, ok, err)
+	}
+}
+
+func TestLoadRefusesAnotherFormatVersion(t *testing.T) {
+	dir := t.TempDir()
+	tc := newTestTableCluster(t, dir)
+	if err := tc.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clusterMetadata, err := ReadTableClusterMetadata(dir)
+	if err != nil || clusterMetadata.FormatVersion != formatVersion {
+		t.Fatalf("ReadTableClusterMetadata() = %d, %v, want format version %d", clusterMetadata.FormatVersion, err, formatVersion)
+	}
+
+	// the metadata of the data files written before the format version was recorded has none
+	clusterMetadata.FormatVersion = 0
+	if err = WriteTableClusterMetadata(dir, clusterMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if err = newTestTableCluster(t, dir).LoadTableClusterMetadata(); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("LoadTableClusterMetadata() = %v, want ErrUnsupportedFormat", err)
+	}
+	if _, err = VerifyDataDir(dir); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("VerifyDataDir() = %v, want ErrUnsupportedFormat", err)
+	}
+}
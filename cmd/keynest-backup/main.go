@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"keynest"
+	"log"
+	"os"
+	"time"
+)
+
+const usage = `usage: keynest-backup <command> [flags]
+
+commands:
+  create   back up the tables of a data directory
+  restore  restore a backup into an empty data directory
+  list     list the backups
+  verify   check the data files of a backup against its manifest
+  purge    delete the old backups
+
+run keynest-backup <command> -h for the flags of a command
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	backupDir := flags.String("backup-dir", "", "directory of the backups")
+	var err error
+	switch os.Args[1] {
+	case "create":
+		dataDir := flags.String("data-dir", "", "data directory of a stopped keynest, or a checkpoint")
+		flags.Parse(os.Args[2:])
+		requireFlag(*backupDir, "backup-dir")
+		var info keynest.BackupInfo
+		if info, err = keynest.CreateBackup(*dataDir, *backupDir); err == nil {
+			fmt.Printf("backup %d created: %d tables, %d bytes copied\n", info.ID, info.NewTables, info.NewBytes)
+		}
+	case "restore":
+		dataDir := flags.String("data-dir", "", "empty directory to restore the backup into")
+		id := flags.Int("id", 0, "id of the backup to restore, the newest one by default")
+		flags.Parse(os.Args[2:])
+		requireFlag(*backupDir, "backup-dir")
+		requireFlag(*dataDir, "data-dir")
+		err = keynest.RestoreBackup(*backupDir, *id, *dataDir)
+	case "list":
+		flags.Parse(os.Args[2:])
+		requireFlag(*backupDir, "backup-dir")
+		var infos []keynest.BackupInfo
+		if infos, err = keynest.ListBackups(*backupDir); err == nil {
+			for _, info := range infos {
+				fmt.Printf("%d\t%s\t%d tables\t%d bytes\n", info.ID, info.CreatedAt.Format(time.RFC3339), info.NTables, info.SizeInBytes)
+			}
+		}
+	case "verify":
+		id := flags.Int("id", 0, "id of the backup to verify, the newest one by default")
+		flags.Parse(os.Args[2:])
+		requireFlag(*backupDir, "backup-dir")
+		if err = keynest.VerifyBackup(*backupDir, *id); err == nil {
+			fmt.Println("backup ok")
+		}
+	case "purge":
+		keep := flags.Int("keep", 1, "number of the newest backups to keep")
+		flags.Parse(os.Args[2:])
+		requireFlag(*backupDir, "backup-dir")
+		var purged []int
+		if purged, err = keynest.PurgeOldBackups(*backupDir, *keep); err == nil {
+			fmt.Printf("%d backups purged: %v\n", len(purged), purged)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", os.Args[1], err)
+	}
+}
+
+func requireFlag(val, name string) {
+	if val == "" {
+		log.Fatalf("-%s is required", name)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"keynest"
+	"log"
+	"os"
+)
+
+const usage = `usage: keynest-dump <command> [flags]
+
+commands:
+  export  write every live key and its newest value as JSON Lines or CSV
+  import  bulk-load a JSON Lines or CSV export
+
+run keynest-dump <command> -h for the flags of a command
+`
+
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "export" && os.Args[1] != "import") {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command := os.Args[1]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	dataDir := flags.String("data-dir", "", "data directory of a stopped keynest, the working directory by default")
+	format := flags.String("format", "jsonl", "jsonl or csv")
+	file := flags.String("file", "", "file to export to or import from, stdout or stdin by default")
+	comparator := flags.String("comparator", "bytewise", "order of the keys, the one keynest runs with")
+	flags.Parse(os.Args[2:])
+	if *format != "jsonl" && *format != "csv" {
+		log.Fatalf("unknown format %q", *format)
+	}
+	cmp, err := keynest.ComparatorByName(*comparator)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// no background job runs, the data directory is only written by an import, whose tables are compacted before
+	// closing
+	cluster := keynest.NewTableCluster(&keynest.Config{
+		DataDir:               *dataDir,
+		IndexSkipNum:          2,
+		WriteBufferSize:       1024 * 4,
+		FalsePositiveRate:     0.01,
+		Lvl0MaxTableNum:       4,
+		MemMaxNum:             1000,
+		MaxSubcompactions:     4,
+		SubcompactionMinBytes: 1024 * 1024,
+		TargetFileSize:        2 * 1024 * 1024,
+		Comparator:            cmp,
+	})
+	if err := cluster.LoadTableClusterMetadata(); err != nil && !(command == "import" && errors.Is(err, fs.ErrNotExist)) {
+		log.Fatalf("Error loading the table cluster: %v", err)
+	}
+
+	n, err := run(cluster, command, *format, *file)
+	if closeErr := cluster.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("%s failed after %d records: %v", command, n, err)
+	}
+	log.Printf("%d records %sed\n", n, command)
+}
+
+func run(cluster *keynest.TableCluster, command, format, file string) (int, error) {
+	if command == "export" {
+		var w io.Writer = os.Stdout
+		if file != "" {
+			f, err := os.Create(file)
+			if err != nil {
+				return 0, err
+			}
+			defer f.Close()
+			w = f
+		}
+		if format == "csv" {
+			return cluster.ExportCSV(w)
+		}
+		return cluster.ExportJSONL(w)
+	}
+
+	var r io.Reader = os.Stdin
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	importFn := cluster.ImportJSONL
+	if format == "csv" {
+		importFn = cluster.ImportCSV
+	}
+	n, err := importFn(r)
+	if err != nil {
+		return n, err
+	}
+	return n, cluster.TriggerCompaction()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"keynest"
+	"log"
+	"os"
+)
+
+func main() {
+	dataDir := flag.String("data-dir", "", "data directory of a stopped keynest, or a checkpoint, the working directory by default")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	report, err := keynest.VerifyDataDir(*dataDir)
+	if err != nil {
+		log.Fatalf("verify failed: %v", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		for _, issue := range report.Issues {
+			fmt.Printf("lvl %d\t%s\t%s\t%s\n", issue.Level, issue.FileName, issue.Check, issue.Message)
+		}
+		fmt.Printf("%d tables, %d records, %d issues\n", report.Tables, report.Records, len(report.Issues))
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
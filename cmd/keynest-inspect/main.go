@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"keynest"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const usage = `usage: keynest-inspect <command> [flags]
+
+commands:
+  dump    print the records of a table: offset, key, tombstone, value size, chunks and decoded value
+  index   print the bloom filter parameters and the sparse index of a table
+  levels  print the level layout stored in master-metadata
+  get     look a key up in a single table
+
+run keynest-inspect <command> -h for the flags of a command
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	var err error
+	switch os.Args[1] {
+	case "dump":
+		file := flags.String("file", "", "data file of the table")
+		limit := flags.Int("limit", 0, "maximum number of records to print, 0 prints them all")
+		flags.Parse(os.Args[2:])
+		err = dump(os.Stdout, *file, *limit)
+	case "index":
+		file := flags.String("file", "", "data file of the table")
+		flags.Parse(os.Args[2:])
+		err = index(os.Stdout, *file)
+	case "levels":
+		dataDir := flags.String("data-dir", "", "directory holding master-metadata, the working directory by default")
+		flags.Parse(os.Args[2:])
+		err = levels(os.Stdout, *dataDir)
+	case "get":
+		file := flags.String("file", "", "data file of the table")
+		key := flags.String("key", "", "key to look up")
+		flags.Parse(os.Args[2:])
+		err = get(os.Stdout, *file, *key)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", os.Args[1], err)
+	}
+}
+
+// findTableMetadata looks the table up in the master-metadata next to its data file, and returns its level.
+func findTableMetadata(file string) (keynest.TableMetadata, int, error) {
+	clusterMetadata, err := keynest.ReadTableClusterMetadata(filepath.Dir(file))
+	if err != nil {
+		return keynest.TableMetadata{}, 0, err
+	}
+	for lvl := range clusterMetadata.FTableMetadata {
+		for _, metadata := range clusterMetadata.FTableMetadata[lvl] {
+			if metadata.FileName == filepath.Base(file) {
+				return metadata, lvl, nil
+			}
+		}
+	}
+	return keynest.TableMetadata{}, 0, fmt.Errorf("%s is not listed in %s", filepath.Base(file), keynest.MetadataFileName)
+}
+
+// tableComparator returns the comparator recorded in the master-metadata next to the data file, bytewise when there
+// is no readable metadata.
+func tableComparator(file string) (keynest.Comparator, error) {
+	clusterMetadata, err := keynest.ReadTableClusterMetadata(filepath.Dir(file))
+	if err != nil {
+		return keynest.BytewiseComparator{}, nil
+	}
+	return keynest.ComparatorByName(clusterMetadata.Comparator)
+}
+
+// openTable opens the table with its metadata. A file missing from master-metadata, like an orphan left by a crash,
+// can still be read as far as its size goes.
+func openTable(file string) (*keynest.FTable, bool, error) {
+	if file == "" {
+		return nil, false, fmt.Errorf("-file is required")
+	}
+	cmp, err := tableComparator(file)
+	if err != nil {
+		return nil, false, err
+	}
+	metadata, _, err := findTableMetadata(file)
+	listed := err == nil
+	if !listed {
+		stat, statErr := os.Stat(file)
+		if statErr != nil {
+			return nil, false, statErr
+		}
+		log.Printf("no metadata for %s (%v), reading the whole file\n", file, err)
+		metadata = keynest.TableMetadata{
+			FileName:    filepath.Base(file),
+			SizeInBytes: stat.Size(),
+		}
+	}
+	ftable, err := keynest.OpenFTable(filepath.Dir(file), metadata, &keynest.Config{Comparator: cmp})
+	return ftable, listed, err
+}
+
+func dump(w io.Writer, file string, limit int) error {
+	ftable, _, err := openTable(file)
+	if err != nil {
+		return err
+	}
+	defer ftable.Close()
+
+	n := 0
+	it := ftable.NewIterator()
+	for it.SeekToFirst(); it.Valid() && (limit == 0 || n < limit); it.Next() {
+		value := "-"
+		if !it.Tombstone() {
+			if value, err = formatValue(it); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "%d\t%q\ttombstone=%t\tvalue_size=%d\tchunks=%d\t%s\t%s\n", it.Offset(), it.Key(), it.Tombstone(), it.ValueSize(), it.Chunks(), it.ValueType(), value)
+		n++
+	}
+	if err = it.Err(); err != nil {
+		return fmt.Errorf("after %d records: %w", n, err)
+	}
+	fmt.Fprintf(w, "%d records\n", n)
+	return nil
+}
+
+func index(w io.Writer, file string) error {
+	metadata, lvl, err := findTableMetadata(file)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "file: %s\nlevel: %d\nrecords: %d\nsize: %d bytes\nkeys: %q .. %q\n",
+		metadata.FileName, lvl, metadata.NRecords, metadata.SizeInBytes, metadata.MinKey, metadata.MaxKey)
+	set := 0
+	for _, bit := range metadata.BloomFilter.BitArray {
+		if bit {
+			set++
+		}
+	}
+	fmt.Fprintf(w, "bloom filter: %d bits, %d hash functions, %d bits set\n",
+		metadata.BloomFilter.Size, metadata.BloomFilter.HashFuncs, set)
+	fmt.Fprintf(w, "sparse index: %d entries\n", len(metadata.SparseIndex))
+	for _, entry := range metadata.SparseIndex {
+		fmt.Fprintf(w, "%d\t%q\ttombstone=%t\tkey_size=%d\tvalue_size=%d\n",
+			entry.Offset, entry.Key, entry.Tombstone, entry.KeySize, entry.ValSize)
+	}
+	return nil
+}
+
+func levels(w io.Writer, dataDir string) error {
+	clusterMetadata, err := keynest.ReadTableClusterMetadata(dataDir)
+	if err != nil {
+		return err
+	}
+	cmp, err := keynest.ComparatorByName(clusterMetadata.Comparator)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "flushed memtable id: %d\n", clusterMetadata.FlushedMemTableID)
+	fmt.Fprintf(w, "comparator: %s\n", cmp.Name())
+	for lvl, tables := range clusterMetadata.FTableMetadata {
+		records, size := 0, int64(0)
+		for _, metadata := range tables {
+			records += metadata.NRecords
+			size += metadata.SizeInBytes
+		}
+		fmt.Fprintf(w, "lvl %d: %d tables, %d records, %d bytes\n", lvl, len(tables), records, size)
+		for _, metadata := range tables {
+			fmt.Fprintf(w, "  %s\t%d records\t%d bytes\t%q .. %q\n",
+				metadata.FileName, metadata.NRecords, metadata.SizeInBytes, metadata.MinKey, metadata.MaxKey)
+		}
+	}
+	return nil
+}
+
+// get reports every step of a lookup. The file is also scanned around the key regardless of the bloom filter, so a
+// key wrongly ruled out by the filter shows up.
+func get(w io.Writer, file, key string) error {
+	if key == "" {
+		return fmt.Errorf("-key is required")
+	}
+	ftable, listed, err := openTable(file)
+	if err != nil {
+		return err
+	}
+	defer ftable.Close()
+
+	if listed {
+		cmp, err := tableComparator(file)
+		if err != nil {
+			return err
+		}
+		compare := func(a, b string) int { return cmp.Compare([]byte(a), []byte(b)) }
+		metadata := ftable.GetSnapshotTableMetadata()
+		fmt.Fprintf(w, "in key range: %t\n", compare(metadata.MinKey, key) <= 0 && compare(key, metadata.MaxKey) <= 0)
+		fmt.Fprintf(w, "bloom filter might contain: %t\n", metadata.BloomFilter.MightContains(key))
+		i := sort.Search(len(metadata.SparseIndex), func(i int) bool {
+			return compare(metadata.SparseIndex[i].Key, key) >= 0
+		})
+		if i > 0 {
+			fmt.Fprintf(w, "sparse index entry before the key: %q at offset %d\n", metadata.SparseIndex[i-1].Key, metadata.SparseIndex[i-1].Offset)
+		}
+		val, ok, err := ftable.Get(key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "get: found=%t value=%v\n", ok, val)
+	}
+
+	// without metadata the sparse index is empty, the seek reads the file from the start
+	it := ftable.NewIterator()
+	it.Seek(key)
+	if err = it.Err(); err != nil {
+		return err
+	}
+	if !it.Valid() || it.Key() != key {
+		fmt.Fprintln(w, "scan: key not in the file")
+		return nil
+	}
+	value, err := formatValue(it)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "scan: offset=%d tombstone=%t value_size=%d type=%s value=%s\n", it.Offset(), it.Tombstone(), it.ValueSize(), it.ValueType(), value)
+	return nil
+}
+
+// formatValue prints the value the way the HTTP API serves it, raw bytes are printed in hex.
+func formatValue(it *keynest.FTableIterator) (string, error) {
+	if it.Separated() {
+		ptr := it.Value().(keynest.ValuePointer)
+		return fmt.Sprintf("-> vlog-%d.log@%d+%d", ptr.Segment, ptr.Offset, ptr.Size), nil
+	}
+	if it.ValueType() == keynest.ValueTypeBytes {
+		return fmt.Sprintf("%x", it.Value()), nil
+	}
+	body, err := keynest.EncodeValue(it.ValueType(), it.Value())
+	return string(body), err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"keynest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTable flushes a single table into a new data directory and returns the path of its data file.
+func writeTable(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	cluster := keynest.NewTableCluster(&keynest.Config{
+		DataDir:           dir,
+		IndexSkipNum:      4,
+		WriteBufferSize:   1024,
+		FalsePositiveRate: 0.01,
+		Lvl0MaxTableNum:   4,
+		MemMaxNum:         1000,
+	})
+	for i := 0; i < 10; i++ {
+		if err := cluster.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("val-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cluster.Put("raw", []byte{0xca, 0xfe}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Delete("key-5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clusterMetadata, err := keynest.ReadTableClusterMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusterMetadata.FTableMetadata[0]) != 1 {
+		t.Fatalf("expected a single lvl 0 table, got %+v", clusterMetadata.FTableMetadata)
+	}
+	return filepath.Join(dir, clusterMetadata.FTableMetadata[0][0].FileName)
+}
+
+func TestDump(t *testing.T) {
+	file := writeTable(t)
+
+	out := bytes.Buffer{}
+	if err := dump(&out, file, 0); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 12 || lines[11] != "11 records" {
+		t.Fatalf("dump printed %d lines:\n%s", len(lines), out.String())
+	}
+	for _, want := range []string{`"key-0"	tombstone=false`, `"key-5"	tombstone=true`, `"raw"	tombstone=false`, "\tcafe\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("dump output misses %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := dump(&out, file, 3); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "\n3 records\n") {
+		t.Errorf("dump -limit 3 printed:\n%s", out.String())
+	}
+}
+
+func TestIndexAndLevels(t *testing.T) {
+	file := writeTable(t)
+
+	out := bytes.Buffer{}
+	if err := index(&out, file); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"level: 0\n", "records: 11\n", `keys: "key-0" .. "raw"`, "sparse index: "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("index output misses %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := levels(&out, filepath.Dir(file)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"comparator: bytewise\n", "lvl 0: 1 tables, 11 records", "lvl 1: 0 tables", filepath.Base(file)} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("levels output misses %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	file := writeTable(t)
+	// a copy missing from master-metadata is read without its sparse index nor its bloom filter
+	orphan := filepath.Join(filepath.Dir(file), "0-1.kv")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(orphan, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		file, key string
+		want      []string
+	}{
+		{file, "key-3", []string{"in key range: true\n", "bloom filter might contain: true\n", "get: found=true value=val-3\n", "scan: offset=", "type=plain-text/string value=val-3\n"}},
+		{file, "key-5", []string{"get: found=false", "tombstone=true"}},
+		{file, "zzz", []string{"in key range: false\n", "scan: key not in the file\n"}},
+		{orphan, "key-7", []string{"scan: offset=", "value=val-7\n"}},
+	} {
+		out := bytes.Buffer{}
+		if err = get(&out, tt.file, tt.key); err != nil {
+			t.Fatalf("get %s %s: %v", filepath.Base(tt.file), tt.key, err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("get %s %s output misses %q:\n%s", filepath.Base(tt.file), tt.key, want, out.String())
+			}
+		}
+		if tt.file == orphan && strings.Contains(out.String(), "get:") {
+			t.Errorf("get of an orphan looked the key up through the metadata:\n%s", out.String())
+		}
+	}
+
+	if err = get(&bytes.Buffer{}, file, ""); err == nil {
+		t.Error("expected an error without -key")
+	}
+	if err = get(&bytes.Buffer{}, "", "key-3"); err == nil {
+		t.Error("expected an error without -file")
+	}
+}
+
+func TestFindTableMetadata(t *testing.T) {
+	file := writeTable(t)
+	metadata, lvl, err := findTableMetadata(file)
+	if err != nil || lvl != 0 || metadata.FileName != filepath.Base(file) || metadata.NRecords != 11 {
+		t.Fatalf("findTableMetadata = %s, %d, %v", metadata.FileName, lvl, err)
+	}
+	if _, _, err = findTableMetadata(filepath.Join(filepath.Dir(file), "0-1.kv")); err == nil {
+		t.Error("expected an error for a file missing from master-metadata")
+	}
+}
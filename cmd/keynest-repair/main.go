@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"keynest"
+	"log"
+)
+
+func main() {
+	dataDir := flag.String("data-dir", "", "data directory of a stopped keynest, the working directory by default")
+	indexSkipNum := flag.Int("index-skip-num", 2, "records between two sparse index entries, see Config.IndexSkipNum")
+	falsePositiveRate := flag.Float64("false-positive-rate", 0.01, "bloom filter false positive rate")
+	targetFileSize := flag.Int64("target-file-size", 2*1024*1024, "size of the tables written when merging overlapping lvl 1 tables")
+	comparator := flag.String("comparator", "bytewise", "order of the keys, the one keynest runs with")
+	flag.Parse()
+	cmp, err := keynest.ComparatorByName(*comparator)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report, err := keynest.Repair(&keynest.Config{
+		DataDir:           *dataDir,
+		IndexSkipNum:      *indexSkipNum,
+		WriteBufferSize:   1024 * 4,
+		FalsePositiveRate: *falsePositiveRate,
+		TargetFileSize:    *targetFileSize,
+		Comparator:        cmp,
+	})
+	if err != nil {
+		log.Fatalf("repair failed: %v", err)
+	}
+
+	for _, table := range report.Tables {
+		status := "ok"
+		if table.Removed {
+			status = "removed, no readable record"
+		} else if table.TruncatedBytes > 0 {
+			status = fmt.Sprintf("%d corrupted bytes truncated", table.TruncatedBytes)
+		}
+		fmt.Printf("lvl %d\t%s\t%d records\t%d bytes\t%s\n", table.Level, table.FileName, table.NRecords, table.SizeInBytes, status)
+	}
+	for _, segment := range report.ValueLogSegments {
+		status := "ok"
+		if segment.TruncatedBytes > 0 {
+			status = fmt.Sprintf("%d bytes of an incomplete entry truncated", segment.TruncatedBytes)
+		}
+		fmt.Printf("vlog\t%s\t%d bytes\t%s\n", segment.FileName, segment.SizeInBytes, status)
+	}
+	for _, name := range report.SkippedFiles {
+		fmt.Printf("skipped %s, not named like a data file\n", name)
+	}
+	if report.MergedTables > 0 {
+		fmt.Printf("%d overlapping lvl 1 tables merged into %d tables\n", report.MergedTables, report.MergeOutputs)
+	}
+	if report.IgnoredMemTables > 0 {
+		fmt.Printf("%d backed up memtables ignored, it's unknown whether they were flushed\n", report.IgnoredMemTables)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"keynest/sharding"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", ":8090", "address the router listens on")
+	nodes := flag.String("nodes", "", "comma separated base URLs of the keynest servers, ignored once the state file exists")
+	vnodes := flag.Int("vnodes", sharding.DefaultVirtualNodes, "virtual nodes of every server on the hash ring, it must not change once the servers hold keys")
+	stateFile := flag.String("state-file", "keynest-router.json", "file keeping the servers across restarts, empty keeps them in memory only")
+	flag.Parse()
+
+	cfg := sharding.Config{VirtualNodes: *vnodes, StateFile: *stateFile}
+	for _, node := range strings.Split(*nodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			cfg.Nodes = append(cfg.Nodes, node)
+		}
+	}
+	router, err := sharding.NewRouter(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(router.Status().Nodes) == 0 {
+		log.Fatal("no keynest server, set -nodes")
+	}
+
+	server := &http.Server{
+		Addr:        *addr,
+		Handler:     router.Handler(),
+		ReadTimeout: 10 * time.Second,
+		IdleTimeout: 10 * time.Second,
+	}
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		<-sigCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Printf("Routing %s to %v\n", *addr, router.Status().Nodes)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Could not listen on %s: %v", *addr, err)
+	}
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"keynest"
 	testcase_gen "keynest/testcase-gen"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -20,15 +31,89 @@ type Response struct {
 }
 
 func main() {
-	cluster := keynest.NewTableCluster(&keynest.Config{
-		IndexSkipNum:       2,
-		WriteBufferSize:    1024 * 4,
-		FalsePositiveRate:  0.01,
-		Lvl0MaxTableNum:    4,
-		MemMaxNum:          1000,
-		CompactionInterval: time.Second * 4,
-		MemFlushInterval:   time.Second * 2,
-	})
+	dataDir := flag.String("data-dir", "", "directory of the data files, the working directory by default")
+	valueCodec := flag.String("value-codec", "msgpack", "codec of the values of the new tables: msgpack, json, gob or raw")
+	comparator := flag.String("comparator", "bytewise", "order of the keys: bytewise or reverse-bytewise, it can't change once the data dir holds tables")
+	valueLogThreshold := flag.Int("value-log-threshold", 4*1024, "size in bytes from which a value is moved to the value log, 0 keeps every value in the tables")
+	addr := flag.String("addr", ":8080", "address the server listens on")
+	replicationLogSize := flag.Int("replication-log-size", 100000, "number of the newest mutations kept for the followers, 0 disables the replication endpoints")
+	follow := flag.String("follow", "", "URL of a leader keynest, the server is then a read-only follower of it")
+	raftID := flag.String("raft-id", "", "id of this server in -raft-peers, the writes then go through a raft log replicated to the peers")
+	raftPeers := flag.String("raft-peers", "", "comma separated id=URL of every server of the raft group, this one included")
+	raftDir := flag.String("raft-dir", "", "directory of the raft log and snapshots, <data-dir>/raft by default")
+	backupRoot := flag.String("backup-root", "", "directory holding the dir of /admin/checkpoint and /admin/backup, <data-dir>/backups by default")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "time allowed to read a request along with its body")
+	writeTimeout := flag.Duration("write-timeout", 30*time.Second, "time allowed to answer a request, the scan, admin and trigger endpoints aren't bound by it")
+	flag.Parse()
+	codec, err := keynest.ValueCodecByName(*valueCodec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmp, err := keynest.ComparatorByName(*comparator)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := &keynest.Config{
+		DataDir:                 *dataDir,
+		IndexSkipNum:            2,
+		WriteBufferSize:         1024 * 4,
+		FalsePositiveRate:       0.01,
+		Lvl0MaxTableNum:         4,
+		MemMaxNum:               1000,
+		CompactionInterval:      time.Second * 4,
+		MemFlushInterval:        time.Second * 2,
+		MemBackupInterval:       time.Second,
+		MaxSubcompactions:       4,
+		SubcompactionMinBytes:   1024 * 1024,
+		TargetFileSize:          2 * 1024 * 1024,
+		Lvl0SlowdownTableNum:    8,
+		Lvl0StopTableNum:        12,
+		MemSlowdownNum:          10000,
+		MemStopNum:              20000,
+		ImmutableMemSlowdownNum: 2,
+		ImmutableMemStopNum:     4,
+		WriteStopTimeout:        time.Millisecond * 500,
+		ValueCodec:              codec,
+		MaxKeySize:              4 * 1024,
+		MaxValueSize:            64 * 1024 * 1024,
+		ValueChunkSize:          1024 * 1024,
+		Comparator:              cmp,
+		ValueLogThreshold:       *valueLogThreshold,
+		ValueLogGCInterval:      time.Minute,
+		ValueLogGCDiscardRatio:  0.5,
+		ReplicationLogSize:      *replicationLogSize,
+	}
+	cluster := keynest.NewTableCluster(cfg)
+	// pick up the tables and the backed up memtables of the previous run, a fresh data dir has none
+	if err := cluster.LoadTableClusterMetadata(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatalf("Error loading the table cluster, keynest-repair can rebuild the metadata: %v", err)
+	}
+	var follower *keynest.Follower
+	if *follow != "" {
+		follower = keynest.StartFollower(cluster, *follow)
+	}
+	var node *keynest.RaftNode
+	if *raftID != "" {
+		if follower != nil {
+			log.Fatal("-follow and -raft-id are exclusive")
+		}
+		peers, err := parseRaftPeers(*raftPeers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *raftDir == "" {
+			*raftDir = filepath.Join(*dataDir, "raft")
+		}
+		node, err = keynest.NewRaftNode(cluster, keynest.RaftConfig{ID: *raftID, Peers: peers, Dir: *raftDir})
+		if err != nil {
+			log.Fatalf("Error starting the raft node: %v", err)
+		}
+	}
+	if *backupRoot == "" {
+		*backupRoot = filepath.Join(*dataDir, "backups")
+	}
+	retryAfter := strconv.Itoa(int(math.Ceil(cfg.CompactionInterval.Seconds())))
 	mux := http.NewServeMux()
 
 	mux.Handle("/add-records", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -45,17 +130,41 @@ func main() {
 					Message:    "internal server error",
 				}
 				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(resp.StatusCode)
 				json.NewEncoder(w).Encode(resp)
+				return
 			}
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(resp.StatusCode)
 			json.NewEncoder(w).Encode(resp)
 		}()
+		if follower != nil {
+			resp = &Response{
+				StatusCode: http.StatusForbidden,
+				Message:    "read-only follower of " + *follow,
+			}
+			return
+		}
 		records := testcase_gen.GenerateRandKeyPairs(1000)
 		for i, record := range records {
 			records[i].Key = fmt.Sprintf("%s-%s-%s", prefix, record.Key, suffix)
 			fmt.Println(records[i])
 		}
-		cluster.AddRecords(records)
+		var err error
+		if node != nil {
+			err = node.AddRecords(r.Context(), records)
+		} else {
+			err = cluster.AddRecords(records)
+		}
+		if leader := raftLeaderOf(err); leader != "" {
+			w.Header().Set("Location", leader+r.URL.RequestURI())
+			resp = &Response{
+				StatusCode: http.StatusTemporaryRedirect,
+				Message:    "not the raft leader",
+			}
+		} else if err != nil {
+			resp = newErrorResponse(err)
+		}
 	}))
 
 	mux.Handle("/record", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -71,73 +180,142 @@ func main() {
 			return
 		}
 
+		if (r.Method == http.MethodPut || r.Method == http.MethodDelete) && follower != nil {
+			w.Header().Set("reason", "read-only follower of "+*follow)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+			if stall, reason := cluster.WriteStall(); stall == keynest.WriteStallStop {
+				w.Header().Set("Retry-After", retryAfter)
+				w.Header().Set("reason", reason)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+
 		switch r.Method {
 		case http.MethodPut:
-			// Read from r.Body
-			var data any
-			contentType := strings.ToLower(r.Header.Get("Content-Type"))
-			switch contentType {
-			case "application/json":
-				if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Header().Set("reason", "invalid request body")
-					return
-				}
-			case "plain-text/string":
-				body, err := io.ReadAll(r.Body)
-				if err != nil {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Header().Set("reason", "invalid request body")
-					return
-				}
-				data = string(body)
-			case "plain-text/int32", "plain-text/int64":
-				body, err := io.ReadAll(r.Body)
-				numStr := string(body)
-				if err != nil {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Header().Set("reason", "invalid request body")
-					return
-				}
-				if contentType == "plain-text/int32" {
-					data, err = strconv.ParseInt(numStr, 10, 32)
-				} else {
-					data, err = strconv.ParseInt(numStr, 10, 64)
-				}
-				if err != nil {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Header().Set("reason", "failed to parse")
-					return
-				}
+			// a body over the value limit is refused before it's read whole
+			if cfg.MaxValueSize > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxValueSize)
+			}
+			body, err := io.ReadAll(r.Body)
+			if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+				w.Header().Set("reason", fmt.Sprintf("value larger than %d bytes", maxBytesErr.Limit))
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				w.Header().Set("reason", "invalid request body")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			valueType, err := keynest.ParseContentType(strings.ToLower(r.Header.Get("Content-Type")))
+			if err != nil {
+				w.Header().Set("reason", "unsupported content type")
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			data, err := keynest.DecodeValue(valueType, body)
+			if err != nil {
+				w.Header().Set("reason", "failed to parse")
+				w.WriteHeader(http.StatusBadRequest)
+				return
 			}
 
-			cluster.Put(key, data)
+			if node != nil {
+				err = node.PutTyped(r.Context(), key, data, valueType)
+			} else {
+				err = cluster.PutTyped(key, data, valueType)
+			}
+			if redirectToRaftLeader(w, r, err) {
+				return
+			}
+			if err != nil {
+				if errors.Is(err, keynest.ErrWriteStall) {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				writeError(w, err)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 		case http.MethodDelete:
-			cluster.Delete(key)
+			var err error
+			if node != nil {
+				err = node.Delete(r.Context(), key)
+			} else {
+				err = cluster.Delete(key)
+			}
+			if redirectToRaftLeader(w, r, err) {
+				return
+			}
+			if err != nil {
+				if errors.Is(err, keynest.ErrWriteStall) {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				writeError(w, err)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 		case http.MethodGet:
-			val, ok := cluster.Get(key)
+			var val any
+			var valueType keynest.ValueType
+			var ok bool
+			var err error
+			if node != nil {
+				// the read index makes every write acknowledged before the request visible
+				val, valueType, ok, err = node.GetTyped(r.Context(), key)
+			} else {
+				val, valueType, ok, err = cluster.GetTyped(key)
+			}
+			if err != nil {
+				writeError(w, err)
+				return
+			}
 			if !ok {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
+			body, err := keynest.EncodeValue(valueType, val)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if follower != nil {
+				w.Header().Set("Replication-Lag", strconv.FormatFloat(follower.Status().LagSeconds, 'f', 3, 64))
+			}
+			w.Header().Set("Content-Type", valueType.ContentType())
 			w.WriteHeader(http.StatusOK)
-			switch val.(type) {
-			case int64:
-				w.Header().Set("Content-Type", "plain-text/int64")
-				w.Write([]byte(strconv.FormatInt(val.(int64), 10)))
-			case int32:
-				w.Header().Set("Content-Type", "plain-text/int32")
-				w.Write([]byte(strconv.FormatInt(int64(val.(int32)), 10)))
-			case string:
-				w.Header().Set("Content-Type", "plain-text/string")
-				w.Write([]byte(val.(string)))
-			case any:
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(val)
+			w.Write(body)
+		}
+	}))
+
+	// GET /scan?after=&end=&limit= pages through the live keys in key order, as the JSON Lines of keynest-dump
+	mux.Handle("/scan", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 1000
+		}
+		if node != nil {
+			if _, err = node.ReadIndex(r.Context()); err != nil {
+				writeError(w, err)
+				return
 			}
 		}
+		body := &bytes.Buffer{}
+		if _, err = cluster.ExportRangeJSONL(body, query.Get("after"), query.Get("end"), limit); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body.Bytes())
 	}))
 
 	mux.Handle("/trigger-compact", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -151,13 +329,18 @@ func main() {
 					Message:    "internal server error",
 				}
 				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(resp.StatusCode)
 				json.NewEncoder(w).Encode(resp)
+				return
 			}
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(resp.StatusCode)
 			json.NewEncoder(w).Encode(resp)
 		}()
 
-		cluster.TriggerCompaction()
+		if err := cluster.TriggerCompaction(); err != nil {
+			resp = newErrorResponse(err)
+		}
 	}))
 
 	mux.Handle("/trigger-memflush", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -171,13 +354,18 @@ func main() {
 					Message:    "internal server error",
 				}
 				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(resp.StatusCode)
 				json.NewEncoder(w).Encode(resp)
+				return
 			}
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(resp.StatusCode)
 			json.NewEncoder(w).Encode(resp)
 		}()
 
-		cluster.TriggerMemFlush()
+		if err := cluster.TriggerMemFlush(); err != nil {
+			resp = newErrorResponse(err)
+		}
 	}))
 
 	mux.Handle("/trigger-snapshot", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -191,13 +379,18 @@ func main() {
 					Message:    "internal server error",
 				}
 				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(resp.StatusCode)
 				json.NewEncoder(w).Encode(resp)
+				return
 			}
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(resp.StatusCode)
 			json.NewEncoder(w).Encode(resp)
 		}()
 
-		cluster.SnapshotTableClusterMetadata()
+		if err := cluster.SnapshotTableClusterMetadata(); err != nil {
+			resp = newErrorResponse(err)
+		}
 	}))
 
 	mux.Handle("/trigger-load-metadata", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -212,20 +405,172 @@ func main() {
 					Message:    "internal server error",
 				}
 				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(resp.StatusCode)
 				json.NewEncoder(w).Encode(resp)
+				return
 			}
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(resp.StatusCode)
 			json.NewEncoder(w).Encode(resp)
 		}()
 
-		cluster.LoadTableClusterMetadata()
+		if err := cluster.LoadTableClusterMetadata(); err != nil {
+			resp = newErrorResponse(err)
+		}
+	}))
+
+	mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := cluster.WritePrometheus(w); err != nil {
+			log.Printf("[ERROR] Error writing metrics: %v", err)
+		}
 	}))
 
+	mux.Handle("/admin/levels", levelsHandler(cluster))
+
+	mux.Handle("/admin/verify", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := cluster.Verify()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}))
+
+	mux.Handle("/admin/rate-limit", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			rate, err := strconv.ParseInt(r.URL.Query().Get("bytes_per_sec"), 10, 64)
+			if err != nil || rate < 0 {
+				w.Header().Set("reason", "bytes_per_sec must be a non-negative integer")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			cluster.SetBackgroundIORate(rate)
+		case http.MethodGet:
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"bytes_per_sec": cluster.BackgroundIORate()})
+	}))
+
+	mux.Handle("/admin/vlog-gc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		discardRatio := cfg.ValueLogGCDiscardRatio
+		if s := r.URL.Query().Get("discard_ratio"); s != "" {
+			ratio, err := strconv.ParseFloat(s, 64)
+			if err != nil || ratio <= 0 || ratio > 1 {
+				w.Header().Set("reason", "discard_ratio must be in ]0, 1]")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			discardRatio = ratio
+		}
+		report, err := cluster.CollectValueLog(discardRatio)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}))
+
+	mux.Handle("/admin/checkpoint", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		resp := &Response{
+			StatusCode: http.StatusOK,
+		}
+		dir, err := backupDirOf(*backupRoot, r.URL.Query().Get("dir"))
+		if err != nil {
+			resp = &Response{
+				StatusCode: http.StatusBadRequest,
+				Message:    err.Error(),
+			}
+		} else if err = cluster.Checkpoint(dir); err != nil {
+			resp = newErrorResponse(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		json.NewEncoder(w).Encode(resp)
+	}))
+
+	mux.Handle("/admin/backup", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		resp := &Response{
+			StatusCode: http.StatusOK,
+		}
+		dir, err := backupDirOf(*backupRoot, r.URL.Query().Get("dir"))
+		if err != nil {
+			resp = &Response{
+				StatusCode: http.StatusBadRequest,
+				Message:    err.Error(),
+			}
+		} else if info, err := cluster.Backup(dir); err != nil {
+			resp = newErrorResponse(err)
+		} else {
+			resp.Val = info
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		json.NewEncoder(w).Encode(resp)
+	}))
+
+	if *replicationLogSize > 0 {
+		mux.Handle(keynest.ReplicationHandlerPrefix, cluster.ReplicationHandler())
+	}
+	mux.Handle("/replication-status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if follower == nil {
+			w.Header().Set("reason", "not a follower")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(follower.Status())
+	}))
+	if node != nil {
+		mux.Handle(keynest.RaftHandlerPrefix, node.Handler())
+	}
+	mux.Handle("/raft-status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if node == nil {
+			w.Header().Set("reason", "not a raft node")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(node.Status())
+	}))
+
+	// the exports, backups and compactions take as long as the data they go through, the replication and raft
+	// endpoints set their own deadlines
+	longRunning := map[string]bool{
+		"/scan": true, "/trigger-compact": true, "/trigger-memflush": true, "/trigger-snapshot": true,
+		"/trigger-load-metadata": true, "/admin/verify": true, "/admin/vlog-gc": true, "/admin/checkpoint": true,
+		"/admin/backup": true,
+	}
 	server := &http.Server{
-		Addr:         ":8080",
-		Handler:      mux,
-		ReadTimeout:  1 * time.Second,
-		WriteTimeout: 1 * time.Second,
+		Addr: *addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if longRunning[r.URL.Path] {
+				controller := http.NewResponseController(w)
+				controller.SetReadDeadline(time.Time{})
+				controller.SetWriteDeadline(time.Time{})
+			}
+			mux.ServeHTTP(w, r)
+		}),
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
 		IdleTimeout:  10 * time.Second,
 	}
 
@@ -236,8 +581,115 @@ func main() {
 		}
 	}()
 
-	log.Println("Starting server on :8080")
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		<-sigCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Printf("Starting server on %s\n", *addr)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Could not listen on :8080: %v", err)
+		log.Fatalf("Could not listen on %s: %v", *addr, err)
+	}
+	if follower != nil {
+		follower.Close()
+	}
+	if node != nil {
+		node.Close()
+	}
+	if err := cluster.Close(); err != nil {
+		log.Printf("[ERROR] Error closing cluster: %v", err)
+	}
+}
+
+// statusCodeOf maps an error returned by the cluster to the HTTP status code sent to the client.
+func statusCodeOf(err error) int {
+	switch {
+	case errors.Is(err, keynest.ErrClosed), errors.Is(err, keynest.ErrWriteStall), errors.Is(err, keynest.ErrNotLeader):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, keynest.ErrUnsupportedContentType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, keynest.ErrEmptyKey):
+		return http.StatusBadRequest
+	case errors.Is(err, keynest.ErrKeyTooLarge), errors.Is(err, keynest.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, keynest.ErrCorruption), errors.Is(err, keynest.ErrIO):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// backupDirOf resolves the dir of an admin request within root, it must be a relative path that stays in root.
+func backupDirOf(root, dir string) (string, error) {
+	if dir == "" {
+		return "", errors.New("dir is required")
+	}
+	if !filepath.IsLocal(dir) || slices.Contains(strings.Split(filepath.ToSlash(dir), "/"), "..") {
+		return "", fmt.Errorf("dir %q must be a path relative to the backup root, without ..", dir)
 	}
+	return filepath.Join(root, dir), nil
+}
+
+// parseRaftPeers parses the id=URL list of -raft-peers.
+func parseRaftPeers(list string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, peer := range strings.Split(list, ",") {
+		id, url, ok := strings.Cut(strings.TrimSpace(peer), "=")
+		if !ok || id == "" || url == "" {
+			return nil, fmt.Errorf("invalid raft peer %q, want id=URL", peer)
+		}
+		peers[id] = strings.TrimSuffix(url, "/")
+	}
+	return peers, nil
+}
+
+// raftLeaderOf returns the URL of the leader a write refused by a raft follower must be sent to, empty when err is
+// another error or the leader is unknown.
+func raftLeaderOf(err error) string {
+	notLeader := (*keynest.NotLeaderError)(nil)
+	if errors.As(err, &notLeader) {
+		return notLeader.Leader
+	}
+	return ""
+}
+
+// redirectToRaftLeader answers a write refused by a raft follower with a redirect to the leader, it returns false
+// for any other error.
+func redirectToRaftLeader(w http.ResponseWriter, r *http.Request, err error) bool {
+	leader := raftLeaderOf(err)
+	if leader == "" {
+		return false
+	}
+	http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	log.Printf("[ERROR] %v", err)
+	w.Header().Set("reason", err.Error())
+	w.WriteHeader(statusCodeOf(err))
+}
+
+func newErrorResponse(err error) *Response {
+	log.Printf("[ERROR] %v", err)
+	return &Response{
+		StatusCode: statusCodeOf(err),
+		Message:    err.Error(),
+	}
+}
+
+// levelsHandler answers GET /admin/levels with the Stats of the cluster.
+func levelsHandler(cluster *keynest.TableCluster) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cluster.Stats())
+	})
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"keynest"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatusCodeOf(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want int
+	}{
+		{keynest.ErrClosed, http.StatusServiceUnavailable},
+		{fmt.Errorf("get a: %w", keynest.ErrClosed), http.StatusServiceUnavailable},
+		{keynest.ErrWriteStall, http.StatusServiceUnavailable},
+		{fmt.Errorf("put a: %w", keynest.ErrWriteStall), http.StatusServiceUnavailable},
+		{keynest.ErrNotLeader, http.StatusServiceUnavailable},
+		{keynest.ErrUnsupportedContentType, http.StatusUnsupportedMediaType},
+		{keynest.ErrEmptyKey, http.StatusBadRequest},
+		{keynest.ErrKeyTooLarge, http.StatusRequestEntityTooLarge},
+		{keynest.ErrValueTooLarge, http.StatusRequestEntityTooLarge},
+		{keynest.ErrCorruption, http.StatusInternalServerError},
+		{keynest.ErrIO, http.StatusInternalServerError},
+	} {
+		if got := statusCodeOf(tt.err); got != tt.want {
+			t.Errorf("statusCodeOf(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestLevelsHandler(t *testing.T) {
+	cluster := keynest.NewTableCluster(&keynest.Config{
+		DataDir:            t.TempDir(),
+		IndexSkipNum:       4,
+		WriteBufferSize:    1024,
+		FalsePositiveRate:  0.01,
+		Lvl0MaxTableNum:    4,
+		MemMaxNum:          1000,
+		CompactionInterval: time.Hour,
+		MemFlushInterval:   time.Hour,
+	})
+	defer cluster.Close()
+	for i := 0; i < 10; i++ {
+		if err := cluster.Put(fmt.Sprintf("key-%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cluster.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Put("in-memory", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	levelsHandler(cluster).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/levels", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /admin/levels = %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	stats := keynest.ClusterStats{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.MemTableEntries != 1 || len(stats.Levels) != 2 || len(stats.Levels[0].Tables) != 1 {
+		t.Fatalf("GET /admin/levels = %+v, want 1 memtable entry and 1 lvl 0 table", stats)
+	}
+	table := stats.Levels[0].Tables[0]
+	if table.NRecords != 10 || table.MinKey != "key-0" || table.MaxKey != "key-9" || table.FileName == "" {
+		t.Fatalf("lvl 0 table = %+v", table)
+	}
+
+	recorder = httptest.NewRecorder()
+	levelsHandler(cluster).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/levels", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /admin/levels = %d, want 405", recorder.Code)
+	}
+}
+
+func TestBackupDirOf(t *testing.T) {
+	if dir, err := backupDirOf("/backups", "nightly/1"); err != nil || dir != filepath.Join("/backups", "nightly/1") {
+		t.Fatalf("backupDirOf(nightly/1) = %s, %v", dir, err)
+	}
+	for _, dir := range []string{"", "/etc", "..", "../data", "nightly/../../data", "nightly/../weekly"} {
+		if _, err := backupDirOf("/backups", dir); err == nil {
+			t.Errorf("backupDirOf(%q) succeeded, want an error", dir)
+		}
+	}
+}
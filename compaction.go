@@ -0,0 +1,492 @@
+package keynest
+
+import (
+	"container/heap"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// compactingLvl0 merges every lvl 0 table into lvl 1. A lvl 0 table overlapping neither another lvl 0 table nor
+// lvl 1 is moved as is. The key range of the others is split into disjoint subcompactions that are merged in
+// parallel. All the moved and output tables are installed at once. On error, none of the existing tables are
+// touched.
+func (t *TableCluster) compactingLvl0() error {
+	t.compactionLock.Lock()
+	defer t.compactionLock.Unlock()
+
+	//since the lvl 0 might be appended during compaction,
+	//so we need to lock the last index of which the compaction will start from index 0 till the last index
+	t.ftablesLock[0].RLock()
+	lastIndex := len(t.ftables[0])
+	lvl0Tables := slices.Clone(t.ftables[0][:lastIndex])
+	t.ftablesLock[0].RUnlock()
+	// a stop trigger at or under Lvl0MaxTableNum would block the writes forever without a compaction
+	if lastIndex <= t.cfg.Lvl0MaxTableNum && !triggerReached(lastIndex, t.cfg.Lvl0StopTableNum) {
+		return nil
+	}
+	defer t.notifyWriteStallChange()
+
+	start := time.Now()
+	log.Printf("[INFO] Start compaction job for %d ftables at %d\n", lastIndex, start.UnixMilli())
+
+	movedTables, mergedTables := t.pickTrivialMoves(lvl0Tables)
+	if len(movedTables) > 0 {
+		log.Printf("[INFO] %d ftables are moved to lvl 1 without rewrite\n", len(movedTables))
+	}
+
+	var newTables []*FTable
+	readBytes := int64(0)
+	minI, maxI := 0, 0
+	if len(mergedTables) > 0 {
+		var err error
+		newTables, minI, maxI, readBytes, err = t.mergeIntoLvl1(mergedTables, movedTables)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.installCompaction(lvl0Tables, movedTables, minI, maxI, newTables)
+
+	writtenBytes := int64(0)
+	for _, table := range newTables {
+		writtenBytes += table.sizeInBytes
+	}
+	log.Printf("[INFO] Compaction job done at %d for %d ftables\n", time.Now().UnixMilli(), lastIndex)
+	t.metrics.CompactionCount.Inc()
+	t.metrics.TrivialMoveCount.Add(uint64(len(movedTables)))
+	t.metrics.CompactionReadBytes.Add(uint64(readBytes))
+	t.metrics.CompactionWrittenBytes.Add(uint64(writtenBytes))
+	t.metrics.CompactionDuration.ObserveDuration(start)
+	return t.SnapshotTableClusterMetadata()
+}
+
+// pickTrivialMoves splits the lvl 0 tables into the ones overlapping neither another lvl 0 table nor lvl 1, which
+// can be moved to lvl 1 by a metadata-only change, and the ones that have to be merged.
+func (t *TableCluster) pickTrivialMoves(lvl0Tables []*FTable) (moved, merged []*FTable) {
+	t.ftablesLock[1].RLock()
+	defer t.ftablesLock[1].RUnlock()
+
+	for i, table := range lvl0Tables {
+		overlap := false
+		for j, other := range lvl0Tables {
+			if i != j && t.compare(table.minKey, other.maxKey) <= 0 && t.compare(other.minKey, table.maxKey) <= 0 {
+				overlap = true
+				break
+			}
+		}
+		if !overlap {
+			_, _, overlap = t.findOverlapTablesRange(1, table.minKey, table.maxKey)
+		}
+		if overlap {
+			merged = append(merged, table)
+		} else {
+			moved = append(moved, table)
+		}
+	}
+	return moved, merged
+}
+
+// mergeIntoLvl1 merges the lvl 0 tables with the overlapping lvl 1 tables, which are the ones in [minI, maxI) of
+// lvl 1. The moved tables are never spanned by an output table, so lvl 1 stays free of overlap once they are
+// installed side by side.
+func (t *TableCluster) mergeIntoLvl1(lvl0Tables, movedTables []*FTable) (newTables []*FTable, minI, maxI int, readBytes int64, err error) {
+	cmp := t.cfg.comparator()
+	minKey, maxKey := lvl0Tables[0].minKey, lvl0Tables[0].maxKey
+	for _, table := range lvl0Tables {
+		readBytes += table.sizeInBytes
+		minKey = minKeyOf(cmp, minKey, table.minKey)
+		maxKey = maxKeyOf(cmp, maxKey, table.maxKey)
+	}
+
+	t.ftablesLock[1].RLock()
+	minI, maxI, _ = t.findOverlapTablesRange(1, minKey, maxKey)
+	lvl1Tables := slices.Clone(t.ftables[1][minI:maxI])
+	t.ftablesLock[1].RUnlock()
+	for _, table := range lvl1Tables {
+		readBytes += table.sizeInBytes
+	}
+
+	boundaries := t.subcompactionBoundaries(lvl0Tables, lvl1Tables, readBytes)
+	for _, table := range movedTables {
+		boundaries = append(boundaries, table.minKey)
+	}
+	slices.SortFunc(boundaries, t.compare)
+	boundaries = slices.Compact(boundaries)
+
+	outputs := make([][]*FTable, len(boundaries)+1)
+	errs := make([]error, len(boundaries)+1)
+	var wg sync.WaitGroup
+	for i := range outputs {
+		// records in [lower, upper), an empty upper means unbounded
+		lower, upper := "", ""
+		if i > 0 {
+			lower = boundaries[i-1]
+		}
+		if i < len(boundaries) {
+			upper = boundaries[i]
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputs[i], errs[i] = t.runSubcompaction(lvl0Tables, lvl1Tables, lower, upper)
+		}()
+	}
+	wg.Wait()
+
+	newTables = slices.Concat(outputs...)
+	for i := range outputs {
+		if errs[i] != nil {
+			err = errs[i]
+		}
+	}
+	if err != nil {
+		for _, table := range newTables {
+			table.Destroy()
+		}
+		return nil, 0, 0, 0, err
+	}
+	log.Printf("[INFO] %d new tables created by %d subcompactions\n", len(newTables), len(outputs))
+	return newTables, minI, maxI, readBytes, nil
+}
+
+// subcompactionBoundaries splits the key range of a compaction into at most Config.MaxSubcompactions disjoint
+// ranges. The split keys are picked evenly among the sparse index keys of the input tables, so every range holds
+// roughly the same amount of data. No boundary is returned when the compaction reads less than
+// Config.SubcompactionMinBytes per subcompaction.
+func (t *TableCluster) subcompactionBoundaries(lvl0Tables, lvl1Tables []*FTable, readBytes int64) []string {
+	n := t.cfg.MaxSubcompactions
+	if t.cfg.SubcompactionMinBytes > 0 {
+		n = min(n, int(readBytes/t.cfg.SubcompactionMinBytes))
+	}
+	if n <= 1 {
+		return nil
+	}
+
+	var candidates []string
+	for _, tables := range [][]*FTable{lvl0Tables, lvl1Tables} {
+		for _, table := range tables {
+			for _, index := range table.sparseIndex {
+				candidates = append(candidates, index.Key)
+			}
+		}
+	}
+	slices.SortFunc(candidates, t.compare)
+	candidates = slices.Compact(candidates)
+	n = min(n, len(candidates))
+
+	boundaries := make([]string, 0, n-1)
+	for i := 1; i < n; i++ {
+		key := candidates[i*len(candidates)/n]
+		if key == "" || (len(boundaries) > 0 && boundaries[len(boundaries)-1] == key) {
+			continue
+		}
+		boundaries = append(boundaries, key)
+	}
+	return boundaries
+}
+
+// runSubcompaction merges the records of the lvl 0 and lvl 1 tables within [lower, upper) into new lvl 1 tables.
+// An empty bound is unbounded. The output is cut into a new table whenever it reaches Config.TargetFileSize, and
+// it is empty when the range holds no record.
+func (t *TableCluster) runSubcompaction(lvl0Tables, lvl1Tables []*FTable, lower, upper string) ([]*FTable, error) {
+	minRecordCh := make(chan *Record)
+	var produceErr error
+
+	go func() {
+		defer close(minRecordCh)
+		// the newest lvl 0 table comes first, so it wins when a key exists in several tables
+		sources := make([]*mergeSource, 0, len(lvl0Tables)+1)
+		for i := len(lvl0Tables) - 1; i >= 0; i-- {
+			sources = append(sources, &mergeSource{
+				reader: newTableRangeReader([]*FTable{lvl0Tables[i]}, lower, upper, t.ioLimiter),
+			})
+		}
+		sources = append(sources, &mergeSource{
+			reader: newTableRangeReader(lvl1Tables, lower, upper, t.ioLimiter),
+			lvl1:   true,
+		})
+
+		merger, err := newMergingIterator(sources, t.cfg.comparator())
+		if err != nil {
+			produceErr = err
+			return
+		}
+		for {
+			record, err := merger.next()
+			if err != nil {
+				produceErr = err
+				return
+			}
+			if record == nil {
+				return
+			}
+			minRecordCh <- record
+		}
+	}()
+
+	outputs, err := writeSortedTables(minRecordCh, 1, t.cfg, t.ioLimiter)
+	if err == nil && produceErr != nil {
+		err = produceErr
+	}
+	if err != nil {
+		for _, table := range outputs {
+			table.Destroy()
+		}
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// writeSortedTables writes the sorted records of recordCh into tables of lvl of about Config.TargetFileSize bytes
+// each. Since the merged keys are unique, a table can be cut after any record without splitting a key across two
+// tables. The channel is always drained.
+func writeSortedTables(recordCh chan *Record, lvl int, cfg *Config, limiter *RateLimiter) ([]*FTable, error) {
+	var outputs []*FTable
+	var builder *ftableBuilder
+	var err error
+	for record := range recordCh {
+		if err != nil {
+			continue
+		}
+		if builder == nil {
+			if builder, err = newFTableBuilder(lvl, cfg, limiter); err != nil {
+				continue
+			}
+		}
+		if err = builder.add(record); err != nil {
+			continue
+		}
+		if cfg.TargetFileSize > 0 && builder.size() >= cfg.TargetFileSize {
+			var ftable *FTable
+			if ftable, err = builder.finish(); err == nil {
+				outputs = append(outputs, ftable)
+			}
+			builder = nil
+		}
+	}
+	if builder != nil {
+		if err != nil {
+			builder.abort()
+		} else {
+			var ftable *FTable
+			if ftable, err = builder.finish(); err == nil {
+				outputs = append(outputs, ftable)
+			}
+		}
+	}
+	return outputs, err
+}
+
+// installCompaction replaces the compacted lvl 0 tables and the lvl 1 tables in [minI, maxI) with the output of
+// the compaction and the moved tables in a single step, then destroys the replaced tables once they aren't pinned.
+func (t *TableCluster) installCompaction(lvl0Tables, movedTables []*FTable, minI, maxI int, newTables []*FTable) {
+	t.ftablesLock[0].Lock()
+	t.ftablesLock[1].Lock()
+
+	replaced := slices.Clone(t.ftables[1][minI:maxI])
+	t.ftables[1] = slices.Concat(t.ftables[1][:minI], newTables, t.ftables[1][maxI:], movedTables)
+	// the moved tables don't overlap any other table, sorting by min key puts them in place
+	slices.SortFunc(t.ftables[1], func(a, b *FTable) int {
+		return t.compare(a.minKey, b.minKey)
+	})
+	// lvl 0 might have been appended during the compaction, only the compacted tables are dropped
+	t.ftables[0] = slices.Clone(t.ftables[0][len(lvl0Tables):])
+
+	t.ftablesLock[1].Unlock()
+	t.ftablesLock[0].Unlock()
+
+	t.destroyUnpinned(func() {
+		for i, table := range replaced {
+			log.Printf("[INFO] Destroy table[%d][%d]\n", 1, minI+i)
+			if err := table.Destroy(); err != nil {
+				log.Printf("[ERROR] Destroy table[%d][%d]: %v\n", 1, minI+i, err)
+			}
+		}
+		for i, table := range lvl0Tables {
+			if slices.Contains(movedTables, table) {
+				continue
+			}
+			log.Printf("[INFO] Destroy table[%d][%d]\n", 0, i)
+			if err := table.Destroy(); err != nil {
+				log.Printf("[ERROR] Destroy table[%d][%d]: %v\n", 0, i, err)
+			}
+		}
+	})
+}
+
+// tableRangeReader reads the records of sorted, non-overlapping tables one by one, restricted to [lower, upper). An
+// empty bound is unbounded.
+type tableRangeReader struct {
+	tables  []*FTable
+	idx     int
+	it      *FTableIterator
+	lower   string
+	upper   string
+	limiter *RateLimiter
+}
+
+// newTableRangeReader skips the tables ending before lower, the first remaining table is then sought to lower so a
+// subcompaction doesn't read the part of the tables belonging to the previous range.
+func newTableRangeReader(tables []*FTable, lower, upper string, limiter *RateLimiter) *tableRangeReader {
+	r := &tableRangeReader{
+		lower:   lower,
+		upper:   upper,
+		limiter: limiter,
+	}
+	if lower != "" {
+		r.idx = sort.Search(len(tables), func(i int) bool { return tables[i].compare(tables[i].maxKey, lower) >= 0 })
+	}
+	r.tables = tables
+	if r.idx < len(tables) {
+		r.it = tables[r.idx].newIterator(limiter)
+		if lower == "" {
+			r.it.SeekToFirst()
+		} else {
+			r.it.Seek(lower)
+		}
+	}
+	return r
+}
+
+// next returns the next record within the range, or nil when the range is exhausted.
+func (r *tableRangeReader) next() (*Record, error) {
+	for r.it != nil {
+		if err := r.it.Err(); err != nil {
+			return nil, err
+		}
+		if !r.it.Valid() {
+			r.idx++
+			r.it = nil
+			if r.idx < len(r.tables) {
+				r.it = r.tables[r.idx].newIterator(r.limiter)
+				r.it.SeekToFirst()
+			}
+			continue
+		}
+		record := r.it.record
+		if r.upper != "" && r.it.table.compare(record.Key, r.upper) >= 0 {
+			r.it = nil
+			return nil, nil
+		}
+		r.it.Next()
+		return record, nil
+	}
+	return nil, nil
+}
+
+// recordReader returns sorted records one at a time, nil once it is exhausted.
+type recordReader interface {
+	next() (*Record, error)
+}
+
+// mergeSource is one input of a mergingIterator along with its current record.
+type mergeSource struct {
+	reader recordReader
+	cur    *Record
+	// lvl1 is true for the lvl 1 tables, which are the oldest source of a compaction
+	lvl1     bool
+	priority int
+}
+
+// mergeHeap orders the sources by their current key. On the same key, the source with the lowest priority, which is
+// the newest one, comes first.
+type mergeHeap struct {
+	sources []*mergeSource
+	cmp     Comparator
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+func (h *mergeHeap) Less(i, j int) bool {
+	if c := compareKeys(h.cmp, h.sources[i].cur.Key, h.sources[j].cur.Key); c != 0 {
+		return c < 0
+	}
+	return h.sources[i].priority < h.sources[j].priority
+}
+func (h *mergeHeap) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+func (h *mergeHeap) Push(x any)    { h.sources = append(h.sources, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() any {
+	old := h.sources
+	source := old[len(old)-1]
+	h.sources = old[:len(old)-1]
+	return source
+}
+
+// mergingIterator is a streaming k-way merge of sorted sources, given from the newest to the oldest, in the order of
+// cmp. Only the current record of every source is held in memory.
+type mergingIterator struct {
+	heap mergeHeap
+}
+
+func newMergingIterator(sources []*mergeSource, cmp Comparator) (*mergingIterator, error) {
+	m := &mergingIterator{heap: mergeHeap{sources: make([]*mergeSource, 0, len(sources)), cmp: cmp}}
+	for i, source := range sources {
+		source.priority = i
+		if err := m.advance(source); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// advance reads the next record of the source and pushes it back to the heap unless the source is exhausted.
+func (m *mergingIterator) advance(source *mergeSource) error {
+	record, err := source.reader.next()
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return nil
+	}
+	source.cur = record
+	heap.Push(&m.heap, source)
+	return nil
+}
+
+// next returns the newest record of the next key, or nil when every source is exhausted. A lvl 0 tombstone of a key
+// that also exists in lvl 1 is dropped along with the lvl 1 record.
+func (m *mergingIterator) next() (*Record, error) {
+	for m.heap.Len() > 0 {
+		newest := heap.Pop(&m.heap).(*mergeSource)
+		record, inLvl1 := newest.cur, newest.lvl1
+		if err := m.advance(newest); err != nil {
+			return nil, err
+		}
+		// the older records of the same key, in the order of the comparator, are shadowed by the newest one
+		for m.heap.Len() > 0 && compareKeys(m.heap.cmp, m.heap.sources[0].cur.Key, record.Key) == 0 {
+			older := heap.Pop(&m.heap).(*mergeSource)
+			inLvl1 = inLvl1 || older.lvl1
+			if err := m.advance(older); err != nil {
+				return nil, err
+			}
+		}
+		//TODO: provide option strategy to deal with deletion: should we put a tombstone or discard it?
+		if record.TombStone && inLvl1 && !newest.lvl1 {
+			continue
+		}
+		return record, nil
+	}
+	return nil, nil
+}
+
+// find overlap tables given a min-max keys. the interpretation of minI-maxI is similar to golang slice [minI-maxI] which means all elements
+// from index minI till maxI-1 are included. When there is no overlap, minI == maxI is the position where a table
+// holding the range should be inserted to keep the level sorted.
+func (t *TableCluster) findOverlapTablesRange(lvl int, minKey, maxKey string) (minI, maxI int, isOverlap bool) {
+
+	if lvl <= 0 || lvl >= len(t.ftables) {
+		return -1, -1, false
+	}
+
+	minI = sort.Search(len(t.ftables[lvl]), func(i int) bool {
+		return t.compare(minKey, t.ftables[lvl][i].maxKey) <= 0
+	})
+
+	maxI = sort.Search(len(t.ftables[lvl]), func(i int) bool {
+		return t.compare(maxKey, t.ftables[lvl][i].minKey) < 0
+	})
+
+	return minI, maxI, minI < maxI
+}
@@ -0,0 +1,224 @@
+package keynest
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCompactionConfig(dir string, maxSubcompactions int, targetFileSize int64) *Config {
+	return &Config{
+		DataDir:            dir,
+		IndexSkipNum:       4,
+		WriteBufferSize:    1024,
+		FalsePositiveRate:  0.01,
+		Lvl0MaxTableNum:    2,
+		MemMaxNum:          1000,
+		CompactionInterval: time.Hour,
+		MemFlushInterval:   time.Hour,
+		MaxSubcompactions:  maxSubcompactions,
+		TargetFileSize:     targetFileSize,
+	}
+}
+
+// checkModel compares every key ever written with the model, a missing key of the model is deleted.
+func checkModel(t *testing.T, tc *TableCluster, model map[string]string, keys int) {
+	t.Helper()
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		want, exists := model[key]
+		val, ok, err := tc.Get(key)
+		if err != nil || ok != exists || exists && val != want {
+			t.Fatalf("Get(%s) = %v, %v, %v, want %q, %v", key, val, ok, err, want, exists)
+		}
+	}
+	report, err := tc.Verify()
+	if err != nil || !report.OK() {
+		t.Fatalf("Verify() = %+v, %v", report, err)
+	}
+}
+
+// checkTargetFileSize checks that lvl 1 is cut into tables of about targetFileSize bytes.
+func checkTargetFileSize(t *testing.T, tc *TableCluster, targetFileSize int64) {
+	t.Helper()
+	// a record is never bigger than its metadata, its key and a 40 bytes value along with their encoding
+	maxRecordSize := SizeOfMetadata + 64
+	total := int64(0)
+	for _, table := range tc.ftables[1] {
+		total += table.sizeInBytes
+		if table.sizeInBytes >= targetFileSize+maxRecordSize {
+			t.Errorf("table %s has %d bytes, over the target of %d", table.dataFile.Name(), table.sizeInBytes, targetFileSize)
+		}
+	}
+	if int64(len(tc.ftables[1])) < total/(targetFileSize+maxRecordSize) {
+		t.Errorf("lvl 1 has %d tables for %d bytes, want tables of about %d bytes", len(tc.ftables[1]), total, targetFileSize)
+	}
+}
+
+func TestCompactionMatchesModel(t *testing.T) {
+	const keys = 200
+	for _, maxSubcompactions := range []int{1, 3, 8} {
+		for _, targetFileSize := range []int64{0, 512, 4096} {
+			t.Run(fmt.Sprintf("subcompactions=%d,target=%d", maxSubcompactions, targetFileSize), func(t *testing.T) {
+				dir := t.TempDir()
+				tc := NewTableCluster(newTestCompactionConfig(dir, maxSubcompactions, targetFileSize))
+				t.Cleanup(func() { tc.Close() })
+
+				rnd := rand.New(rand.NewSource(int64(maxSubcompactions)*10000 + targetFileSize))
+				model := make(map[string]string)
+				for op := 0; op < 2000; op++ {
+					key := fmt.Sprintf("key-%03d", rnd.Intn(keys))
+					if rnd.Intn(5) == 0 {
+						if err := tc.Delete(key); err != nil {
+							t.Fatal(err)
+						}
+						delete(model, key)
+					} else {
+						val := strings.Repeat(string(rune('a'+op%26)), 1+rnd.Intn(40))
+						if err := tc.Put(key, val); err != nil {
+							t.Fatal(err)
+						}
+						model[key] = val
+					}
+					if op%50 == 49 {
+						if err := tc.TriggerMemFlush(); err != nil {
+							t.Fatal(err)
+						}
+					}
+					if op%200 == 199 {
+						if err := tc.TriggerCompaction(); err != nil {
+							t.Fatal(err)
+						}
+						checkModel(t, tc, model, keys)
+					}
+				}
+				if len(tc.ftables) < 2 || len(tc.ftables[1]) == 0 {
+					t.Fatal("no table in lvl 1")
+				}
+				if targetFileSize > 0 {
+					checkTargetFileSize(t, tc, targetFileSize)
+				}
+				if targetFileSize == 0 && maxSubcompactions == 1 && len(tc.ftables[1]) != 1 {
+					t.Errorf("lvl 1 has %d tables, want a single one without a target size nor subcompactions", len(tc.ftables[1]))
+				}
+
+				if err := tc.Close(); err != nil {
+					t.Fatal(err)
+				}
+				reopened := NewTableCluster(newTestCompactionConfig(dir, maxSubcompactions, targetFileSize))
+				t.Cleanup(func() { reopened.Close() })
+				if err := reopened.LoadTableClusterMetadata(); err != nil {
+					t.Fatal(err)
+				}
+				checkModel(t, reopened, model, keys)
+			})
+		}
+	}
+}
+
+func TestCompactionOutputRespectsTargetFileSize(t *testing.T) {
+	dir := t.TempDir()
+	tc := NewTableCluster(newTestCompactionConfig(dir, 1, 512))
+	t.Cleanup(func() { tc.Close() })
+	for _, prefix := range []string{"a", "b", "c"} {
+		putKeys(t, tc, prefix, 40)
+	}
+	if err := tc.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	// overlapping tables, so that lvl 0 is merged rather than moved
+	for _, prefix := range []string{"c", "b"} {
+		putKeys(t, tc, prefix, 40)
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+
+	lvl1 := tc.ftables[1]
+	if len(lvl1) < 2 {
+		t.Fatalf("lvl 1 has %d tables, want the output cut into several", len(lvl1))
+	}
+	checkTargetFileSize(t, tc, 512)
+	records := 0
+	for i, table := range lvl1 {
+		records += table.nRecords
+		if i > 0 && lvl1[i-1].maxKey >= table.minKey {
+			t.Fatalf("lvl 1 tables %s and %s overlap", lvl1[i-1].dataFile.Name(), table.dataFile.Name())
+		}
+	}
+	if records != 120 {
+		t.Fatalf("lvl 1 has %d records, want 120", records)
+	}
+}
+
+func TestCompactionMovesNonOverlappingTables(t *testing.T) {
+	dir := t.TempDir()
+	tc := NewTableCluster(newTestCompactionConfig(dir, 1, 0))
+	t.Cleanup(func() { tc.Close() })
+	for _, prefix := range []string{"a", "b", "c"} {
+		putKeys(t, tc, prefix, 10)
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lvl0 := tc.ftables[0]
+	names := make([]string, len(lvl0))
+	for i, table := range lvl0 {
+		names[i] = table.fileName()
+	}
+
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.metrics.TrivialMoveCount.Value(); got != 3 {
+		t.Fatalf("TrivialMoveCount = %d, want 3", got)
+	}
+	if got := tc.metrics.CompactionWrittenBytes.Value(); got != 0 {
+		t.Fatalf("CompactionWrittenBytes = %d, want nothing rewritten", got)
+	}
+	if len(tc.ftables[0]) != 0 || len(tc.ftables[1]) != 3 {
+		t.Fatalf("levels have %d and %d tables, want 0 and 3", len(tc.ftables[0]), len(tc.ftables[1]))
+	}
+	for i, table := range tc.ftables[1] {
+		if table != lvl0[i] {
+			t.Fatalf("lvl 1 table %d is %s, want the lvl 0 table %s", i, table.fileName(), names[i])
+		}
+		// the move only changes the metadata, the data file keeps its name
+		if table.fileName() != names[i] {
+			t.Fatalf("moved table is named %s, want %s", table.fileName(), names[i])
+		}
+	}
+
+	if err := tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := NewTableCluster(newTestCompactionConfig(dir, 1, 0))
+	t.Cleanup(func() { reopened.Close() })
+	if err := reopened.LoadTableClusterMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.ftables[0]) != 0 || len(reopened.ftables[1]) != 3 {
+		t.Fatalf("reloaded levels have %d and %d tables, want 0 and 3", len(reopened.ftables[0]), len(reopened.ftables[1]))
+	}
+	for i, table := range reopened.ftables[1] {
+		if table.fileName() != names[i] {
+			t.Fatalf("reloaded lvl 1 table %d is %s, want %s", i, table.fileName(), names[i])
+		}
+	}
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("%s-%02d", prefix, i)
+			if val, ok, err := reopened.Get(key); err != nil || !ok || val != "v" {
+				t.Fatalf("Get(%s) after a reload = %v, %v, %v", key, val, ok, err)
+			}
+		}
+	}
+	if report, err := reopened.Verify(); err != nil || !report.OK() {
+		t.Fatalf("Verify() = %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,107 @@
+package keynest
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// Comparator orders the keys. It's used by the memtables, the sparse index searches, the overlap detection of the
+// compactions and every merge, so the whole LSM tree follows the same order. The name of the comparator is stored in
+// the metadata and a data directory is refused when it's opened with another comparator.
+type Comparator interface {
+	// Name identifies the comparator in the metadata, it must change whenever the order changes
+	Name() string
+	// Compare returns a negative number when a comes before b, a positive one when a comes after b, and 0 only when
+	// a and b are the same bytes, since the bloom filters and the memtables look the keys up by equality. a and b
+	// must not be modified nor retained.
+	Compare(a, b []byte) int
+}
+
+var (
+	comparators     = map[string]Comparator{}
+	comparatorsLock sync.RWMutex
+)
+
+func init() {
+	RegisterComparator(BytewiseComparator{})
+	RegisterComparator(ReverseBytewiseComparator{})
+}
+
+// RegisterComparator makes a custom comparator known, so the tools working on a data directory without a Config,
+// like keynest-fsck, can order its keys. The built-in comparators are always registered.
+func RegisterComparator(cmp Comparator) {
+	comparatorsLock.Lock()
+	defer comparatorsLock.Unlock()
+	comparators[cmp.Name()] = cmp
+}
+
+// ComparatorByName returns a registered comparator. An empty name is bytewise, the order of the data directories
+// written before the comparator was recorded.
+func ComparatorByName(name string) (Comparator, error) {
+	if name == "" {
+		return BytewiseComparator{}, nil
+	}
+	comparatorsLock.RLock()
+	defer comparatorsLock.RUnlock()
+	cmp, ok := comparators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown comparator %q, it must be registered with RegisterComparator", name)
+	}
+	return cmp, nil
+}
+
+// comparator returns Config.Comparator, bytewise when it isn't set.
+func (c *Config) comparator() Comparator {
+	if c == nil || c.Comparator == nil {
+		return BytewiseComparator{}
+	}
+	return c.Comparator
+}
+
+// checkComparator refuses a data directory whose keys were ordered by another comparator than the configured one.
+func (c *Config) checkComparator(name string) error {
+	if name == "" {
+		name = BytewiseComparator{}.Name()
+	}
+	if configured := c.comparator().Name(); name != configured {
+		return fmt.Errorf("%w: the keys of %s are ordered by %q, the configured comparator is %q", ErrComparatorMismatch, c.DataDir, name, configured)
+	}
+	return nil
+}
+
+// BytewiseComparator orders the keys lexicographically by their bytes, it's the default.
+type BytewiseComparator struct{}
+
+func (BytewiseComparator) Name() string { return "bytewise" }
+
+func (BytewiseComparator) Compare(a, b []byte) int { return bytes.Compare(a, b) }
+
+// ReverseBytewiseComparator is the reverse of BytewiseComparator, scans return the greatest keys first.
+type ReverseBytewiseComparator struct{}
+
+func (ReverseBytewiseComparator) Name() string { return "reverse-bytewise" }
+
+func (ReverseBytewiseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+
+// compareKeys compares two keys with cmp. The keys are held in strings, which are immutable, so they are handed to
+// the comparator without being copied.
+func compareKeys(cmp Comparator, a, b string) int {
+	return cmp.Compare(unsafe.Slice(unsafe.StringData(a), len(a)), unsafe.Slice(unsafe.StringData(b), len(b)))
+}
+
+// minKeyOf and maxKeyOf return the first and the last of two keys in the order of cmp.
+func minKeyOf(cmp Comparator, a, b string) string {
+	if compareKeys(cmp, b, a) < 0 {
+		return b
+	}
+	return a
+}
+
+func maxKeyOf(cmp Comparator, a, b string) string {
+	if compareKeys(cmp, b, a) > 0 {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,122 @@
+package keynest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// numericComparator orders decimal keys by their value.
+type numericComparator struct{}
+
+func (numericComparator) Name() string { return "test-numeric" }
+
+func (numericComparator) Compare(a, b []byte) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return bytes.Compare(a, b)
+}
+
+func TestComparatorOrdersEveryLayer(t *testing.T) {
+	RegisterComparator(numericComparator{})
+	dir := t.TempDir()
+	tc := newTestTableCluster(t, dir)
+	tc.cfg.Comparator = numericComparator{}
+	tc.memtable = tc.newMemTable()
+	for round := 0; round < 4; round++ {
+		for i := round; i < 120; i += 4 {
+			if err := tc.Put(strconv.Itoa(i), int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+		if round == 2 {
+			if err := tc.TriggerCompaction(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tc.Delete("7"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := 0
+	err := tc.Scan("", "", func(key string, val any, _ ValueType) bool {
+		if want == 7 {
+			want++
+		}
+		if key != strconv.Itoa(want) || val != int64(want) {
+			t.Fatalf("Scan gave %s = %v, want %d", key, val, want)
+		}
+		want++
+		return true
+	})
+	if err != nil || want != 120 {
+		t.Fatalf("Scan stopped at %d: %v", want, err)
+	}
+	for _, key := range []string{"9", "10", "99", "100", "119"} {
+		if _, ok, err := tc.Get(key); !ok || err != nil {
+			t.Fatalf("Get(%s) = %v, %v", key, ok, err)
+		}
+	}
+	if report, err := tc.Verify(); err != nil || !report.OK() {
+		t.Fatalf("Verify = %+v, %v", report, err)
+	}
+	if err = tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if report, err := VerifyDataDir(dir); err != nil || !report.OK() {
+		t.Fatalf("VerifyDataDir = %+v, %v", report, err)
+	}
+	if err = newTestTableCluster(t, dir).LoadTableClusterMetadata(); !errors.Is(err, ErrComparatorMismatch) {
+		t.Fatalf("LoadTableClusterMetadata with the bytewise comparator = %v, want ErrComparatorMismatch", err)
+	}
+	reopened := newTestTableCluster(t, dir)
+	reopened.cfg.Comparator = numericComparator{}
+	if err = reopened.LoadTableClusterMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := reopened.Get("100"); !ok || err != nil || val != int64(100) {
+		t.Fatalf("Get(100) after reopening = %v, %v, %v", val, ok, err)
+	}
+}
+
+func TestReverseComparatorWithBinaryKeys(t *testing.T) {
+	tc := newTestTableCluster(t, t.TempDir())
+	tc.cfg.Comparator = ReverseBytewiseComparator{}
+	tc.memtable = tc.newMemTable()
+	for round := 0; round < 3; round++ {
+		for i := round; i < 60; i += 3 {
+			if err := tc.PutBytes([]byte{byte(i), 0, 0xff}, fmt.Sprint(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := 49
+	err := tc.Scan(string([]byte{49, 0, 0xff}), string([]byte{9}), func(key string, val any, _ ValueType) bool {
+		if !bytes.Equal([]byte(key), []byte{byte(want), 0, 0xff}) || val != fmt.Sprint(want) {
+			t.Fatalf("Scan gave %x = %v, want %d", key, val, want)
+		}
+		want--
+		return true
+	})
+	if err != nil || want != 8 {
+		t.Fatalf("Scan stopped at %d: %v", want, err)
+	}
+	if val, ok, err := tc.GetBytes([]byte{30, 0, 0xff}); !ok || err != nil || val != "30" {
+		t.Fatalf("GetBytes = %v, %v, %v", val, ok, err)
+	}
+}
@@ -3,11 +3,69 @@ package keynest
 import "time"
 
 type Config struct {
-	IndexSkipNum       int
-	WriteBufferSize    int
-	FalsePositiveRate  float64
-	Lvl0MaxTableNum    int
+	// DataDir is the directory holding the data and metadata files, the working directory when empty
+	DataDir           string
+	IndexSkipNum      int
+	WriteBufferSize   int
+	FalsePositiveRate float64
+	Lvl0MaxTableNum   int
+	// CompactionInterval is the period of the background compaction job, 0 disables the job and leaves the
+	// compactions to TriggerCompaction.
 	CompactionInterval time.Duration
-	MemFlushInterval   time.Duration
-	MemMaxNum          int
+	// MemFlushInterval is the period of the background memtable flush job, 0 disables the job and leaves the flushes
+	// to TriggerMemFlush and Close.
+	MemFlushInterval time.Duration
+	MemMaxNum        int
+	// MemBackupInterval is the period at which the memtables are written to the memtable backup file without being
+	// flushed, so a restart loses at most one interval of writes. 0 disables the backup.
+	MemBackupInterval time.Duration
+	// ValueCodec encodes the values of the new tables, msgpack when nil. The existing tables keep their own codec.
+	ValueCodec ValueCodec
+	// MaxKeySize is the maximum length of a key in bytes, 0 means MaxKeySizeLimit which is also the upper bound.
+	MaxKeySize int
+	// MaxValueSize is the maximum size of a value in bytes, the length of a string or a []byte, the size encoded by
+	// ValueCodec for the other values. 0 means unlimited.
+	MaxValueSize int64
+	// ValueChunkSize is the size in bytes above which an encoded value is split into several records of the data
+	// file, read back as a single value. 0 only splits the values that don't fit in a single record.
+	ValueChunkSize int
+	// ValueLogThreshold is the size in bytes from which an encoded value is moved to the value log when it's flushed,
+	// the tables then only hold a pointer to it. 0 keeps every value in the tables.
+	ValueLogThreshold int
+	// ValueLogGCInterval is the period at which CollectValueLog runs with ValueLogGCDiscardRatio, 0.5 when 0.
+	// 0 disables the job.
+	ValueLogGCInterval     time.Duration
+	ValueLogGCDiscardRatio float64
+	// ReplicationLogSize is the number of the newest mutations kept in memory for the followers, see
+	// ReplicationHandler. A follower that falls further behind bootstraps again from a checkpoint. 0 disables the
+	// replication log.
+	ReplicationLogSize int
+	// ReplicationPollWait is how long a follower waits for new mutations in a single request to its leader, one
+	// second when 0.
+	ReplicationPollWait time.Duration
+	// Comparator orders the keys, bytewise when nil. It can't be changed once the data directory holds tables.
+	Comparator Comparator
+	// MaxSubcompactions is the number of key ranges a lvl 0 compaction is split into to be merged in parallel,
+	// every subcompaction reads at least SubcompactionMinBytes. 0 or 1 disables the split.
+	MaxSubcompactions     int
+	SubcompactionMinBytes int64
+	// TargetFileSize is the size in bytes at which the output of a compaction is cut into a new lvl 1 table,
+	// 0 means a single table per subcompaction.
+	TargetFileSize int64
+	// BackgroundIORate limits the bytes per second read and written by memtable flushes and compactions,
+	// 0 means unlimited. It can be changed at runtime with TableCluster.SetBackgroundIORate.
+	BackgroundIORate int64
+
+	// Writes are delayed by WriteSlowdownDelay once a slowdown trigger is reached and blocked once a stop trigger
+	// is reached, until flushes and compactions catch up. A trigger of 0 is disabled. A memtable or lvl 0 stop
+	// trigger at or under MemMaxNum or Lvl0MaxTableNum rotates the memtable or compacts lvl 0 once it is reached.
+	Lvl0SlowdownTableNum    int
+	Lvl0StopTableNum        int
+	MemSlowdownNum          int
+	MemStopNum              int
+	ImmutableMemSlowdownNum int
+	ImmutableMemStopNum     int
+	WriteSlowdownDelay      time.Duration
+	// WriteStopTimeout is how long a blocked write waits before failing with ErrWriteStall, 0 means forever.
+	WriteStopTimeout time.Duration
 }
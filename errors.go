@@ -0,0 +1,33 @@
+package keynest
+
+import "errors"
+
+var (
+	// ErrCorruption is returned when the content of a data or metadata file does not match its expected layout.
+	ErrCorruption = errors.New("keynest: corruption")
+	// ErrClosed is returned when an operation is issued to a closed TableCluster.
+	ErrClosed = errors.New("keynest: table cluster is closed")
+	// ErrIO is returned when the underlying file system fails to serve a read or write.
+	ErrIO = errors.New("keynest: i/o error")
+	// ErrWriteStall is returned when a write stays blocked by a stop trigger for longer than Config.WriteStopTimeout.
+	ErrWriteStall = errors.New("keynest: writes are stopped until flush and compaction catch up")
+	// ErrUnsupportedContentType is returned when a value is given with a content type keynest doesn't know.
+	ErrUnsupportedContentType = errors.New("keynest: unsupported content type")
+	// ErrKeyTooLarge is returned when a key is longer than Config.MaxKeySize, the error is a *SizeLimitError.
+	ErrKeyTooLarge = errors.New("keynest: key too large")
+	// ErrValueTooLarge is returned when a value is larger than Config.MaxValueSize, the error is a *SizeLimitError.
+	ErrValueTooLarge = errors.New("keynest: value too large")
+	// ErrEmptyKey is returned when a record is written with an empty key, which only the chunks of a large value have.
+	ErrEmptyKey = errors.New("keynest: empty key")
+	// ErrComparatorMismatch is returned when a data directory is opened with another comparator than its own.
+	ErrComparatorMismatch = errors.New("keynest: comparator mismatch")
+	// ErrUnsupportedFormat is returned when a data directory was written in another on-disk format than the one of
+	// this version of keynest.
+	ErrUnsupportedFormat = errors.New("keynest: unsupported on-disk format")
+	// ErrReplicationLogTruncated is returned when a follower asks for mutations the leader no longer holds, or for a
+	// replication log the leader doesn't know, e.g. after a restart of the leader.
+	ErrReplicationLogTruncated = errors.New("keynest: mutations no longer in the replication log")
+	// ErrNotLeader is returned when a write or a linearizable read reaches a raft node that can't serve it, the error
+	// is a *NotLeaderError.
+	ErrNotLeader = errors.New("keynest: not the raft leader")
+)
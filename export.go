@@ -0,0 +1,293 @@
+package keynest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// defaultImportBatchBytes is the size of the tables built by an import when Config.TargetFileSize is not set.
+const defaultImportBatchBytes = 4 * 1024 * 1024
+
+var csvHeader = []string{"key", "type", "value"}
+
+// ExportedRecord is a line of a JSON Lines export. Value holds the JSON form of the value, a base64 string for raw
+// bytes, and Type is its content type so the exact type is restored on import.
+type ExportedRecord struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// NewExportedRecord returns the JSON Lines form of a value.
+func NewExportedRecord(key string, val any, valueType ValueType) (ExportedRecord, error) {
+	value, err := json.Marshal(val)
+	if err != nil {
+		return ExportedRecord{}, fmt.Errorf("marshal value of %q: %w", key, err)
+	}
+	return ExportedRecord{Key: key, Type: valueType.ContentType(), Value: value}, nil
+}
+
+// Record decodes the value back into the Go type a Get of the key returns.
+func (e ExportedRecord) Record() (*Record, error) {
+	valueType, err := ParseContentType(e.Type)
+	if err != nil {
+		return nil, err
+	}
+	var val any
+	switch valueType {
+	// strings and bytes are quoted in JSON, unlike in the HTTP body
+	case ValueTypeString:
+		var s string
+		err = json.Unmarshal(e.Value, &s)
+		val = s
+	case ValueTypeBytes:
+		var raw []byte
+		err = json.Unmarshal(e.Value, &raw)
+		val = raw
+	default:
+		val, err = DecodeValue(valueType, e.Value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Record{Key: e.Key, Val: val, Metadata: Metadata{ValueType: valueType}}, nil
+}
+
+// ExportJSONL writes every live key along with its newest value to w, one JSON object per line in key order. It
+// returns the number of exported keys.
+func (t *TableCluster) ExportJSONL(w io.Writer) (int, error) {
+	return t.ExportRangeJSONL(w, "", "", 0)
+}
+
+// ExportRangeJSONL writes the live keys after the key after and before upper like ExportJSONL, at most limit of
+// them when limit is positive. An empty bound is unbounded. Paging through the keys takes the last key written as
+// the next after.
+func (t *TableCluster) ExportRangeJSONL(w io.Writer, after, upper string, limit int) (int, error) {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	n := 0
+	var encodeErr error
+	err := t.Scan(after, upper, func(key string, val any, valueType ValueType) bool {
+		if after != "" && key == after {
+			return true
+		}
+		exported, err := NewExportedRecord(key, val, valueType)
+		if err != nil {
+			encodeErr = err
+			return false
+		}
+		if encodeErr = encoder.Encode(exported); encodeErr != nil {
+			return false
+		}
+		n++
+		return limit <= 0 || n < limit
+	})
+	if err == nil {
+		err = encodeErr
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return n, err
+}
+
+// ExportCSV writes every live key along with its newest value to w as CSV with a key, type and value header. The
+// value column holds the same text as the body of the HTTP API, except for raw bytes which are base64 encoded.
+func (t *TableCluster) ExportCSV(w io.Writer) (int, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return 0, err
+	}
+	n := 0
+	var encodeErr error
+	err := t.Scan("", "", func(key string, val any, valueType ValueType) bool {
+		body, err := EncodeValue(valueType, val)
+		if err != nil {
+			encodeErr = fmt.Errorf("encode value of %q: %w", key, err)
+			return false
+		}
+		if valueType == ValueTypeBytes {
+			body = []byte(base64.StdEncoding.EncodeToString(body))
+		}
+		if encodeErr = cw.Write([]string{key, valueType.ContentType(), string(body)}); encodeErr != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err == nil {
+		err = encodeErr
+	}
+	if err == nil {
+		cw.Flush()
+		err = cw.Error()
+	}
+	return n, err
+}
+
+// ImportJSONL loads the records written by ExportJSONL. The records are gathered into batches that are sorted and
+// written straight to lvl 0 tables, skipping the memtable. When a key shows up more than once, the last line wins.
+// It returns the number of imported lines.
+func (t *TableCluster) ImportJSONL(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	line := 0
+	return t.importRecords(func() (*Record, int, error) {
+		for {
+			b, err := br.ReadBytes('\n')
+			if len(bytes.TrimSpace(b)) == 0 {
+				if err == nil {
+					line++
+					continue
+				}
+				if errors.Is(err, io.EOF) {
+					return nil, 0, nil
+				}
+				return nil, 0, err
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, 0, err
+			}
+			line++
+			exported := ExportedRecord{}
+			if err = json.Unmarshal(b, &exported); err != nil {
+				return nil, 0, fmt.Errorf("line %d: %w", line, err)
+			}
+			record, err := exported.Record()
+			if err != nil {
+				return nil, 0, fmt.Errorf("line %d: %w", line, err)
+			}
+			return record, len(b), nil
+		}
+	})
+}
+
+// ImportCSV loads the records written by ExportCSV, the same way as ImportJSONL.
+func (t *TableCluster) ImportCSV(r io.Reader) (int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	first := true
+	return t.importRecords(func() (*Record, int, error) {
+		fields, err := cr.Read()
+		if first && err == nil && slices.Equal(fields, csvHeader) {
+			fields, err = cr.Read()
+		}
+		first = false
+		if errors.Is(err, io.EOF) {
+			return nil, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		line, _ := cr.FieldPos(0)
+		valueType, err := ParseContentType(strings.ToLower(fields[1]))
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		body := []byte(fields[2])
+		if valueType == ValueTypeBytes {
+			if body, err = base64.StdEncoding.DecodeString(fields[2]); err != nil {
+				return nil, 0, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		val, err := DecodeValue(valueType, body)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		return &Record{Key: fields[0], Val: val, Metadata: Metadata{ValueType: valueType}}, len(fields[0]) + len(fields[2]), nil
+	})
+}
+
+// importRecords pulls records from next until it returns a nil record, and writes them to lvl 0 in batches of about
+// Config.TargetFileSize bytes. The memtables are flushed first, so the imported records override the older writes.
+func (t *TableCluster) importRecords(next func() (*Record, int, error)) (int, error) {
+	if t.closed.Load() {
+		return 0, ErrClosed
+	}
+	if err := t.flushMemTableToFTable(); err != nil {
+		return 0, err
+	}
+	batchBytes := t.cfg.TargetFileSize
+	if batchBytes <= 0 {
+		batchBytes = defaultImportBatchBytes
+	}
+
+	imported := 0
+	batch := make([]*Record, 0)
+	size := int64(0)
+	var err error
+	for {
+		record, n, nextErr := next()
+		if nextErr != nil {
+			err = nextErr
+			break
+		}
+		if record != nil {
+			if err = t.cfg.checkRecordSize(record); err != nil {
+				err = fmt.Errorf("record %d: %w", imported+len(batch)+1, err)
+				break
+			}
+			batch = append(batch, record)
+			size += int64(n)
+		}
+		if len(batch) > 0 && (record == nil || size >= batchBytes) {
+			if err = t.importBatch(batch); err != nil {
+				break
+			}
+			imported += len(batch)
+			batch, size = batch[:0:0], 0
+		}
+		if record == nil {
+			break
+		}
+	}
+
+	if imported > 0 {
+		if snapshotErr := t.SnapshotTableClusterMetadata(); err == nil {
+			err = snapshotErr
+		}
+	}
+	return imported, err
+}
+
+// importBatch writes a batch as a new lvl 0 table, which is newer than every table installed before. Unlike a Put,
+// a write stall doesn't fail the import, it waits for as long as it takes.
+func (t *TableCluster) importBatch(batch []*Record) error {
+	slices.SortStableFunc(batch, func(a, b *Record) int {
+		return t.compare(a.Key, b.Key)
+	})
+
+	for {
+		err := t.waitForWriteStall()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrWriteStall) {
+			return err
+		}
+	}
+	// only the last of the records of a key is kept
+	records := make([]*Record, 0, len(batch))
+	for i, record := range batch {
+		if i+1 < len(batch) && batch[i+1].Key == record.Key {
+			continue
+		}
+		records = append(records, record)
+	}
+	mutations, err := t.replicationLog.prepare(records...)
+	if err != nil {
+		return err
+	}
+	if err = t.installLvl0Table(records, mutations, t.ioLimiter); err != nil {
+		return err
+	}
+	t.kick(t.compactionKick)
+	return nil
+}
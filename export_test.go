@@ -0,0 +1,88 @@
+package keynest
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	tc := newTestTableCluster(t, t.TempDir())
+	want := map[string]any{}
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		var val any
+		switch i % 5 {
+		case 0:
+			val = fmt.Sprintf("val, \"%d\"\n", i)
+		case 1:
+			val = int32(-i)
+		case 2:
+			val = int64(i) << 40
+		case 3:
+			val = map[string]any{"n": float64(i), "tags": []any{"a", "b"}}
+		case 4:
+			val = []byte{0, byte(i), 0xff}
+		}
+		if err := tc.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+		if i%10 == 9 {
+			if err := tc.TriggerMemFlush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	// deleted and overwritten keys only show their newest state
+	for _, key := range []string{"key-000", "key-013"} {
+		if err := tc.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, key)
+	}
+	if err := tc.Put("key-001", "overwritten"); err != nil {
+		t.Fatal(err)
+	}
+	want["key-001"] = "overwritten"
+
+	for _, format := range []string{"jsonl", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			export, load := tc.ExportJSONL, (*TableCluster).ImportJSONL
+			if format == "csv" {
+				export, load = tc.ExportCSV, (*TableCluster).ImportCSV
+			}
+			n, err := export(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(want) {
+				t.Fatalf("exported %d keys, want %d", n, len(want))
+			}
+
+			imported := newTestTableCluster(t, t.TempDir())
+			if n, err = load(imported, buf); err != nil {
+				t.Fatal(err)
+			}
+			if n != len(want) {
+				t.Fatalf("imported %d keys, want %d", n, len(want))
+			}
+			got := map[string]any{}
+			err = imported.Scan("", "", func(key string, val any, valueType ValueType) bool {
+				got[key] = val
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("imported %v, want %v", got, want)
+			}
+		})
+	}
+}
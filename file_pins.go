@@ -0,0 +1,68 @@
+package keynest
+
+import "sync"
+
+// filePins keeps the data files and value log segments read by Scan, Backup and Checkpoint from being destroyed while
+// they are in use. These readers don't hold compactionLock, so compactions and value log collections carry on, and
+// the destruction of the files they replace is left to the last reader.
+type filePins struct {
+	lock sync.Mutex
+	// released is broadcast when the last pin is released
+	released *sync.Cond
+	count    int
+	// destroys are the destructions waiting for the last pin to be released
+	destroys []func()
+}
+
+// pinFiles calls snapshot, which lists the files to read, and keeps every file in use from being destroyed until
+// release is called. No file is retired while snapshot runs, so the value log segments it lists are the ones the
+// tables it lists point at.
+func (t *TableCluster) pinFiles(snapshot func()) (release func()) {
+	t.pins.lock.Lock()
+	defer t.pins.lock.Unlock()
+	t.pins.count++
+	snapshot()
+	return func() {
+		t.pins.lock.Lock()
+		t.pins.count--
+		var destroys []func()
+		if t.pins.count == 0 {
+			destroys, t.pins.destroys = t.pins.destroys, nil
+			t.pins.released.Broadcast()
+		}
+		t.pins.lock.Unlock()
+		for _, destroy := range destroys {
+			destroy()
+		}
+	}
+}
+
+// retireFiles runs retire, which takes files out of use, between two snapshots of pinFiles.
+func (t *TableCluster) retireFiles(retire func()) {
+	t.pins.lock.Lock()
+	defer t.pins.lock.Unlock()
+	retire()
+}
+
+// destroyUnpinned calls destroy right away, or once the last pin is released if files are pinned. The files must
+// already be out of use, destroy may run after Close.
+func (t *TableCluster) destroyUnpinned(destroy func()) {
+	t.pins.lock.Lock()
+	if t.pins.count > 0 {
+		t.pins.destroys = append(t.pins.destroys, destroy)
+		t.pins.lock.Unlock()
+		return
+	}
+	t.pins.lock.Unlock()
+	destroy()
+}
+
+// whenUnpinned waits until no file is pinned and runs fn, which closes the files in use, before any new pin is taken.
+func (t *TableCluster) whenUnpinned(fn func()) {
+	t.pins.lock.Lock()
+	defer t.pins.lock.Unlock()
+	for t.pins.count > 0 {
+		t.pins.released.Wait()
+	}
+	fn()
+}
@@ -0,0 +1,193 @@
+package keynest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+)
+
+const defaultIteratorBufferSize = 64 * 1024
+
+// FTableIterator reads the records of an FTable sequentially in key order through a buffered reader. A new iterator
+// is not positioned, SeekToFirst or Seek must be called before reading it.
+//
+//	it := ftable.NewIterator()
+//	for it.SeekToFirst(); it.Valid(); it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil { ... }
+type FTableIterator struct {
+	table  *FTable
+	reader *bufio.Reader
+	// offset is the position of the next record to be read
+	offset int64
+	// recordOffset is the position of the current record
+	recordOffset int64
+	record       *Record
+	err          error
+	limiter      *RateLimiter
+}
+
+func (s *FTable) NewIterator() *FTableIterator {
+	return s.newIterator(nil)
+}
+
+func (s *FTable) newIterator(limiter *RateLimiter) *FTableIterator {
+	return &FTableIterator{
+		table:   s,
+		limiter: limiter,
+	}
+}
+
+// SeekToFirst positions the iterator on the first record of the table.
+func (it *FTableIterator) SeekToFirst() {
+	it.seekToOffset(0)
+	it.Next()
+}
+
+// Seek positions the iterator on the first record whose key is greater than or equal to key. The reading starts
+// from the sparse index entry preceding key, so at most Config.IndexSkipNum records are skipped.
+func (it *FTableIterator) Seek(key string) {
+	sparseIndex := it.table.sparseIndex
+	i := sort.Search(len(sparseIndex), func(i int) bool {
+		return it.table.compare(sparseIndex[i].Key, key) >= 0
+	})
+	offset := int64(0)
+	if i > 0 {
+		offset = sparseIndex[i-1].Offset
+	}
+	it.seekToOffset(offset)
+	for it.Next(); it.Valid() && it.table.compare(it.record.Key, key) < 0; it.Next() {
+	}
+}
+
+func (it *FTableIterator) seekToOffset(offset int64) {
+	bufferSize := defaultIteratorBufferSize
+	if it.table.cfg != nil && it.table.cfg.WriteBufferSize > 0 {
+		bufferSize = it.table.cfg.WriteBufferSize
+	}
+	section := io.NewSectionReader(it.table.dataFile, offset, it.table.sizeInBytes-offset)
+	if it.reader == nil {
+		it.reader = bufio.NewReaderSize(section, bufferSize)
+	} else {
+		it.reader.Reset(section)
+	}
+	it.offset = offset
+	it.record = nil
+	it.err = nil
+}
+
+// Valid returns true while the iterator is positioned on a record.
+func (it *FTableIterator) Valid() bool {
+	return it.record != nil
+}
+
+// Next moves the iterator to the following record. The iterator becomes invalid at the end of the table or on
+// error, which is then reported by Err.
+func (it *FTableIterator) Next() {
+	it.record = nil
+	if it.err != nil || it.reader == nil || it.offset >= it.table.sizeInBytes {
+		return
+	}
+	name := it.table.dataFile.Name()
+
+	record := &Record{}
+	b := make([]byte, SizeOfMetadata)
+	if _, err := io.ReadFull(it.reader, b); err != nil {
+		it.err = it.readError(err, "metadata")
+		return
+	}
+	if err := record.Metadata.UnMarshal(b); err != nil {
+		it.err = fmt.Errorf("%w: decode metadata of %s at offset %d: %w", ErrCorruption, name, it.offset, err)
+		return
+	}
+	b = make([]byte, record.ContentSize())
+	if _, err := io.ReadFull(it.reader, b); err != nil {
+		it.err = it.readError(err, "content")
+		return
+	}
+	record.UnMarshalKey(b[:record.KeySize])
+	it.limiter.Wait(int(SizeOfMetadata) + record.ContentSize())
+	it.recordOffset = it.offset
+	it.offset += SizeOfMetadata + int64(record.ContentSize())
+
+	val := b[record.KeySize:]
+	for i := uint32(0); i < record.Chunks; i++ {
+		chunk := Metadata{}
+		b = make([]byte, SizeOfMetadata)
+		if _, err := io.ReadFull(it.reader, b); err != nil {
+			it.err = it.readError(err, "chunk metadata")
+			return
+		}
+		if err := chunk.UnMarshal(b); err != nil || !chunk.isChunk() {
+			it.err = fmt.Errorf("%w: chunk %d of %d of %q expected at offset %d of %s", ErrCorruption, i+1, record.Chunks, record.Key, it.offset, name)
+			return
+		}
+		start := len(val)
+		val = slices.Grow(val, int(chunk.ValSize))[:start+int(chunk.ValSize)]
+		if _, err := io.ReadFull(it.reader, val[start:]); err != nil {
+			it.err = it.readError(err, "chunk")
+			return
+		}
+		it.limiter.Wait(int(SizeOfMetadata) + int(chunk.ValSize))
+		it.offset += SizeOfMetadata + int64(chunk.ValSize)
+	}
+	if err := record.UnMarshalVal(val, it.table.codec); err != nil {
+		it.err = fmt.Errorf("%w: decode value of %q in %s: %w", ErrCorruption, record.Key, name, err)
+		return
+	}
+	it.record = record
+}
+
+// readError tells apart a record cut by the end of the table, which is a corruption, from an I/O error.
+func (it *FTableIterator) readError(err error, part string) error {
+	name := it.table.dataFile.Name()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %s of the record at offset %d of %s is cut by the end of the table", ErrCorruption, part, it.offset, name)
+	}
+	return fmt.Errorf("%w: read %s of %s at offset %d: %w", ErrIO, part, name, it.offset, err)
+}
+
+func (it *FTableIterator) Key() string {
+	return it.record.Key
+}
+
+func (it *FTableIterator) Value() any {
+	return it.record.Val
+}
+
+func (it *FTableIterator) Tombstone() bool {
+	return it.record.TombStone
+}
+
+func (it *FTableIterator) ValueType() ValueType {
+	return it.record.ValueType
+}
+
+// ValueSize returns the size of the encoded value held by the current record, without its chunks.
+func (it *FTableIterator) ValueSize() uint32 {
+	return it.record.ValSize
+}
+
+// Chunks returns the number of chunk records holding the rest of the value of the current record.
+func (it *FTableIterator) Chunks() uint32 {
+	return it.record.Chunks
+}
+
+// Separated tells whether the value of the current record was moved to the value log, Value then returns its
+// ValuePointer.
+func (it *FTableIterator) Separated() bool {
+	return it.record.Separated
+}
+
+// Offset returns the position of the current record in the data file.
+func (it *FTableIterator) Offset() int64 {
+	return it.recordOffset
+}
+
+func (it *FTableIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,72 @@
+package keynest
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newTestFTable(t *testing.T, n int) *FTable {
+	t.Helper()
+	records := make([]*Record, n)
+	for i := range records {
+		records[i] = &Record{Key: fmt.Sprintf("key-%03d", i), Val: fmt.Sprintf("val-%d", i)}
+		records[i].TombStone = i%10 == 0
+	}
+	ftable, err := NewFTableWithUnsortedRecord(0, records, &Config{DataDir: t.TempDir(), IndexSkipNum: 4, WriteBufferSize: 64, FalsePositiveRate: 0.01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ftable.Destroy() })
+	return ftable
+}
+
+func TestFTableIteratorSeekToFirst(t *testing.T) {
+	ftable := newTestFTable(t, 50)
+
+	it := ftable.NewIterator()
+	i := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if want := fmt.Sprintf("key-%03d", i); it.Key() != want {
+			t.Fatalf("expected key %s, got %s", want, it.Key())
+		}
+		if it.Tombstone() != (i%10 == 0) {
+			t.Fatalf("unexpected tombstone of %s", it.Key())
+		}
+		if !it.Tombstone() && it.Value() != fmt.Sprintf("val-%d", i) {
+			t.Fatalf("unexpected value of %s: %v", it.Key(), it.Value())
+		}
+		i++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != 50 {
+		t.Fatalf("expected 50 records, got %d", i)
+	}
+}
+
+func TestFTableIteratorSeek(t *testing.T) {
+	ftable := newTestFTable(t, 50)
+
+	for _, tc := range []struct {
+		seek string
+		want string
+	}{
+		{"", "key-000"},
+		{"key-017", "key-017"},
+		{"key-017a", "key-018"},
+		{"key-049", "key-049"},
+	} {
+		it := ftable.NewIterator()
+		it.Seek(tc.seek)
+		if !it.Valid() || it.Key() != tc.want {
+			t.Errorf("Seek(%q): expected %s, got valid=%v err=%v", tc.seek, tc.want, it.Valid(), it.Err())
+		}
+	}
+
+	it := ftable.NewIterator()
+	it.Seek("key-050")
+	if it.Valid() || it.Err() != nil {
+		t.Errorf("expected seeking past the last key to be exhausted, got valid=%v err=%v", it.Valid(), it.Err())
+	}
+}
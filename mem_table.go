@@ -4,23 +4,33 @@ import rbt "github.com/emirpasic/gods/trees/redblacktree"
 
 type MemTable struct {
 	tree *rbt.Tree
+	// id orders the memtables of a TableCluster, it tells which backed up memtables have already been flushed
+	id uint64
 }
 
 type MemRecord struct {
 	tombstone bool
 	val       any
+	valueType ValueType
 }
 
 func NewMemTable() *MemTable {
+	return NewMemTableWithComparator(BytewiseComparator{})
+}
+
+func NewMemTableWithComparator(cmp Comparator) *MemTable {
 	return &MemTable{
-		tree: rbt.NewWithStringComparator(),
+		tree: rbt.NewWith(func(a, b any) int {
+			return compareKeys(cmp, a.(string), b.(string))
+		}),
 	}
 }
 
-func (m *MemTable) Put(key string, val any) {
+func (m *MemTable) Put(key string, val any, valueType ValueType) {
 	m.tree.Put(key, &MemRecord{
 		tombstone: false,
 		val:       val,
+		valueType: valueType,
 	})
 }
 
@@ -36,6 +46,16 @@ func (m *MemTable) Get(key string) (any, bool) {
 	return nil, false
 }
 
+// lookup reports the record of key, tombstone included, so a deletion shadows the older tables.
+func (m *MemTable) lookup(key string) lookupResult {
+	record, ok := m.tree.Get(key)
+	if !ok {
+		return lookupResult{}
+	}
+	memRecord := record.(*MemRecord)
+	return lookupResult{val: memRecord.val, valueType: memRecord.valueType, found: true, tombstone: memRecord.tombstone}
+}
+
 func (m *MemTable) Delete(key string) {
 	m.tree.Put(key, &MemRecord{
 		tombstone: true,
@@ -0,0 +1,162 @@
+package keynest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// MemTableBackupFileName is the name of the file, inside Config.DataDir, holding the memtable backup.
+const MemTableBackupFileName = "memtable-backup"
+
+type MemTableBackup struct {
+	// MemTables are ordered from the oldest to the newest
+	MemTables []MemTableSnapshot
+}
+
+type MemTableSnapshot struct {
+	ID      uint64
+	Records []Record
+}
+
+func (t *TableCluster) runMemTableBackupJob() {
+	if t.cfg.MemBackupInterval <= 0 {
+		return
+	}
+	t.jobs.Add(1)
+	go func() {
+		defer t.jobs.Done()
+		ticker := time.NewTicker(t.cfg.MemBackupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+				if err := t.BackupMemTable(); err != nil && !errors.Is(err, ErrClosed) {
+					log.Printf("[ERROR] Memtable backup job failed: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// BackupMemTable writes the content of the memtable and the immutable memtables to the memtable backup file. The
+// memtables are neither cleared nor flushed.
+func (t *TableCluster) BackupMemTable() error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+	t.backupLock.Lock()
+	defer t.backupLock.Unlock()
+
+	backup := MemTableBackup{}
+	t.memTableLock.RLock()
+	for _, memtable := range append(t.immutables[:len(t.immutables):len(t.immutables)], t.memtable) {
+		if memtable.tree.Size() == 0 {
+			continue
+		}
+		snapshot := MemTableSnapshot{
+			ID:      memtable.id,
+			Records: make([]Record, 0, memtable.tree.Size()),
+		}
+		it := memtable.tree.Iterator()
+		for it.Next() {
+			memRecord := it.Value().(*MemRecord)
+			snapshot.Records = append(snapshot.Records, Record{
+				Key: it.Key().(string),
+				Val: memRecord.val,
+				Metadata: Metadata{
+					TombStone: memRecord.tombstone,
+					ValueType: memRecord.valueType,
+				},
+			})
+		}
+		backup.MemTables = append(backup.MemTables, snapshot)
+	}
+	t.memTableLock.RUnlock()
+
+	bytes, err := msgpack.Marshal(backup)
+	if err != nil {
+		return fmt.Errorf("marshal memtable backup: %w", err)
+	}
+	path := filepath.Join(t.cfg.DataDir, MemTableBackupFileName)
+	if err = os.WriteFile(path+".tmp", bytes, 0644); err != nil {
+		return fmt.Errorf("%w: write memtable backup: %w", ErrIO, err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("%w: rename memtable backup: %w", ErrIO, err)
+	}
+	return nil
+}
+
+// restoreMemTableBackup puts back the backed up memtables newer than the last flushed one as immutable memtables,
+// so they are flushed by the next flush. The older ones are already part of lvl 0.
+func (t *TableCluster) restoreMemTableBackup() error {
+	backup, err := readMemTableBackup(t.cfg.DataDir)
+	if err != nil {
+		return err
+	}
+
+	t.memTableLock.Lock()
+	defer t.memTableLock.Unlock()
+	restored := make([]*MemTable, 0, len(backup.MemTables))
+	flushedID := t.flushedMemTableID.Load()
+	for _, snapshot := range backup.MemTables {
+		// a memtable still waiting for its flush is already restored when the metadata is loaded twice
+		alreadyRestored := slices.ContainsFunc(t.immutables, func(memtable *MemTable) bool {
+			return memtable.id == snapshot.ID
+		})
+		if snapshot.ID <= flushedID || alreadyRestored {
+			continue
+		}
+		memtable := NewMemTableWithComparator(t.cfg.comparator())
+		memtable.id = snapshot.ID
+		for _, record := range snapshot.Records {
+			if record.TombStone {
+				memtable.Delete(record.Key)
+			} else {
+				memtable.Put(record.Key, normalizeValue(record.ValueType, record.Val), record.ValueType)
+			}
+		}
+		restored = append(restored, memtable)
+	}
+
+	lastID := flushedID
+	for _, memtable := range restored {
+		lastID = max(lastID, memtable.id)
+	}
+	if lastID > t.lastMemTableID.Load() {
+		t.lastMemTableID.Store(lastID)
+	}
+	// the restored memtables are older than anything written since the cluster was created
+	t.immutables = append(restored, t.immutables...)
+	if t.memtable.id <= lastID {
+		t.memtable.id = t.lastMemTableID.Add(1)
+	}
+	if len(restored) > 0 {
+		log.Printf("[INFO] %d memtables restored from the memtable backup\n", len(restored))
+	}
+	return nil
+}
+
+// readMemTableBackup reads the memtable backup of dataDir, a missing backup is an empty one.
+func readMemTableBackup(dataDir string) (MemTableBackup, error) {
+	backup := MemTableBackup{}
+	bytes, err := os.ReadFile(filepath.Join(dataDir, MemTableBackupFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return backup, nil
+	}
+	if err != nil {
+		return backup, fmt.Errorf("%w: read memtable backup: %w", ErrIO, err)
+	}
+	if err = msgpack.Unmarshal(bytes, &backup); err != nil {
+		return backup, fmt.Errorf("%w: decode memtable backup: %w", ErrCorruption, err)
+	}
+	return backup, nil
+}
@@ -0,0 +1,50 @@
+package keynest
+
+import (
+	"testing"
+)
+
+func TestMemTableBackupIsRestoredOnLoad(t *testing.T) {
+	dir := t.TempDir()
+	crashed := newTestTableCluster(t, dir)
+	if err := crashed.Put("flushed", "on disk"); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.Put("backed-up", "in memory"); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.Delete("flushed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.BackupMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first cluster is never closed, as if the process had been killed
+	restarted := newTestTableCluster(t, dir)
+	for i := 0; i < 2; i++ {
+		if err := restarted.LoadTableClusterMetadata(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(restarted.immutables) != 1 {
+		t.Fatalf("restored %d memtables, want only the unflushed one", len(restarted.immutables))
+	}
+	if val, ok, err := restarted.Get("backed-up"); err != nil || !ok || val != "in memory" {
+		t.Fatalf("Get(backed-up) = %v, %v, %v", val, ok, err)
+	}
+	if _, ok, err := restarted.Get("flushed"); err != nil || ok {
+		t.Fatalf("Get(flushed) = %v, %v, want the restored tombstone", ok, err)
+	}
+
+	// the restored memtable is flushed like any other
+	if err := restarted.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := restarted.Get("backed-up"); err != nil || !ok || val != "in memory" {
+		t.Fatalf("Get(backed-up) after flush = %v, %v, %v", val, ok, err)
+	}
+}
@@ -0,0 +1,218 @@
+package keynest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// GetSource tells where a Get found its answer, it's used as the label of the Get latency histogram.
+type GetSource int
+
+const (
+	GetSourceMemTable GetSource = iota
+	GetSourceLvl0
+	GetSourceLvl1
+	GetSourceNotFound
+	numGetSources
+)
+
+func (s GetSource) String() string {
+	switch s {
+	case GetSourceMemTable:
+		return "memtable"
+	case GetSourceLvl0:
+		return "l0"
+	case GetSourceLvl1:
+		return "l1"
+	default:
+		return "not_found"
+	}
+}
+
+var (
+	getLatencyBuckets  = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+	jobDurationBuckets = []float64{.001, .01, .05, .1, .5, 1, 5, 10, 30, 60, 300}
+)
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// Histogram counts observations into cumulative buckets, the same way a Prometheus histogram does.
+type Histogram struct {
+	bounds  []float64
+	buckets []atomic.Uint64
+	count   atomic.Uint64
+	sumBits atomic.Uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds:  bounds,
+		buckets: make([]atomic.Uint64, len(bounds)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i].Add(1)
+		}
+	}
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) ObserveDuration(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(h.sumBits.Load())
+}
+
+// Metrics is the registry of every counter and histogram updated by a TableCluster. Gauges describing the shape of
+// the tree (tables and bytes per level, memtable size) are not stored here, they are read from the cluster when
+// the metrics are written.
+type Metrics struct {
+	BloomUseful        Counter
+	BloomFalsePositive Counter
+	GetLatency         [numGetSources]*Histogram
+
+	FlushCount    Counter
+	FlushBytes    Counter
+	FlushDuration *Histogram
+
+	CompactionCount        Counter
+	TrivialMoveCount       Counter
+	CompactionReadBytes    Counter
+	CompactionWrittenBytes Counter
+	CompactionDuration     *Histogram
+
+	WriteSlowdownCount Counter
+	WriteStopCount     Counter
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		FlushDuration:      NewHistogram(jobDurationBuckets),
+		CompactionDuration: NewHistogram(jobDurationBuckets),
+	}
+	for i := range m.GetLatency {
+		m.GetLatency[i] = NewHistogram(getLatencyBuckets)
+	}
+	return m
+}
+
+func (t *TableCluster) Metrics() *Metrics {
+	return t.metrics
+}
+
+// WritePrometheus writes every metric of the cluster in the Prometheus text exposition format.
+func (t *TableCluster) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m := t.metrics
+
+	writeHeader(bw, "keynest_level_tables", "gauge", "Number of tables per level.")
+	levelBytes := make([]int64, len(t.ftables))
+	for i := range t.ftables {
+		t.ftablesLock[i].RLock()
+		for _, ftable := range t.ftables[i] {
+			levelBytes[i] += ftable.sizeInBytes
+		}
+		fmt.Fprintf(bw, "keynest_level_tables{level=\"%d\"} %d\n", i, len(t.ftables[i]))
+		t.ftablesLock[i].RUnlock()
+	}
+	writeHeader(bw, "keynest_level_bytes", "gauge", "Size in bytes of the tables per level.")
+	for i := range levelBytes {
+		fmt.Fprintf(bw, "keynest_level_bytes{level=\"%d\"} %d\n", i, levelBytes[i])
+	}
+
+	t.memTableLock.RLock()
+	memEntries := t.memtable.tree.Size()
+	immutables := len(t.immutables)
+	t.memTableLock.RUnlock()
+	writeHeader(bw, "keynest_memtable_entries", "gauge", "Number of entries in the memtable, tombstones included.")
+	fmt.Fprintf(bw, "keynest_memtable_entries %d\n", memEntries)
+	writeHeader(bw, "keynest_immutable_memtables", "gauge", "Number of immutable memtables waiting to be flushed.")
+	fmt.Fprintf(bw, "keynest_immutable_memtables %d\n", immutables)
+	stall, _ := t.WriteStall()
+	writeHeader(bw, "keynest_write_stall", "gauge", "State of the write path: 0 none, 1 slowdown, 2 stop.")
+	fmt.Fprintf(bw, "keynest_write_stall %d\n", stall)
+
+	writeCounter(bw, "keynest_bloom_useful_total", "Table lookups skipped because the bloom filter ruled the key out.", &m.BloomUseful)
+	writeCounter(bw, "keynest_bloom_false_positive_total", "Table lookups where the bloom filter passed but the key was absent.", &m.BloomFalsePositive)
+
+	writeHeader(bw, "keynest_get_latency_seconds", "histogram", "Latency of Get by where the key was found.")
+	for source := range numGetSources {
+		writeHistogram(bw, "keynest_get_latency_seconds", fmt.Sprintf("source=%q", source.String()), m.GetLatency[source])
+	}
+
+	writeCounter(bw, "keynest_flush_total", "Number of memtable flushes.", &m.FlushCount)
+	writeCounter(bw, "keynest_flush_bytes_total", "Bytes written by memtable flushes.", &m.FlushBytes)
+	writeHeader(bw, "keynest_flush_duration_seconds", "histogram", "Duration of memtable flushes.")
+	writeHistogram(bw, "keynest_flush_duration_seconds", "", m.FlushDuration)
+
+	writeCounter(bw, "keynest_compaction_total", "Number of compactions.", &m.CompactionCount)
+	writeCounter(bw, "keynest_compaction_trivial_move_total", "Lvl 0 tables moved to lvl 1 without rewrite.", &m.TrivialMoveCount)
+	writeCounter(bw, "keynest_compaction_read_bytes_total", "Bytes read by compactions.", &m.CompactionReadBytes)
+	writeCounter(bw, "keynest_compaction_written_bytes_total", "Bytes written by compactions.", &m.CompactionWrittenBytes)
+	writeHeader(bw, "keynest_compaction_duration_seconds", "histogram", "Duration of compactions.")
+	writeHistogram(bw, "keynest_compaction_duration_seconds", "", m.CompactionDuration)
+
+	writeCounter(bw, "keynest_write_slowdown_total", "Writes delayed by a slowdown trigger.", &m.WriteSlowdownCount)
+	writeCounter(bw, "keynest_write_stop_total", "Writes blocked by a stop trigger.", &m.WriteStopCount)
+
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeCounter(w io.Writer, name, help string, c *Counter) {
+	writeHeader(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *Histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i].Load())
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.Count())
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.Sum(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count())
+}
@@ -0,0 +1,30 @@
+package keynest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogramWritesCumulativeBuckets(t *testing.T) {
+	h := NewHistogram([]float64{1, 5, 10})
+	for _, v := range []float64{0.5, 3, 7, 20} {
+		h.Observe(v)
+	}
+
+	buf := &bytes.Buffer{}
+	writeHistogram(buf, "test_seconds", `source="l0"`, h)
+
+	for _, line := range []string{
+		`test_seconds_bucket{source="l0",le="1"} 1`,
+		`test_seconds_bucket{source="l0",le="5"} 2`,
+		`test_seconds_bucket{source="l0",le="10"} 3`,
+		`test_seconds_bucket{source="l0",le="+Inf"} 4`,
+		`test_seconds_sum{source="l0"} 30.5`,
+		`test_seconds_count{source="l0"} 4`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, buf.String())
+		}
+	}
+}
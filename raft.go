@@ -0,0 +1,974 @@
+package keynest
+
+import (
+	"context"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRaftElectionTimeout   = 300 * time.Millisecond
+	defaultRaftHeartbeatInterval = 50 * time.Millisecond
+	defaultRaftSnapshotThreshold = 10000
+	// maxRaftAppendEntries bounds the entries sent to a follower in a single request
+	maxRaftAppendEntries = 500
+	raftApplyRetryDelay  = 100 * time.Millisecond
+)
+
+type RaftConfig struct {
+	// ID names this node in Peers
+	ID string
+	// Peers maps the id of every node of the group, this one included, to the base URL its RaftNode.Handler is
+	// served at. A group of 3 nodes survives the loss of one, a group of 5 the loss of two.
+	Peers map[string]string
+	// Dir holds the raft log, the vote and the snapshots. It must be on the file system of the data directory, the
+	// snapshots are checkpoints of the cluster.
+	Dir string
+	// ElectionTimeout is the silence of the leader after which a follower starts an election, randomized between 1
+	// and 2 times the value. 300ms when 0.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is the period at which the leader contacts idle followers, 50ms when 0.
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is the number of applied entries after which a snapshot replaces them, 10000 when 0.
+	SnapshotThreshold uint64
+	// Transport carries the requests to the peers, http.DefaultTransport when nil.
+	Transport http.RoundTripper
+}
+
+// NotLeaderError is returned when a write reaches a node that isn't the leader. Leader is the base URL of the leader
+// when it's known.
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return fmt.Sprintf("%v, the leader is unknown", ErrNotLeader)
+	}
+	return fmt.Sprintf("%v, the leader is %s", ErrNotLeader, e.Leader)
+}
+
+func (e *NotLeaderError) Unwrap() error {
+	return ErrNotLeader
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (r raftRole) String() string {
+	switch r {
+	case raftCandidate:
+		return "candidate"
+	case raftLeader:
+		return "leader"
+	}
+	return "follower"
+}
+
+type RaftStatus struct {
+	ID            string `json:"id"`
+	Role          string `json:"role"`
+	Leader        string `json:"leader"`
+	Term          uint64 `json:"term"`
+	LastIndex     uint64 `json:"last_index"`
+	CommitIndex   uint64 `json:"commit_index"`
+	AppliedIndex  uint64 `json:"applied_index"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+}
+
+// raftWaiter is a proposal waiting for its entry to be applied.
+type raftWaiter struct {
+	term uint64
+	done chan error
+}
+
+// RaftNode replicates the writes of a TableCluster to a group of nodes through a raft log. A write is applied once a
+// majority of the nodes stored it, and the reads go through the read index of the leader, so the group behaves like
+// a single cluster as long as a majority of its nodes is up. The applied entries are compacted into snapshots, which
+// are checkpoints of the cluster, and a follower too far behind receives the newest snapshot.
+type RaftNode struct {
+	cfg     RaftConfig
+	cluster *TableCluster
+	client  *http.Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	lock sync.Mutex
+	// changed is broadcast whenever the role, the term, the commit index, the applied index or the acknowledgments
+	// of the leader change
+	changed          *sync.Cond
+	role             raftRole
+	term             uint64
+	votedFor         string
+	leader           string
+	log              *raftLog
+	snapshotDir      string
+	commitIndex      uint64
+	lastApplied      uint64
+	electionDeadline time.Time
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	// sends numbers the requests of the leader to its followers, and acked holds for every follower the number of
+	// the newest request it answered. A read index only counts the answers to requests sent after it's taken, an
+	// older answer may predate the election of a newer leader.
+	sends   uint64
+	acked   map[string]uint64
+	kicks   map[string]chan struct{}
+	waiters map[uint64]raftWaiter
+	closed  bool
+
+	// applyLock serializes the application of the entries, the snapshots and their installation
+	applyLock sync.Mutex
+}
+
+// NewRaftNode starts the raft node cfg.ID on top of cluster, which must not be written to by anything else. The
+// cluster is restored from the newest snapshot first, the entries that follow are applied again once they are known
+// to be committed.
+func NewRaftNode(cluster *TableCluster, cfg RaftConfig) (*RaftNode, error) {
+	if _, ok := cfg.Peers[cfg.ID]; !ok {
+		return nil, fmt.Errorf("raft node %q is not one of its peers", cfg.ID)
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = defaultRaftElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultRaftHeartbeatInterval
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = defaultRaftSnapshotThreshold
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("%w: create raft directory: %w", ErrIO, err)
+	}
+	// snapshots being written or received when the node stopped
+	for _, pattern := range []string{raftSnapshotPrefix + "*.tmp", raftReceivePrefix + "*"} {
+		leftovers, _ := filepath.Glob(filepath.Join(cfg.Dir, pattern))
+		for _, leftover := range leftovers {
+			os.RemoveAll(leftover)
+		}
+	}
+	state, err := readRaftState(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshotDir, snapshot, err := latestRaftSnapshot(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotDir != "" {
+		if err = restoreRaftSnapshot(cluster, snapshotDir); err != nil {
+			return nil, err
+		}
+	}
+	raftLog, err := openRaftLog(cfg.Dir, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &RaftNode{
+		cfg:         cfg,
+		cluster:     cluster,
+		client:      &http.Client{Transport: cfg.Transport},
+		ctx:         ctx,
+		cancel:      cancel,
+		term:        state.Term,
+		votedFor:    state.VotedFor,
+		log:         raftLog,
+		snapshotDir: snapshotDir,
+		commitIndex: snapshot.Index,
+		lastApplied: snapshot.Index,
+		waiters:     make(map[uint64]raftWaiter),
+	}
+	n.changed = sync.NewCond(&n.lock)
+	n.resetElectionDeadline()
+	n.wg.Add(2)
+	go n.runTicker()
+	go n.runApplyLoop()
+	log.Printf("[INFO] Raft node %s started at term %d, %d entries after snapshot %d\n", cfg.ID, n.term, len(raftLog.entries), snapshot.Index)
+	return n, nil
+}
+
+// Close stops the node, the cluster stays open.
+func (n *RaftNode) Close() error {
+	n.lock.Lock()
+	n.closed = true
+	n.failWaiters(ErrClosed)
+	n.changed.Broadcast()
+	n.lock.Unlock()
+	n.cancel()
+	n.wg.Wait()
+	return n.log.close()
+}
+
+func (n *RaftNode) Status() RaftStatus {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return RaftStatus{
+		ID:            n.cfg.ID,
+		Role:          n.role.String(),
+		Leader:        n.leader,
+		Term:          n.term,
+		LastIndex:     n.log.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		SnapshotIndex: n.log.snapshotIndex,
+	}
+}
+
+// Leader returns the base URL of the leader, empty when it's unknown.
+func (n *RaftNode) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.cfg.Peers[n.leader]
+}
+
+func (n *RaftNode) PutTyped(ctx context.Context, key string, val any, valueType ValueType) error {
+	return n.AddRecords(ctx, []*Record{{Key: key, Val: val, Metadata: Metadata{ValueType: valueType}}})
+}
+
+func (n *RaftNode) Delete(ctx context.Context, key string) error {
+	return n.AddRecords(ctx, []*Record{{Key: key, Metadata: Metadata{TombStone: true}}})
+}
+
+// AddRecords writes the records as a single entry, they are applied together and in order.
+func (n *RaftNode) AddRecords(ctx context.Context, records []*Record) error {
+	for _, record := range records {
+		if record.TombStone {
+			if err := n.cluster.cfg.checkKeySize(record.Key); err != nil {
+				return err
+			}
+		} else if err := n.cluster.cfg.checkRecordSize(record); err != nil {
+			return err
+		}
+	}
+	mutations, err := encodeMutations(records...)
+	if err != nil {
+		return err
+	}
+	return n.propose(ctx, mutations)
+}
+
+// GetTyped reads key once every write acknowledged before the call is applied to the local cluster.
+func (n *RaftNode) GetTyped(ctx context.Context, key string) (val any, valueType ValueType, ok bool, err error) {
+	if _, err = n.ReadIndex(ctx); err != nil {
+		return nil, ValueTypeUnknown, false, err
+	}
+	return n.cluster.GetTyped(key)
+}
+
+// propose appends an entry to the log of the leader and waits until it's applied.
+func (n *RaftNode) propose(ctx context.Context, mutations []Mutation) error {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return ErrClosed
+	}
+	if n.role != raftLeader {
+		n.lock.Unlock()
+		return &NotLeaderError{Leader: n.cfg.Peers[n.leader]}
+	}
+	entry := raftEntry{Index: n.log.lastIndex() + 1, Term: n.term, Mutations: mutations}
+	if err := n.log.append(entry); err != nil {
+		n.lock.Unlock()
+		return err
+	}
+	done := make(chan error, 1)
+	n.waiters[entry.Index] = raftWaiter{term: entry.Term, done: done}
+	n.advanceCommitIndex()
+	n.kickReplicators()
+	n.lock.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		n.lock.Lock()
+		delete(n.waiters, entry.Index)
+		n.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// ReadIndex returns an index of the log once it's applied to the local cluster, every write acknowledged before the
+// call is then visible. The leader takes its commit index and checks with a majority that it's still the leader, a
+// follower asks the leader for it.
+func (n *RaftNode) ReadIndex(ctx context.Context) (uint64, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return 0, ErrClosed
+	}
+	var index uint64
+	if n.role == raftLeader {
+		var err error
+		if index, err = n.leaderReadIndex(ctx); err != nil {
+			return 0, err
+		}
+	} else {
+		leader := n.cfg.Peers[n.leader]
+		if leader == "" || n.leader == n.cfg.ID {
+			return 0, &NotLeaderError{}
+		}
+		n.lock.Unlock()
+		resp := raftReadIndexResponse{}
+		err := n.call(ctx, leader, raftReadIndexPath, struct{}{}, &resp)
+		n.lock.Lock()
+		if err != nil {
+			return 0, err
+		}
+		index = resp.Index
+	}
+	return index, n.waitLocked(ctx, func() bool { return n.lastApplied >= index })
+}
+
+// leaderReadIndex returns the commit index once a majority confirmed the leadership, n.lock must be held.
+func (n *RaftNode) leaderReadIndex(ctx context.Context) (uint64, error) {
+	term := n.term
+	stillLeader := func() bool { return n.role == raftLeader && n.term == term }
+	// the commit index of a new leader is only known once an entry of its term is committed
+	err := n.waitLocked(ctx, func() bool {
+		commitTerm, _ := n.log.term(n.commitIndex)
+		return !stillLeader() || commitTerm == term
+	})
+	if err != nil {
+		return 0, err
+	}
+	index, start := n.commitIndex, n.sends
+	n.kickReplicators()
+	err = n.waitLocked(ctx, func() bool {
+		acks := 1
+		for _, send := range n.acked {
+			if send > start {
+				acks++
+			}
+		}
+		return !stillLeader() || acks >= n.quorum()
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !stillLeader() {
+		return 0, &NotLeaderError{Leader: n.cfg.Peers[n.leader]}
+	}
+	return index, nil
+}
+
+// waitLocked waits until ready returns true, n.lock must be held.
+func (n *RaftNode) waitLocked(ctx context.Context, ready func() bool) error {
+	stop := context.AfterFunc(ctx, func() {
+		n.lock.Lock()
+		n.changed.Broadcast()
+		n.lock.Unlock()
+	})
+	defer stop()
+	for !ready() {
+		if n.closed {
+			return ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n.changed.Wait()
+	}
+	return nil
+}
+
+func (n *RaftNode) quorum() int {
+	return len(n.cfg.Peers)/2 + 1
+}
+
+func (n *RaftNode) resetElectionDeadline() {
+	timeout := n.cfg.ElectionTimeout + rand.N(n.cfg.ElectionTimeout)
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// persistState saves the term and the vote before they are acted upon, n.lock must be held.
+func (n *RaftNode) persistState() error {
+	return writeSyncedFile(filepath.Join(n.cfg.Dir, raftStateFileName), raftState{Term: n.term, VotedFor: n.votedFor})
+}
+
+// stepDown turns the node into a follower of term, n.lock must be held. The pending proposals fail, their outcome
+// is unknown until the new leader is known.
+func (n *RaftNode) stepDown(term uint64) error {
+	if term > n.term {
+		n.term, n.votedFor, n.leader = term, "", ""
+		if err := n.persistState(); err != nil {
+			return err
+		}
+	}
+	if n.role != raftFollower {
+		log.Printf("[INFO] Raft node %s is a follower at term %d\n", n.cfg.ID, n.term)
+	}
+	if n.role == raftLeader {
+		n.failWaiters(&NotLeaderError{})
+	}
+	n.role = raftFollower
+	n.changed.Broadcast()
+	return nil
+}
+
+func (n *RaftNode) failWaiters(err error) {
+	for index, waiter := range n.waiters {
+		waiter.done <- err
+		delete(n.waiters, index)
+	}
+}
+
+func (n *RaftNode) runTicker() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(max(n.cfg.HeartbeatInterval/5, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+			n.lock.Lock()
+			if n.role != raftLeader && time.Now().After(n.electionDeadline) {
+				n.startElection()
+			}
+			n.lock.Unlock()
+		}
+	}
+}
+
+// startElection asks every peer for its vote for the next term, n.lock must be held.
+func (n *RaftNode) startElection() {
+	n.resetElectionDeadline()
+	n.role, n.term, n.votedFor, n.leader = raftCandidate, n.term+1, n.cfg.ID, ""
+	if err := n.persistState(); err != nil {
+		log.Printf("[ERROR] Raft node %s can't start an election: %v\n", n.cfg.ID, err)
+		n.role = raftFollower
+		return
+	}
+	n.changed.Broadcast()
+	req := raftVoteRequest{Term: n.term, Candidate: n.cfg.ID, LastIndex: n.log.lastIndex(), LastTerm: n.log.lastTerm()}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for id, peer := range n.cfg.Peers {
+		if id == n.cfg.ID {
+			continue
+		}
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			resp := raftVoteResponse{}
+			ctx, cancel := context.WithTimeout(n.ctx, n.cfg.ElectionTimeout)
+			defer cancel()
+			if err := n.call(ctx, peer, raftVotePath, req, &resp); err != nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.role != raftCandidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			if votes++; votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader starts the replication to every follower with an empty entry of the new term, n.lock must be held.
+func (n *RaftNode) becomeLeader() {
+	n.role, n.leader = raftLeader, n.cfg.ID
+	if err := n.log.append(raftEntry{Index: n.log.lastIndex() + 1, Term: n.term}); err != nil {
+		log.Printf("[ERROR] Raft node %s can't lead: %v\n", n.cfg.ID, err)
+		n.role, n.leader = raftFollower, ""
+		return
+	}
+	log.Printf("[INFO] Raft node %s is the leader of term %d\n", n.cfg.ID, n.term)
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.acked = make(map[string]uint64)
+	n.kicks = make(map[string]chan struct{})
+	for id := range n.cfg.Peers {
+		if id == n.cfg.ID {
+			continue
+		}
+		n.nextIndex[id] = n.log.lastIndex()
+		n.kicks[id] = make(chan struct{}, 1)
+		n.wg.Add(1)
+		go n.runReplicator(id, n.term, n.kicks[id])
+	}
+	n.advanceCommitIndex()
+	n.changed.Broadcast()
+}
+
+func (n *RaftNode) kickReplicators() {
+	for _, kick := range n.kicks {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advanceCommitIndex commits the newest entry of the current term stored by a majority, n.lock must be held. The
+// entries of the previous terms are committed along with it.
+func (n *RaftNode) advanceCommitIndex() {
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.log.term(index); term != n.term {
+			break
+		}
+		replicas := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				replicas++
+			}
+		}
+		if replicas >= n.quorum() {
+			n.commitIndex = index
+			n.changed.Broadcast()
+			return
+		}
+	}
+}
+
+// runReplicator sends the missing entries to a follower whenever there are new ones, and an empty append as a
+// heartbeat otherwise, for as long as the node leads term.
+func (n *RaftNode) runReplicator(id string, term uint64, kick chan struct{}) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for n.replicate(id, term) {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+// replicate sends a single append or snapshot to a follower, it returns false once the node doesn't lead term.
+func (n *RaftNode) replicate(id string, term uint64) bool {
+	n.lock.Lock()
+	if n.role != raftLeader || n.term != term {
+		n.lock.Unlock()
+		return false
+	}
+	n.sends++
+	send, next := n.sends, n.nextIndex[id]
+	if next <= n.log.snapshotIndex {
+		snapshotDir := n.snapshotDir
+		n.lock.Unlock()
+		return n.sendSnapshot(id, term, send, snapshotDir)
+	}
+	prevTerm, _ := n.log.term(next - 1)
+	req := raftAppendRequest{
+		Term:      term,
+		Leader:    n.cfg.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  prevTerm,
+		Entries:   n.log.slice(next, next+maxRaftAppendEntries),
+		Commit:    n.commitIndex,
+	}
+	n.lock.Unlock()
+
+	resp := raftAppendResponse{}
+	ctx, cancel := context.WithTimeout(n.ctx, n.cfg.ElectionTimeout)
+	defer cancel()
+	if err := n.call(ctx, n.cfg.Peers[id], raftAppendPath, req, &resp); err != nil {
+		return n.ctx.Err() == nil
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return false
+	}
+	if n.role != raftLeader || n.term != term {
+		return false
+	}
+	n.acked[id] = max(n.acked[id], send)
+	n.changed.Broadcast()
+	if resp.Success {
+		match := req.PrevIndex + uint64(len(req.Entries))
+		n.matchIndex[id] = max(n.matchIndex[id], match)
+		n.nextIndex[id] = max(n.nextIndex[id], match+1)
+		n.advanceCommitIndex()
+	} else {
+		n.nextIndex[id] = max(1, min(resp.ConflictIndex, next-1))
+	}
+	if n.nextIndex[id] <= n.log.lastIndex() {
+		select {
+		case n.kicks[id] <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// handleAppend stores the entries of the leader once the log agrees with it on the entry before them.
+func (n *RaftNode) handleAppend(req raftAppendRequest) (raftAppendResponse, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return raftAppendResponse{}, ErrClosed
+	}
+	resp := raftAppendResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	if req.Term > n.term || n.role != raftFollower {
+		if err := n.stepDown(req.Term); err != nil {
+			return resp, err
+		}
+	}
+	resp.Term = n.term
+	n.leader = req.Leader
+	n.resetElectionDeadline()
+
+	if req.PrevIndex > n.log.lastIndex() {
+		resp.ConflictIndex = n.log.lastIndex() + 1
+		return resp, nil
+	}
+	// the entries up to the snapshot are committed, they agree with the leader
+	if req.PrevIndex > n.log.snapshotIndex {
+		if term, _ := n.log.term(req.PrevIndex); term != req.PrevTerm {
+			resp.ConflictIndex = n.log.firstIndexOfTerm(term, req.PrevIndex)
+			return resp, nil
+		}
+	}
+	for i, entry := range req.Entries {
+		if entry.Index <= n.log.snapshotIndex {
+			continue
+		}
+		if term, ok := n.log.term(entry.Index); ok {
+			if term == entry.Term {
+				continue
+			}
+			if err := n.log.truncate(entry.Index); err != nil {
+				return resp, err
+			}
+		}
+		if err := n.log.append(req.Entries[i:]...); err != nil {
+			return resp, err
+		}
+		break
+	}
+	if lastNew := req.PrevIndex + uint64(len(req.Entries)); req.Commit > n.commitIndex && lastNew > n.commitIndex {
+		n.commitIndex = min(req.Commit, lastNew)
+		n.changed.Broadcast()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// handleVote grants the vote of the term to the first candidate whose log is at least as up to date.
+func (n *RaftNode) handleVote(req raftVoteRequest) (raftVoteResponse, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return raftVoteResponse{}, ErrClosed
+	}
+	if req.Term > n.term {
+		if err := n.stepDown(req.Term); err != nil {
+			return raftVoteResponse{Term: n.term}, err
+		}
+	}
+	resp := raftVoteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return resp, nil
+	}
+	lastTerm := n.log.lastTerm()
+	if req.LastTerm < lastTerm || (req.LastTerm == lastTerm && req.LastIndex < n.log.lastIndex()) {
+		return resp, nil
+	}
+	n.votedFor = req.Candidate
+	if err := n.persistState(); err != nil {
+		n.votedFor = ""
+		return resp, err
+	}
+	n.resetElectionDeadline()
+	resp.Granted = true
+	return resp, nil
+}
+
+// handleReadIndex answers the read index of the leader to a follower.
+func (n *RaftNode) handleReadIndex(ctx context.Context) (raftReadIndexResponse, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.role != raftLeader {
+		return raftReadIndexResponse{}, &NotLeaderError{Leader: n.cfg.Peers[n.leader]}
+	}
+	index, err := n.leaderReadIndex(ctx)
+	return raftReadIndexResponse{Index: index}, err
+}
+
+// runApplyLoop applies the committed entries to the cluster in order, and takes a snapshot every
+// cfg.SnapshotThreshold entries.
+func (n *RaftNode) runApplyLoop() {
+	defer n.wg.Done()
+	for {
+		n.lock.Lock()
+		for !n.closed && n.lastApplied >= n.commitIndex {
+			n.changed.Wait()
+		}
+		closed := n.closed
+		n.lock.Unlock()
+		if closed {
+			return
+		}
+
+		n.applyLock.Lock()
+		n.lock.Lock()
+		entries := n.log.slice(n.lastApplied+1, n.commitIndex+1)
+		n.lock.Unlock()
+		err := n.apply(entries)
+		if status := n.Status(); err == nil && status.AppliedIndex-status.SnapshotIndex >= n.cfg.SnapshotThreshold {
+			err = n.takeSnapshot()
+		}
+		n.applyLock.Unlock()
+		if err != nil && n.ctx.Err() == nil {
+			log.Printf("[ERROR] Raft node %s failed to apply the log: %v\n", n.cfg.ID, err)
+			select {
+			case <-n.ctx.Done():
+			case <-time.After(raftApplyRetryDelay):
+			}
+		}
+	}
+}
+
+// apply writes the entries to the cluster and answers the proposals waiting for them, applyLock must be held.
+func (n *RaftNode) apply(entries []raftEntry) error {
+	for _, entry := range entries {
+		n.lock.Lock()
+		// a snapshot installed meanwhile already holds the entry
+		next := entry.Index == n.lastApplied+1
+		n.lock.Unlock()
+		if !next {
+			continue
+		}
+		for _, mutation := range entry.Mutations {
+			if err := n.cluster.applyMutation(n.ctx, mutation); err != nil {
+				return err
+			}
+		}
+
+		n.lock.Lock()
+		n.lastApplied = entry.Index
+		if waiter, ok := n.waiters[entry.Index]; ok {
+			if waiter.term == entry.Term {
+				waiter.done <- nil
+			} else {
+				waiter.done <- &NotLeaderError{Leader: n.cfg.Peers[n.leader]}
+			}
+			delete(n.waiters, entry.Index)
+		}
+		n.changed.Broadcast()
+		n.lock.Unlock()
+	}
+	return nil
+}
+
+// takeSnapshot checkpoints the cluster at the applied index and drops the entries it holds, applyLock must be held
+// so no entry is applied meanwhile.
+func (n *RaftNode) takeSnapshot() error {
+	n.lock.Lock()
+	index := n.lastApplied
+	term, _ := n.log.term(index)
+	n.lock.Unlock()
+
+	dir := filepath.Join(n.cfg.Dir, raftSnapshotDirName(index))
+	os.RemoveAll(dir + ".tmp")
+	if err := n.cluster.Checkpoint(dir + ".tmp"); err != nil {
+		return err
+	}
+	err := writeSyncedFile(filepath.Join(dir+".tmp", raftSnapshotFileName), raftSnapshotMetadata{Index: index, Term: term})
+	if err == nil {
+		os.RemoveAll(dir)
+		if err = os.Rename(dir+".tmp", dir); err != nil {
+			err = fmt.Errorf("%w: rename raft snapshot: %w", ErrIO, err)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir + ".tmp")
+		return err
+	}
+	return n.useSnapshot(dir, raftSnapshotMetadata{Index: index, Term: term})
+}
+
+// useSnapshot makes dir the newest snapshot, compacts the log and removes the previous snapshot.
+func (n *RaftNode) useSnapshot(dir string, snapshot raftSnapshotMetadata) error {
+	n.lock.Lock()
+	err := n.log.compact(snapshot.Index, snapshot.Term)
+	previous := n.snapshotDir
+	if err == nil {
+		n.snapshotDir = dir
+	}
+	n.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if previous != "" && previous != dir {
+		os.RemoveAll(previous)
+	}
+	log.Printf("[INFO] Raft node %s compacted its log up to entry %d\n", n.cfg.ID, snapshot.Index)
+	return nil
+}
+
+// installSnapshot replaces the cluster with a snapshot received from the leader, dir is a directory of cfg.Dir
+// holding it.
+func (n *RaftNode) installSnapshot(dir string, snapshot raftSnapshotMetadata) error {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	n.lock.Lock()
+	applied := n.lastApplied
+	n.lock.Unlock()
+	if snapshot.Index <= applied {
+		os.RemoveAll(dir)
+		return nil
+	}
+
+	final := filepath.Join(n.cfg.Dir, raftSnapshotDirName(snapshot.Index))
+	os.RemoveAll(final)
+	if err := os.Rename(dir, final); err != nil {
+		return fmt.Errorf("%w: rename raft snapshot: %w", ErrIO, err)
+	}
+	if err := restoreRaftSnapshot(n.cluster, final); err != nil {
+		return err
+	}
+	if err := n.useSnapshot(final, snapshot); err != nil {
+		return err
+	}
+	n.lock.Lock()
+	n.lastApplied = snapshot.Index
+	n.commitIndex = max(n.commitIndex, snapshot.Index)
+	n.changed.Broadcast()
+	n.lock.Unlock()
+	log.Printf("[INFO] Raft node %s installed the snapshot of entry %d\n", n.cfg.ID, snapshot.Index)
+	return nil
+}
+
+// restoreRaftSnapshot replaces the content of the cluster with a snapshot, which is kept: its files are linked into
+// a directory of the data directory first.
+func restoreRaftSnapshot(cluster *TableCluster, snapshotDir string) error {
+	dir, err := os.MkdirTemp(cluster.cfg.DataDir, "raft-restore-")
+	if err != nil {
+		return fmt.Errorf("%w: create restore directory: %w", ErrIO, err)
+	}
+	defer os.RemoveAll(dir)
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return fmt.Errorf("%w: read raft snapshot: %w", ErrIO, err)
+	}
+	for _, entry := range entries {
+		if err = linkOrCopyFile(filepath.Join(snapshotDir, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return cluster.replaceWithCheckpoint(dir)
+}
+
+// sendSnapshot sends the snapshot of dir to a follower that needs entries the log doesn't hold anymore, send is the
+// number of the request among n.sends.
+func (n *RaftNode) sendSnapshot(id string, term, send uint64, dir string) bool {
+	snapshot, err := readRaftSnapshotMetadata(dir)
+	resp := raftSnapshotResponse{}
+	if err == nil {
+		resp, err = n.postSnapshot(n.cfg.Peers[id], term, dir)
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return false
+	}
+	if n.role != raftLeader || n.term != term {
+		return false
+	}
+	if err != nil {
+		if n.ctx.Err() == nil {
+			log.Printf("[WARN] Raft node %s failed to send its snapshot to %s: %v\n", n.cfg.ID, id, err)
+		}
+		return n.ctx.Err() == nil
+	}
+	n.acked[id] = max(n.acked[id], send)
+	n.matchIndex[id] = max(n.matchIndex[id], snapshot.Index)
+	n.nextIndex[id] = max(n.nextIndex[id], snapshot.Index+1)
+	n.advanceCommitIndex()
+	n.changed.Broadcast()
+	return true
+}
+
+// handleSnapshot is the follower side of sendSnapshot, extract writes the snapshot into the given directory.
+func (n *RaftNode) handleSnapshot(term uint64, leader string, extract func(dir string) error) (raftSnapshotResponse, error) {
+	n.lock.Lock()
+	resp := raftSnapshotResponse{Term: n.term}
+	if n.closed {
+		n.lock.Unlock()
+		return resp, ErrClosed
+	}
+	if term < n.term {
+		n.lock.Unlock()
+		return resp, nil
+	}
+	if term > n.term || n.role != raftFollower {
+		if err := n.stepDown(term); err != nil {
+			n.lock.Unlock()
+			return resp, err
+		}
+	}
+	resp.Term = n.term
+	n.leader = leader
+	n.resetElectionDeadline()
+	n.lock.Unlock()
+
+	dir, err := os.MkdirTemp(n.cfg.Dir, raftReceivePrefix+"*")
+	if err != nil {
+		return resp, fmt.Errorf("%w: create snapshot directory: %w", ErrIO, err)
+	}
+	if err = extract(dir); err == nil {
+		var snapshot raftSnapshotMetadata
+		if snapshot, err = readRaftSnapshotMetadata(dir); err == nil {
+			err = n.installSnapshot(dir, snapshot)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return resp, err
+	}
+	n.lock.Lock()
+	n.resetElectionDeadline()
+	n.lock.Unlock()
+	resp.Installed = true
+	return resp, nil
+}
+
+func readRaftSnapshotMetadata(dir string) (raftSnapshotMetadata, error) {
+	snapshot := raftSnapshotMetadata{}
+	b, err := os.ReadFile(filepath.Join(dir, raftSnapshotFileName))
+	if err != nil {
+		return snapshot, fmt.Errorf("%w: read raft snapshot metadata: %w", ErrIO, err)
+	}
+	if err = msgpack.Unmarshal(b, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("%w: decode raft snapshot metadata: %w", ErrCorruption, err)
+	}
+	return snapshot, nil
+}
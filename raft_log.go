@@ -0,0 +1,283 @@
+package keynest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The raft directory holds the vote, the log entries following the newest snapshot, and the snapshots themselves,
+// each one a checkpoint of the cluster along with its snapshot metadata file. A snapshot sent by the leader is
+// received in a directory of its own before it's installed.
+const (
+	raftStateFileName    = "raft-state"
+	raftLogFileName      = "raft-log"
+	raftSnapshotPrefix   = "snapshot-"
+	raftSnapshotFileName = "raft-snapshot"
+	raftReceivePrefix    = "receive-"
+)
+
+// raftEntry is an entry of the raft log, a batch of mutations applied together. The entry a leader appends when it's
+// elected holds no mutation.
+type raftEntry struct {
+	Index     uint64
+	Term      uint64
+	Mutations []Mutation
+}
+
+// raftState is the part of the state of a node that must survive a restart along with the log.
+type raftState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// raftSnapshotMetadata tells which entries a snapshot replaces.
+type raftSnapshotMetadata struct {
+	Index uint64
+	Term  uint64
+}
+
+func raftSnapshotDirName(index uint64) string {
+	return fmt.Sprintf("%s%020d", raftSnapshotPrefix, index)
+}
+
+func readRaftState(dir string) (raftState, error) {
+	state := raftState{}
+	b, err := os.ReadFile(filepath.Join(dir, raftStateFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("%w: read raft state: %w", ErrIO, err)
+	}
+	if err = msgpack.Unmarshal(b, &state); err != nil {
+		return state, fmt.Errorf("%w: decode raft state: %w", ErrCorruption, err)
+	}
+	return state, nil
+}
+
+// writeSyncedFile writes a small file through a synced temporary file renamed over the previous one.
+func writeSyncedFile(path string, v any) error {
+	b, err := msgpack.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", filepath.Base(path), err)
+	}
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("%w: create %s: %w", ErrIO, filepath.Base(path), err)
+	}
+	defer file.Close()
+	if _, err = file.Write(b); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("%w: write %s: %w", ErrIO, filepath.Base(path), err)
+	}
+	return nil
+}
+
+// latestRaftSnapshot returns the directory and the metadata of the newest complete snapshot of dir, an empty
+// directory name when there is none.
+func latestRaftSnapshot(dir string) (string, raftSnapshotMetadata, error) {
+	latest, metadata := "", raftSnapshotMetadata{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", metadata, fmt.Errorf("%w: read raft directory: %w", ErrIO, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), raftSnapshotPrefix) || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name(), raftSnapshotFileName))
+		if err != nil {
+			continue
+		}
+		candidate := raftSnapshotMetadata{}
+		if err = msgpack.Unmarshal(b, &candidate); err != nil {
+			return "", metadata, fmt.Errorf("%w: decode metadata of %s: %w", ErrCorruption, entry.Name(), err)
+		}
+		if latest == "" || candidate.Index > metadata.Index {
+			latest, metadata = filepath.Join(dir, entry.Name()), candidate
+		}
+	}
+	return latest, metadata, nil
+}
+
+// raftLog holds the entries following the newest snapshot, in memory and in the log file where every entry is a
+// 4-byte length followed by the msgpack entry. Appends are synced before they return. Truncating or compacting the
+// log rewrites the file.
+type raftLog struct {
+	path          string
+	file          *os.File
+	size          int64
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	entries       []raftEntry
+}
+
+// openRaftLog reads the log file of dir, skipping the entries the snapshot already holds. An incomplete entry left
+// by a crash is cut off the file.
+func openRaftLog(dir string, snapshot raftSnapshotMetadata) (*raftLog, error) {
+	l := &raftLog{
+		path:          filepath.Join(dir, raftLogFileName),
+		snapshotIndex: snapshot.Index,
+		snapshotTerm:  snapshot.Term,
+		entries:       make([]raftEntry, 0),
+	}
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("%w: open raft log: %w", ErrIO, err)
+	}
+	reader := bufio.NewReader(file)
+	size := int64(0)
+	for {
+		header := make([]byte, 4)
+		if _, err = io.ReadFull(reader, header); err != nil {
+			break
+		}
+		b := make([]byte, binary.LittleEndian.Uint32(header))
+		if _, err = io.ReadFull(reader, b); err != nil {
+			break
+		}
+		entry := raftEntry{}
+		if err = msgpack.Unmarshal(b, &entry); err != nil {
+			break
+		}
+		size += int64(len(header) + len(b))
+		if entry.Index <= l.snapshotIndex {
+			continue
+		}
+		if entry.Index != l.lastIndex()+1 {
+			file.Close()
+			return nil, fmt.Errorf("%w: raft log holds entry %d after entry %d", ErrCorruption, entry.Index, l.lastIndex())
+		}
+		l.entries = append(l.entries, entry)
+	}
+	if err = file.Truncate(size); err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w: truncate raft log: %w", ErrIO, err)
+	}
+	l.file, l.size = file, size
+	return l, nil
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapshotIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapshotTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry index, ok is false when the log doesn't know it anymore or yet.
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	switch {
+	case index == l.snapshotIndex:
+		return l.snapshotTerm, true
+	case index < l.snapshotIndex || index > l.lastIndex():
+		return 0, false
+	}
+	return l.entries[index-l.snapshotIndex-1].Term, true
+}
+
+// firstIndexOfTerm returns the first index of the run of entries of term that ends at index.
+func (l *raftLog) firstIndexOfTerm(term, index uint64) uint64 {
+	for index-1 > l.snapshotIndex {
+		if t, _ := l.term(index - 1); t != term {
+			break
+		}
+		index--
+	}
+	return index
+}
+
+// slice returns a copy of the entries from the index from to the index to excluded.
+func (l *raftLog) slice(from, to uint64) []raftEntry {
+	from = max(from, l.snapshotIndex+1)
+	to = min(to, l.lastIndex()+1)
+	if from >= to {
+		return nil
+	}
+	return append([]raftEntry(nil), l.entries[from-l.snapshotIndex-1:to-l.snapshotIndex-1]...)
+}
+
+func (l *raftLog) append(entries ...raftEntry) error {
+	buf := make([]byte, 0)
+	for _, entry := range entries {
+		b, err := msgpack.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("marshal raft entry: %w", err)
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b)))
+		buf = append(buf, b...)
+	}
+	_, err := l.file.Write(buf)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// a partial entry would hide the next ones
+		l.file.Truncate(l.size)
+		l.file.Seek(l.size, io.SeekStart)
+		return fmt.Errorf("%w: append to raft log: %w", ErrIO, err)
+	}
+	l.size += int64(len(buf))
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// truncate drops the entries from index on, they conflict with the ones of the leader.
+func (l *raftLog) truncate(index uint64) error {
+	return l.rewrite(l.snapshotIndex, l.snapshotTerm, l.slice(l.snapshotIndex+1, index))
+}
+
+// compact drops the entries a new snapshot holds. The following entries are kept if the log agrees with the
+// snapshot on the term of index, they are all dropped otherwise.
+func (l *raftLog) compact(index, term uint64) error {
+	entries := []raftEntry(nil)
+	if t, ok := l.term(index); ok && t == term {
+		entries = l.slice(index+1, l.lastIndex()+1)
+	}
+	return l.rewrite(index, term, entries)
+}
+
+func (l *raftLog) rewrite(snapshotIndex, snapshotTerm uint64, entries []raftEntry) error {
+	file, err := os.Create(l.path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("%w: create raft log: %w", ErrIO, err)
+	}
+	previous, previousSize, previousEntries := l.file, l.size, l.entries
+	l.file, l.size, l.entries = file, 0, nil
+	if err = l.append(entries...); err == nil {
+		err = os.Rename(file.Name(), l.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		l.file, l.size, l.entries = previous, previousSize, previousEntries
+		return fmt.Errorf("%w: rewrite raft log: %w", ErrIO, err)
+	}
+	previous.Close()
+	l.snapshotIndex, l.snapshotTerm = snapshotIndex, snapshotTerm
+	return nil
+}
+
+func (l *raftLog) close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,249 @@
+package keynest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRaftGroup runs the nodes of a raft group on loopback, a stopped node keeps its server, which answers 503. A
+// partitioned node keeps running but neither reaches nor is reached by the other nodes.
+type testRaftGroup struct {
+	t           *testing.T
+	cfgs        []RaftConfig
+	clusters    []*TableCluster
+	nodes       []*RaftNode
+	handlers    []atomic.Pointer[http.Handler]
+	partitioned []atomic.Bool
+}
+
+// partitionTransport fails every request while its node is partitioned.
+type partitionTransport struct {
+	partitioned *atomic.Bool
+}
+
+func (p partitionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p.partitioned.Load() {
+		return nil, errors.New("partitioned")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestRaftGroup(t *testing.T, size int, snapshotThreshold uint64) *testRaftGroup {
+	t.Helper()
+	g := &testRaftGroup{
+		t:           t,
+		cfgs:        make([]RaftConfig, size),
+		clusters:    make([]*TableCluster, size),
+		nodes:       make([]*RaftNode, size),
+		handlers:    make([]atomic.Pointer[http.Handler], size),
+		partitioned: make([]atomic.Bool, size),
+	}
+	peers := make(map[string]string)
+	servers := make([]*httptest.Server, size)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler := g.handlers[i].Load()
+			if handler == nil || g.partitioned[i].Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			(*handler).ServeHTTP(w, r)
+		}))
+		peers[fmt.Sprintf("node-%d", i)] = "http://" + servers[i].Listener.Addr().String()
+	}
+	for i, server := range servers {
+		server.Start()
+		t.Cleanup(server.Close)
+		g.clusters[i] = newTestTableCluster(t, t.TempDir())
+		g.cfgs[i] = RaftConfig{
+			ID:                fmt.Sprintf("node-%d", i),
+			Peers:             peers,
+			Dir:               t.TempDir(),
+			ElectionTimeout:   150 * time.Millisecond,
+			HeartbeatInterval: 30 * time.Millisecond,
+			SnapshotThreshold: snapshotThreshold,
+			Transport:         partitionTransport{partitioned: &g.partitioned[i]},
+		}
+		g.start(i)
+	}
+	t.Cleanup(func() {
+		for i := range g.nodes {
+			g.stop(i)
+		}
+	})
+	return g
+}
+
+func (g *testRaftGroup) start(i int) {
+	g.t.Helper()
+	node, err := NewRaftNode(g.clusters[i], g.cfgs[i])
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	handler := node.Handler()
+	g.nodes[i] = node
+	g.handlers[i].Store(&handler)
+}
+
+func (g *testRaftGroup) stop(i int) {
+	if g.nodes[i] == nil {
+		return
+	}
+	g.handlers[i].Store(nil)
+	g.nodes[i].Close()
+	g.nodes[i] = nil
+}
+
+// leader waits until a single running node out of any partition leads and returns its position.
+func (g *testRaftGroup) leader() int {
+	g.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := -1
+		for i, node := range g.nodes {
+			if node != nil && !g.partitioned[i].Load() && node.Status().Role == "leader" {
+				if leader != -1 {
+					leader = -2
+					break
+				}
+				leader = i
+			}
+		}
+		if leader >= 0 {
+			return leader
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	g.t.Fatal("no leader elected")
+	return -1
+}
+
+func TestRaftReplicatesWrites(t *testing.T) {
+	g := newTestRaftGroup(t, 3, 1000)
+	ctx := context.Background()
+	leader := g.leader()
+	if err := g.nodes[leader].AddRecords(ctx, []*Record{
+		{Key: "a", Val: "1", Metadata: Metadata{ValueType: ValueTypeString}},
+		{Key: "b", Val: "2", Metadata: Metadata{ValueType: ValueTypeString}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.nodes[leader].Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	follower := (leader + 1) % 3
+	err := g.nodes[follower].PutTyped(ctx, "c", "3", ValueTypeString)
+	notLeader := (*NotLeaderError)(nil)
+	if !errors.As(err, &notLeader) || notLeader.Leader != g.cfgs[leader].Peers[g.cfgs[leader].ID] {
+		t.Fatalf("PutTyped on a follower = %v, want a NotLeaderError naming the leader", err)
+	}
+	// the read index makes the write visible on the follower
+	val, _, ok, err := g.nodes[follower].GetTyped(ctx, "a")
+	if err != nil || !ok || val != "1" {
+		t.Fatalf("GetTyped(a) on a follower = %v, %v, %v", val, ok, err)
+	}
+	if _, _, ok, err = g.nodes[follower].GetTyped(ctx, "b"); err != nil || ok {
+		t.Fatalf("GetTyped(b) on a follower = %v, %v, want deleted", ok, err)
+	}
+
+	g.stop(leader)
+	newLeader := g.leader()
+	if err = g.nodes[newLeader].PutTyped(ctx, "c", "3", ValueTypeString); err != nil {
+		t.Fatal(err)
+	}
+	for i, node := range g.nodes {
+		if node == nil {
+			continue
+		}
+		for key, want := range map[string]string{"a": "1", "c": "3"} {
+			if val, _, ok, err = node.GetTyped(ctx, key); err != nil || !ok || val != want {
+				t.Fatalf("GetTyped(%s) on node %d = %v, %v, %v, want %s", key, i, val, ok, err, want)
+			}
+		}
+	}
+}
+
+func TestRaftNodeCatchesUpFromSnapshot(t *testing.T) {
+	g := newTestRaftGroup(t, 3, 5)
+	ctx := context.Background()
+	leader := g.leader()
+	lagging := (leader + 1) % 3
+	g.stop(lagging)
+	for i := 0; i < 30; i++ {
+		if err := g.nodes[leader].PutTyped(ctx, fmt.Sprintf("key-%02d", i), int64(i), ValueTypeInt64); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := g.nodes[leader].Status()
+	if status.SnapshotIndex == 0 {
+		t.Fatalf("status = %+v, want a snapshot", status)
+	}
+
+	g.start(lagging)
+	deadline := time.Now().Add(5 * time.Second)
+	for g.nodes[lagging].Status().AppliedIndex < status.CommitIndex && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := g.nodes[lagging].Status(); got.AppliedIndex < status.CommitIndex || got.SnapshotIndex == 0 {
+		t.Fatalf("status = %+v, want entry %d applied from a snapshot", got, status.CommitIndex)
+	}
+	for i := 0; i < 30; i++ {
+		val, ok, err := g.clusters[lagging].Get(fmt.Sprintf("key-%02d", i))
+		if err != nil || !ok || val != int64(i) {
+			t.Fatalf("Get(key-%02d) = %v, %v, %v", i, val, ok, err)
+		}
+	}
+
+	// a restarted node starts again from its own snapshot, and applies the following entries once they are committed
+	g.stop(lagging)
+	g.start(lagging)
+	if val, ok, err := g.clusters[lagging].Get("key-00"); err != nil || !ok || val != int64(0) {
+		t.Fatalf("Get(key-00) after a restart = %v, %v, %v", val, ok, err)
+	}
+	for g.nodes[lagging].Leader() == "" && time.Now().Before(deadline.Add(5*time.Second)) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if val, _, ok, err := g.nodes[lagging].GetTyped(ctx, "key-29"); err != nil || !ok || val != int64(29) {
+		t.Fatalf("GetTyped(key-29) after a restart = %v, %v, %v", val, ok, err)
+	}
+}
+
+func TestRaftPartitionedLeaderRefusesReads(t *testing.T) {
+	g := newTestRaftGroup(t, 3, 1000)
+	ctx := context.Background()
+	oldLeader := g.leader()
+	if err := g.nodes[oldLeader].PutTyped(ctx, "a", "1", ValueTypeString); err != nil {
+		t.Fatal(err)
+	}
+
+	g.partitioned[oldLeader].Store(true)
+	newLeader := g.leader()
+	if err := g.nodes[newLeader].PutTyped(ctx, "a", "2", ValueTypeString); err != nil {
+		t.Fatal(err)
+	}
+	if status := g.nodes[oldLeader].Status(); status.Role != "leader" {
+		t.Fatalf("status of the partitioned node = %+v, it should still believe it leads", status)
+	}
+	// the answers the deposed leader got before the partition don't confirm its leadership
+	readCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	if val, _, _, err := g.nodes[oldLeader].GetTyped(readCtx, "a"); err == nil {
+		t.Fatalf("GetTyped(a) on the partitioned leader = %v, want an error", val)
+	}
+
+	g.partitioned[oldLeader].Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for (g.nodes[oldLeader].Status().Role == "leader" || g.nodes[oldLeader].Leader() == "") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if val, _, ok, err := g.nodes[oldLeader].GetTyped(ctx, "a"); err != nil || !ok || val != "2" {
+		t.Fatalf("GetTyped(a) after the partition = %v, %v, %v, want 2", val, ok, err)
+	}
+}
@@ -0,0 +1,228 @@
+package keynest
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The nodes of a raft group talk to each other with msgpack POST requests under RaftHandlerPrefix, the snapshots are
+// sent as tar archives.
+const (
+	RaftHandlerPrefix = "/raft/"
+	raftVotePath      = RaftHandlerPrefix + "vote"
+	raftAppendPath    = RaftHandlerPrefix + "append"
+	raftSnapshotPath  = RaftHandlerPrefix + "snapshot"
+	raftReadIndexPath = RaftHandlerPrefix + "read-index"
+	raftTermHeader    = "Keynest-Raft-Term"
+	raftLeaderHeader  = "Keynest-Raft-Leader"
+)
+
+type raftVoteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type raftVoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type raftAppendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []raftEntry
+	Commit    uint64
+}
+
+type raftAppendResponse struct {
+	Term    uint64
+	Success bool
+	// ConflictIndex is the index the leader should resume from when the follower refuses the entries
+	ConflictIndex uint64
+}
+
+type raftSnapshotResponse struct {
+	Term      uint64
+	Installed bool
+}
+
+type raftReadIndexResponse struct {
+	Index uint64
+}
+
+// Handler serves the requests of the other nodes of the group, it must be mounted on RaftHandlerPrefix.
+func (n *RaftNode) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(raftVotePath, func(w http.ResponseWriter, r *http.Request) {
+		req := raftVoteRequest{}
+		if decodeRaftRequest(w, r, &req) {
+			resp, err := n.handleVote(req)
+			writeRaftResponse(w, resp, err)
+		}
+	})
+	mux.HandleFunc(raftAppendPath, func(w http.ResponseWriter, r *http.Request) {
+		req := raftAppendRequest{}
+		if decodeRaftRequest(w, r, &req) {
+			resp, err := n.handleAppend(req)
+			writeRaftResponse(w, resp, err)
+		}
+	})
+	mux.HandleFunc(raftReadIndexPath, func(w http.ResponseWriter, r *http.Request) {
+		if decodeRaftRequest(w, r, &struct{}{}) {
+			resp, err := n.handleReadIndex(r.Context())
+			writeRaftResponse(w, resp, err)
+		}
+	})
+	mux.HandleFunc(raftSnapshotPath, n.serveSnapshot)
+	return mux
+}
+
+func decodeRaftRequest(w http.ResponseWriter, r *http.Request, req any) bool {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = msgpack.Unmarshal(body, req)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeRaftResponse answers a *NotLeaderError with 421 Misdirected Request and the leader in a header, so the caller
+// gets the same error back.
+func writeRaftResponse(w http.ResponseWriter, resp any, err error) {
+	if notLeader := (*NotLeaderError)(nil); errors.As(err, &notLeader) {
+		w.Header().Set(raftLeaderHeader, notLeader.Leader)
+		http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := msgpack.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/msgpack")
+	w.Write(body)
+}
+
+// call posts req to the path of a peer and decodes its answer into resp.
+func (n *RaftNode) call(ctx context.Context, peer, path string, req, resp any) error {
+	body, err := msgpack.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshal raft request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/msgpack")
+	return n.do(httpReq, resp)
+}
+
+func (n *RaftNode) do(req *http.Request, resp any) error {
+	httpResp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return fmt.Errorf("read raft response: %w", err)
+	}
+	if httpResp.StatusCode == http.StatusMisdirectedRequest {
+		return &NotLeaderError{Leader: httpResp.Header.Get(raftLeaderHeader)}
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s: %s", req.URL.Path, httpResp.Status, strings.TrimSpace(string(body)))
+	}
+	if err = msgpack.Unmarshal(body, resp); err != nil {
+		return fmt.Errorf("decode raft response: %w", err)
+	}
+	return nil
+}
+
+// postSnapshot streams the files of the snapshot dir to a peer.
+func (n *RaftNode) postSnapshot(peer string, term uint64, dir string) (raftSnapshotResponse, error) {
+	resp := raftSnapshotResponse{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return resp, fmt.Errorf("%w: read raft snapshot: %w", ErrIO, err)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(writer)
+		for _, entry := range entries {
+			if err := writeTarFile(tw, filepath.Join(dir, entry.Name())); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.CloseWithError(tw.Close())
+	}()
+	defer reader.Close()
+
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+raftSnapshotPath, reader)
+	if err != nil {
+		return resp, err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.Header.Set(raftTermHeader, strconv.FormatUint(term, 10))
+	req.Header.Set(raftLeaderHeader, n.cfg.ID)
+	if err = n.do(req, &resp); err != nil {
+		return resp, err
+	}
+	if !resp.Installed {
+		return resp, fmt.Errorf("snapshot refused at term %d", resp.Term)
+	}
+	return resp, nil
+}
+
+// serveSnapshot answers POST /raft/snapshot, whose body is the tar archive of a snapshot.
+func (n *RaftNode) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	term, err := strconv.ParseUint(r.Header.Get(raftTermHeader), 10, 64)
+	if err != nil {
+		http.Error(w, "term must be a number", http.StatusBadRequest)
+		return
+	}
+	// the server timeouts are meant for the client requests, not for a whole snapshot
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+
+	resp, err := n.handleSnapshot(term, r.Header.Get(raftLeaderHeader), func(dir string) error {
+		return extractTar(r.Body, dir)
+	})
+	if err != nil {
+		log.Printf("[ERROR] Raft node %s failed to install a snapshot: %v\n", n.cfg.ID, err)
+	}
+	writeRaftResponse(w, resp, err)
+}
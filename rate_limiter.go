@@ -0,0 +1,90 @@
+package keynest
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket measured in bytes per second. It allows bursts of up to one second worth of
+// bytes, a single request bigger than that is let through and the debt is paid by the following requests.
+// A nil RateLimiter or a rate of 0 means unlimited.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+	// rateCh is closed and replaced by SetRate, so the waiting goroutines sleep according to the new rate
+	rateCh chan struct{}
+}
+
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   bytesPerSec,
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+		rateCh: make(chan struct{}),
+	}
+}
+
+// SetRate changes the rate of the limiter, it's safe to be called while other goroutines are waiting. The waiting
+// goroutines pay the rest of their debt at the new rate, and are let through right away when it's unlimited.
+func (r *RateLimiter) SetRate(bytesPerSec int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refill(time.Now())
+	r.rate = bytesPerSec
+	if bytesPerSec <= 0 {
+		// the waiting requests are let through, their debt is forgiven
+		r.tokens = 0
+	}
+	r.tokens = min(r.tokens, float64(bytesPerSec))
+	close(r.rateCh)
+	r.rateCh = make(chan struct{})
+}
+
+func (r *RateLimiter) Rate() int64 {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate
+}
+
+// Wait blocks until n bytes are allowed to be read or written.
+func (r *RateLimiter) Wait(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rate <= 0 {
+		return
+	}
+	r.refill(time.Now())
+	r.tokens -= float64(n)
+	// debt is the number of bytes the bucket must be refilled with before the request is let through, it's paid at
+	// the rate in force while sleeping
+	debt := -r.tokens
+	for debt > 0 && r.rate > 0 {
+		rate, rateCh := r.rate, r.rateCh
+		r.mu.Unlock()
+		start := time.Now()
+		timer := time.NewTimer(time.Duration(debt / float64(rate) * float64(time.Second)))
+		select {
+		case <-timer.C:
+		case <-rateCh:
+			timer.Stop()
+		}
+		r.mu.Lock()
+		debt -= time.Since(start).Seconds() * float64(rate)
+	}
+}
+
+// refill adds the tokens earned since the last refill, up to one second worth of bytes.
+func (r *RateLimiter) refill(now time.Time) {
+	if r.rate > 0 {
+		r.tokens = min(r.tokens+now.Sub(r.last).Seconds()*float64(r.rate), float64(r.rate))
+	}
+	r.last = now
+}
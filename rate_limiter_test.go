@@ -0,0 +1,48 @@
+package keynest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterDelaysBeyondBurst(t *testing.T) {
+	limiter := NewRateLimiter(1000)
+
+	start := time.Now()
+	limiter.Wait(1000) // the initial burst is free
+	limiter.Wait(200)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected the second wait to be delayed, took %v", elapsed)
+	}
+
+	limiter.SetRate(0)
+	start = time.Now()
+	limiter.Wait(1 << 30)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected an unlimited limiter not to wait, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterWaitFollowsSetRate(t *testing.T) {
+	for _, rate := range []int64{0, 1 << 30} {
+		limiter := NewRateLimiter(1000)
+		limiter.Wait(1000)
+
+		done := make(chan time.Duration)
+		go func() {
+			start := time.Now()
+			limiter.Wait(10000) // 10s at the initial rate
+			done <- time.Since(start)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		limiter.SetRate(rate)
+		select {
+		case elapsed := <-done:
+			if elapsed > time.Second {
+				t.Errorf("Wait took %v after SetRate(%d)", elapsed, rate)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Wait still sleeps at the initial rate after SetRate(%d)", rate)
+		}
+	}
+}
@@ -3,13 +3,20 @@ package keynest
 import (
 	"bytes"
 	"encoding/binary"
-	"github.com/vmihailenco/msgpack/v5"
+	"fmt"
+	"math"
 )
 
 type Metadata struct {
 	TombStone bool
 	KeySize   uint16
 	ValSize   uint32
+	ValueType ValueType
+	// Chunks is the number of records following this one that hold the rest of its value. A chunk record has no key
+	// and only holds a part of the value.
+	Chunks uint32
+	// Separated is true when the value is in the value log, the record then holds a ValuePointer
+	Separated bool
 }
 
 type Record struct {
@@ -43,6 +50,18 @@ func (m *Metadata) Marshal(src *bytes.Buffer) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Write(src, binary.LittleEndian, &m.ValueType)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(src, binary.LittleEndian, &m.Chunks)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(src, binary.LittleEndian, &m.Separated)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -65,28 +84,86 @@ func (m *Metadata) UnMarshal(src []byte) error {
 	if err != nil {
 		return err
 	}
+	start, end = end, end+binary.Size(m.ValueType)
+	_, err = binary.Decode(src[start:end], binary.LittleEndian, &m.ValueType)
+	if err != nil {
+		return err
+	}
+	start, end = end, end+binary.Size(m.Chunks)
+	_, err = binary.Decode(src[start:end], binary.LittleEndian, &m.Chunks)
+	if err != nil {
+		return err
+	}
+	start, end = end, end+binary.Size(m.Separated)
+	_, err = binary.Decode(src[start:end], binary.LittleEndian, &m.Separated)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
-func (r *Record) Marshal(buf *bytes.Buffer) (Metadata, error) {
+// isChunk tells whether the metadata is the one of a chunk record.
+func (m *Metadata) isChunk() bool {
+	return !m.TombStone && m.KeySize == 0 && m.Chunks == 0 && !m.Separated
+}
+
+// Marshal writes the record to buf, the value is encoded with codec. A tombstone has no value, and the value of a
+// separated record is its ValuePointer. An encoded value
+// larger than chunkSize is split, the record holds the first chunk and is followed by a chunk record for every other
+// chunk. The returned metadata is the one of the record.
+func (r *Record) Marshal(buf *bytes.Buffer, codec ValueCodec, chunkSize int) (Metadata, error) {
+	if len(r.Key) > MaxKeySizeLimit {
+		return r.Metadata, &SizeLimitError{Err: ErrKeyTooLarge, Size: int64(len(r.Key)), Limit: MaxKeySizeLimit}
+	}
+	if r.ValueType == ValueTypeUnknown && !r.TombStone {
+		r.ValueType = ValueTypeOf(r.Val)
+	}
 	r.Metadata.KeySize = uint16(len(r.Key))
-	b, err := msgpack.Marshal(r.Val)
-	if err != nil {
-		return r.Metadata, err
+	var b []byte
+	if r.Separated {
+		ptr, ok := r.Val.(ValuePointer)
+		if !ok {
+			return r.Metadata, fmt.Errorf("separated value of %T instead of a ValuePointer", r.Val)
+		}
+		b = ptr.marshal()
+	} else if !r.TombStone {
+		var err error
+		if b, err = codec.Encode(r.Val); err != nil {
+			return r.Metadata, err
+		}
+	}
+	if chunkSize <= 0 || chunkSize > maxRecordValueSize {
+		chunkSize = maxRecordValueSize
 	}
-	r.Metadata.ValSize = uint32(len(b))
+	chunks := (len(b) + chunkSize - 1) / chunkSize
+	if chunks > math.MaxUint32 {
+		return r.Metadata, &SizeLimitError{Err: ErrValueTooLarge, Size: int64(len(b)), Limit: int64(chunkSize) * math.MaxUint32}
+	}
+	first := min(len(b), chunkSize)
+	r.Metadata.ValSize = uint32(first)
+	r.Metadata.Chunks = uint32(max(chunks-1, 0))
 	r.Metadata.Marshal(buf)
 
-	_, err = buf.WriteString(r.Key)
+	_, err := buf.WriteString(r.Key)
 	if err != nil {
 		return r.Metadata, err
 	}
 
-	_, err = buf.Write(b)
+	_, err = buf.Write(b[:first])
 	if err != nil {
 		return r.Metadata, err
 	}
 
+	for rest := b[first:]; len(rest) > 0; {
+		chunk := rest[:min(len(rest), chunkSize)]
+		rest = rest[len(chunk):]
+		chunkMetadata := Metadata{ValSize: uint32(len(chunk)), ValueType: r.ValueType}
+		chunkMetadata.Marshal(buf)
+		if _, err = buf.Write(chunk); err != nil {
+			return r.Metadata, err
+		}
+	}
+
 	return r.Metadata, nil
 }
 
@@ -94,6 +171,22 @@ func (r *Record) UnMarshalKey(src []byte) {
 	r.Key = string(src)
 }
 
-func (r *Record) UnMarshalVal(src []byte) error {
-	return msgpack.Unmarshal(src, &r.Val)
+// UnMarshalVal decodes the value with codec into the Go type of r.ValueType, the metadata must be decoded first. The
+// value of a separated record is decoded into its ValuePointer.
+func (r *Record) UnMarshalVal(src []byte, codec ValueCodec) error {
+	if r.TombStone {
+		r.Val = nil
+		return nil
+	}
+	if r.Separated {
+		ptr, err := unmarshalValuePointer(src)
+		r.Val = ptr
+		return err
+	}
+	val, err := codec.Decode(src, r.ValueType)
+	if err != nil {
+		return err
+	}
+	r.Val = val
+	return nil
 }
@@ -13,7 +13,7 @@ func TestName(t *testing.T) {
 		Val: "felicia",
 	}
 
-	m, _ := record.Marshal(buf)
+	m, _ := record.Marshal(buf, MsgpackCodec{}, 0)
 	fmt.Println(m)
 
 	record2 := &Record{}
@@ -0,0 +1,386 @@
+package keynest
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"keynest/bloom"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// RepairedTable describes a data file found by Repair.
+type RepairedTable struct {
+	FileName    string
+	Level       int
+	NRecords    int
+	SizeInBytes int64
+	// TruncatedBytes is the size of the corrupted tail cut off the file
+	TruncatedBytes int64
+	// Removed is true when not a single record could be salvaged from the file
+	Removed bool
+}
+
+// RepairedValueLogSegment describes a value log segment found by Repair.
+type RepairedValueLogSegment struct {
+	FileName    string
+	SizeInBytes int64
+	// TruncatedBytes is the size of the incomplete entry cut off the end of the file
+	TruncatedBytes int64
+}
+
+type RepairReport struct {
+	Tables           []RepairedTable
+	ValueLogSegments []RepairedValueLogSegment
+	// SkippedFiles are the files of the data directory that are not named like a data file
+	SkippedFiles []string
+	// MergedTables is the number of overlapping lvl 1 tables merged into MergeOutputs new tables
+	MergedTables int
+	MergeOutputs int
+	// IgnoredMemTables is the number of backed up memtables left out because it's unknown whether they were flushed
+	IgnoredMemTables int
+}
+
+// parseDataFileName returns the level and the timestamp of a data file named by nextDataFileName.
+func parseDataFileName(name string) (lvl int, ts int64, ok bool) {
+	if _, err := fmt.Sscanf(name, "%d-%d.kv", &lvl, &ts); err != nil {
+		return 0, 0, false
+	}
+	return lvl, ts, name == fmt.Sprintf("%d-%d.kv", lvl, ts)
+}
+
+// Repair rebuilds the metadata file of cfg.DataDir from the data files it holds, for when master-metadata is lost or
+// corrupted. Every data file is read again to recompute its key range, record count, sparse index and bloom filter,
+// and its level is taken from the previous metadata when it lists the file, from its name otherwise. A lvl 0 table
+// moved to lvl 1 keeps its name, rebuilding it in lvl 0 is still correct since no lvl 1 table overlaps it. A file
+// whose tail is corrupted is truncated after its last readable record.
+// Overlapping lvl 1 tables, left by an interrupted compaction, are merged, the newest file winning on duplicated keys.
+// The value log segments are listed again, cut after their last complete entry.
+//
+// The cluster must not be running, and cfg.Comparator must be the comparator recorded in the previous metadata file,
+// when it's readable. The previous metadata file, if any, is kept with a .bak suffix.
+func Repair(cfg *Config) (RepairReport, error) {
+	report := RepairReport{}
+	entries, err := os.ReadDir(cfg.DataDir)
+	if err != nil {
+		return report, fmt.Errorf("%w: read data directory: %w", ErrIO, err)
+	}
+
+	type dataFile struct {
+		name string
+		lvl  int
+		ts   int64
+	}
+	files := make([]dataFile, 0, len(entries))
+	segments := make([]string, 0)
+	for _, entry := range entries {
+		if _, ok := parseValueLogSegmentName(entry.Name()); ok && !entry.IsDir() {
+			segments = append(segments, entry.Name())
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), ".kv") {
+			continue
+		}
+		lvl, ts, ok := parseDataFileName(entry.Name())
+		if !ok || entry.IsDir() {
+			report.SkippedFiles = append(report.SkippedFiles, entry.Name())
+			continue
+		}
+		files = append(files, dataFile{name: entry.Name(), lvl: lvl, ts: ts})
+	}
+	// the lvl 0 tables are ordered from the oldest to the newest, like they are flushed
+	slices.SortFunc(files, func(a, b dataFile) int {
+		return cmp.Compare(a.ts, b.ts)
+	})
+
+	// the codec of a table is only known from the metadata, the files missing from it are assumed to use
+	// Config.ValueCodec
+	previous, previousErr := ReadTableClusterMetadata(cfg.DataDir)
+	if errors.Is(previousErr, ErrUnsupportedFormat) {
+		// the data files would be read with the wrong record layout
+		return report, previousErr
+	}
+	if previousErr == nil {
+		// the data files are read in the order of their comparator, the wrong one would take every key for disorder
+		if err = cfg.checkComparator(previous.Comparator); err != nil {
+			return report, err
+		}
+	}
+	codecs := make(map[string]string)
+	levels := make(map[string]int)
+	for i := range previous.FTableMetadata {
+		for _, metadata := range previous.FTableMetadata[i] {
+			codecs[metadata.FileName] = metadata.ValueCodec
+			levels[metadata.FileName] = i
+		}
+	}
+	for i := range files {
+		if lvl, ok := levels[files[i].name]; ok {
+			files[i].lvl = lvl
+		}
+	}
+
+	ftables := make([][]*FTable, 1)
+	timestamps := make(map[*FTable]int64)
+	closeAll := func() {
+		for i := range ftables {
+			for _, ftable := range ftables[i] {
+				ftable.Close()
+			}
+		}
+	}
+	for _, file := range files {
+		codec, ok := codecs[file.name]
+		if !ok {
+			codec = cfg.valueCodec().Name()
+		}
+		ftable, truncated, err := rebuildFTable(cfg, file.name, codec)
+		if err != nil {
+			closeAll()
+			return report, err
+		}
+		repaired := RepairedTable{
+			FileName:       file.name,
+			Level:          file.lvl,
+			TruncatedBytes: truncated,
+			Removed:        ftable == nil,
+		}
+		if ftable != nil {
+			repaired.NRecords, repaired.SizeInBytes = ftable.nRecords, ftable.sizeInBytes
+			for len(ftables) <= file.lvl {
+				ftables = append(ftables, []*FTable{})
+			}
+			ftables[file.lvl] = append(ftables[file.lvl], ftable)
+			timestamps[ftable] = file.ts
+		}
+		report.Tables = append(report.Tables, repaired)
+	}
+
+	for lvl := 1; lvl < len(ftables); lvl++ {
+		merged, outputs, err := resolveOverlaps(cfg, lvl, ftables[lvl], timestamps)
+		if err != nil {
+			closeAll()
+			return report, err
+		}
+		ftables[lvl] = outputs
+		report.MergedTables += merged
+		if merged > 0 {
+			report.MergeOutputs += len(outputs)
+		}
+	}
+	defer closeAll()
+
+	clusterMetadata := TableClusterMetadata{
+		FormatVersion:  formatVersion,
+		FTableMetadata: make([][]TableMetadata, len(ftables)),
+		Comparator:     cfg.comparator().Name(),
+	}
+	for i := range ftables {
+		clusterMetadata.FTableMetadata[i] = make([]TableMetadata, 0, len(ftables[i]))
+		for _, ftable := range ftables[i] {
+			clusterMetadata.FTableMetadata[i] = append(clusterMetadata.FTableMetadata[i], ftable.GetSnapshotTableMetadata())
+		}
+	}
+
+	// every segment is kept, the tables may point at any of them and the value log collection drops the dead ones
+	slices.Sort(segments)
+	for _, name := range segments {
+		size, truncated, err := repairValueLogSegment(filepath.Join(cfg.DataDir, name))
+		if err != nil {
+			return report, err
+		}
+		clusterMetadata.ValueLogSegments = append(clusterMetadata.ValueLogSegments, ValueLogSegmentMetadata{FileName: name, SizeInBytes: size})
+		report.ValueLogSegments = append(report.ValueLogSegments, RepairedValueLogSegment{FileName: name, SizeInBytes: size, TruncatedBytes: truncated})
+	}
+
+	// restoring a memtable that was already flushed could shadow newer records, only a readable previous metadata
+	// tells which ones are safe
+	clusterMetadata.FlushedMemTableID = previous.FlushedMemTableID
+	if previousErr != nil {
+		backup, err := readMemTableBackup(cfg.DataDir)
+		if err != nil {
+			log.Printf("[WARN] Memtable backup is unreadable, it will be ignored: %v\n", err)
+		}
+		for _, memtable := range backup.MemTables {
+			clusterMetadata.FlushedMemTableID = max(clusterMetadata.FlushedMemTableID, memtable.ID)
+			report.IgnoredMemTables++
+		}
+	}
+
+	metadataPath := filepath.Join(cfg.DataDir, MetadataFileName)
+	if _, err = os.Stat(metadataPath); err == nil {
+		if err = os.Rename(metadataPath, metadataPath+".bak"); err != nil {
+			return report, fmt.Errorf("%w: keep previous metadata file: %w", ErrIO, err)
+		}
+	}
+	if err = WriteTableClusterMetadata(cfg.DataDir, clusterMetadata); err != nil {
+		return report, err
+	}
+	log.Printf("[INFO] Metadata of %s rebuilt from %d data files\n", cfg.DataDir, len(files))
+	return report, nil
+}
+
+// rebuildFTable reads every record of a data file to recompute the metadata of its table. The file is truncated
+// after the last record that can be decoded and keeps the key order, and removed when there is no such record, in
+// which case a nil table is returned.
+func rebuildFTable(cfg *Config, fileName, codec string) (*FTable, int64, error) {
+	path := filepath.Join(cfg.DataDir, fileName)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: stat %s: %w", ErrIO, path, err)
+	}
+	ftable, err := OpenFTable(cfg.DataDir, TableMetadata{FileName: fileName, SizeInBytes: stat.Size(), ValueCodec: codec}, cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keys := make([]string, 0)
+	sparseIndex := make([]Index, 0)
+	validEnd := int64(0)
+	it := ftable.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if len(keys) > 0 && ftable.compare(it.Key(), keys[len(keys)-1]) <= 0 {
+			log.Printf("[WARN] %s: key %q at offset %d is out of order\n", path, it.Key(), it.Offset())
+			break
+		}
+		if (len(keys)+1)%cfg.IndexSkipNum == 0 {
+			sparseIndex = append(sparseIndex, Index{
+				Tombstone: it.Tombstone(),
+				Key:       it.Key(),
+				KeySize:   it.record.KeySize,
+				ValSize:   it.record.ValSize,
+				Offset:    it.Offset(),
+			})
+		}
+		keys = append(keys, it.Key())
+		validEnd = it.offset
+	}
+	ftable.Close()
+	if err = it.Err(); err != nil {
+		// only a corrupted tail is cut, a failing disk must not cost the rest of the file
+		if !errors.Is(err, ErrCorruption) {
+			return nil, 0, err
+		}
+		log.Printf("[WARN] %s: %v\n", path, err)
+	}
+
+	truncated := stat.Size() - validEnd
+	if len(keys) == 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, truncated, fmt.Errorf("%w: remove %s: %w", ErrIO, path, err)
+		}
+		log.Printf("[WARN] %s: no readable record, the file is removed\n", path)
+		return nil, truncated, nil
+	}
+	if truncated > 0 {
+		if err = os.Truncate(path, validEnd); err != nil {
+			return nil, truncated, fmt.Errorf("%w: truncate %s: %w", ErrIO, path, err)
+		}
+		log.Printf("[WARN] %s: %d corrupted bytes cut after offset %d\n", path, truncated, validEnd)
+	}
+
+	bloomFilter := bloom.NewBloomFilter(uint(len(keys)), cfg.FalsePositiveRate)
+	for _, key := range keys {
+		bloomFilter.Add(key)
+	}
+	ftable, err = OpenFTable(cfg.DataDir, TableMetadata{
+		FileName:    fileName,
+		NRecords:    len(keys),
+		SizeInBytes: validEnd,
+		MinKey:      keys[0],
+		MaxKey:      keys[len(keys)-1],
+		BloomFilter: *bloomFilter,
+		SparseIndex: sparseIndex,
+		ValueCodec:  codec,
+	}, cfg)
+	return ftable, truncated, err
+}
+
+// resolveOverlaps sorts the tables of a level by min key and merges every group of overlapping tables into new
+// tables of the level. It returns the number of merged tables along with the tables of the level once resolved.
+func resolveOverlaps(cfg *Config, lvl int, tables []*FTable, timestamps map[*FTable]int64) (int, []*FTable, error) {
+	cmp := cfg.comparator()
+	slices.SortFunc(tables, func(a, b *FTable) int {
+		return compareKeys(cmp, a.minKey, b.minKey)
+	})
+
+	resolved := make([]*FTable, 0, len(tables))
+	merged := 0
+	for start := 0; start < len(tables); {
+		end, maxKey := start+1, tables[start].maxKey
+		for end < len(tables) && compareKeys(cmp, tables[end].minKey, maxKey) <= 0 {
+			maxKey = maxKeyOf(cmp, maxKey, tables[end].maxKey)
+			end++
+		}
+		if end-start == 1 {
+			resolved = append(resolved, tables[start])
+			start = end
+			continue
+		}
+
+		group := slices.Clone(tables[start:end])
+		// the newest file comes first, so it wins when a key exists in several tables
+		sort.SliceStable(group, func(i, j int) bool {
+			return timestamps[group[i]] > timestamps[group[j]]
+		})
+		outputs, err := mergeTables(cfg, lvl, group)
+		if err != nil {
+			return 0, nil, err
+		}
+		log.Printf("[INFO] %d overlapping lvl %d tables merged into %d tables\n", len(group), lvl, len(outputs))
+		for _, table := range group {
+			if err = table.Destroy(); err != nil {
+				log.Printf("[ERROR] Destroy merged table %s: %v\n", table.dataFile.Name(), err)
+			}
+		}
+		resolved = append(resolved, outputs...)
+		merged += len(group)
+		start = end
+	}
+	return merged, resolved, nil
+}
+
+// mergeTables merges tables, given from the newest to the oldest, into new tables of lvl. Tombstones are kept.
+func mergeTables(cfg *Config, lvl int, tables []*FTable) ([]*FTable, error) {
+	recordCh := make(chan *Record)
+	var produceErr error
+	go func() {
+		defer close(recordCh)
+		sources := make([]*mergeSource, 0, len(tables))
+		for _, table := range tables {
+			sources = append(sources, &mergeSource{reader: newTableRangeReader([]*FTable{table}, "", "", nil)})
+		}
+		merger, err := newMergingIterator(sources, cfg.comparator())
+		if err != nil {
+			produceErr = err
+			return
+		}
+		for {
+			record, err := merger.next()
+			if err != nil {
+				produceErr = err
+				return
+			}
+			if record == nil {
+				return
+			}
+			recordCh <- record
+		}
+	}()
+
+	outputs, err := writeSortedTables(recordCh, lvl, cfg, nil)
+	if err == nil && produceErr != nil {
+		err = produceErr
+	}
+	if err != nil {
+		for _, table := range outputs {
+			table.Destroy()
+		}
+		return nil, err
+	}
+	return outputs, nil
+}
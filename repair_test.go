@@ -0,0 +1,139 @@
+package keynest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRepairRebuildsMetadata(t *testing.T) {
+	dir := t.TempDir()
+	tc := newTestTableCluster(t, dir)
+	want := map[string]string{}
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key-%03d", i*3+round%3)
+			val := fmt.Sprintf("val-%d-%d", round, i)
+			if err := tc.Put(key, val); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = val
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+		if round == 2 {
+			if err := tc.TriggerCompaction(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	clusterMetadata := tc.getTableClusterMetadata()
+	if err := tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(clusterMetadata.FTableMetadata) < 2 || len(clusterMetadata.FTableMetadata[1]) == 0 {
+		t.Fatalf("expected lvl 1 tables, got %+v", clusterMetadata.FTableMetadata)
+	}
+
+	// lose the metadata, corrupt the tail of a lvl 0 table and leave a stale copy of a lvl 1 table behind
+	if err := os.Remove(filepath.Join(dir, MetadataFileName)); err != nil {
+		t.Fatal(err)
+	}
+	lvl0File := filepath.Join(dir, clusterMetadata.FTableMetadata[0][0].FileName)
+	f, err := os.OpenFile(lvl0File, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 42, 0, 1, 2})
+	f.Close()
+	lvl1File := clusterMetadata.FTableMetadata[1][0].FileName
+	lvl, ts, _ := parseDataFileName(lvl1File)
+	stale := filepath.Join(dir, fmt.Sprintf("%d-%d.kv", lvl, ts-1))
+	if err = copyFile(filepath.Join(dir, lvl1File), stale); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair(&Config{DataDir: dir, IndexSkipNum: 4, FalsePositiveRate: 0.01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := int64(0)
+	for _, table := range report.Tables {
+		truncated += table.TruncatedBytes
+	}
+	if truncated != 5 || report.MergedTables != 2 {
+		t.Fatalf("report = %+v, want 5 truncated bytes and 2 merged tables", report)
+	}
+
+	repaired := newTestTableCluster(t, dir)
+	if err = repaired.LoadTableClusterMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range want {
+		got, ok, err := repaired.Get(key)
+		if err != nil || !ok || got != val {
+			t.Fatalf("Get(%s) = %v, %v, %v, want %s", key, got, ok, err, val)
+		}
+	}
+}
+
+func TestRepairKeepsTheLevelOfMovedTables(t *testing.T) {
+	dir := t.TempDir()
+	tc := newTestTableCluster(t, dir)
+	for _, prefix := range []string{"a", "b", "c"} {
+		putKeys(t, tc, prefix, 10)
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{DataDir: dir, IndexSkipNum: 4, FalsePositiveRate: 0.01}
+	// the moved tables are still named after lvl 0, only the previous metadata knows they are in lvl 1
+	for _, lost := range []bool{false, true} {
+		if lost {
+			if err := os.Remove(filepath.Join(dir, MetadataFileName)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := Repair(cfg); err != nil {
+			t.Fatal(err)
+		}
+		clusterMetadata, err := ReadTableClusterMetadata(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make([]int, levelNum)
+		for lvl, tables := range clusterMetadata.FTableMetadata {
+			counts[lvl] = len(tables)
+		}
+		want := []int{0, 3}
+		if lost {
+			want = []int{3, 0}
+		}
+		if !slices.Equal(counts, want) {
+			t.Fatalf("repaired levels have %v tables, want %v", counts, want)
+		}
+
+		repaired := newTestTableCluster(t, dir)
+		if err = repaired.LoadTableClusterMetadata(); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"a-00", "b-05", "c-09"} {
+			if val, ok, err := repaired.Get(key); err != nil || !ok || val != "v" {
+				t.Fatalf("Get(%s) = %v, %v, %v", key, val, ok, err)
+			}
+		}
+		if err = repaired.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package keynest
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The leader serves its replication log and its checkpoints over HTTP, under ReplicationHandlerPrefix.
+const (
+	ReplicationHandlerPrefix = "/replication/"
+	replicationLogPath       = ReplicationHandlerPrefix + "log"
+	replicationCheckpoint    = ReplicationHandlerPrefix + "checkpoint"
+	replicationLogIDHeader   = "Keynest-Log-Id"
+	replicationSeqHeader     = "Keynest-Log-Seq"
+	defaultReplicationBatch  = 1000
+	maxReplicationPollWait   = 30 * time.Second
+)
+
+// Mutation is a write shipped to another node, by the replication log or in a raft entry. Val holds the value encoded by MsgpackCodec, so it's decoded back
+// into the same Go type as a value read from a table.
+type Mutation struct {
+	// Seq numbers the mutations of the replication log, it's 0 in a raft entry
+	Seq       uint64
+	Key       string
+	Val       []byte
+	ValueType ValueType
+	TombStone bool
+	// UnixNano is the time the leader applied the mutation of the replication log
+	UnixNano int64
+}
+
+// applyMutation writes a mutation to the cluster, waiting for as long as the writes are stalled or until ctx is done.
+func (t *TableCluster) applyMutation(ctx context.Context, mutation Mutation) error {
+	for {
+		var err error
+		if mutation.TombStone {
+			err = t.Delete(mutation.Key)
+		} else {
+			var val any
+			if val, err = (MsgpackCodec{}).Decode(mutation.Val, mutation.ValueType); err != nil {
+				return fmt.Errorf("%w: decode value of mutation %d: %w", ErrCorruption, mutation.Seq, err)
+			}
+			err = t.PutTyped(mutation.Key, val, mutation.ValueType)
+		}
+		if !errors.Is(err, ErrWriteStall) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// replicationBatch is the body of a replication log response.
+type replicationBatch struct {
+	LogID string
+	// LastSeq is the sequence number of the newest mutation of the leader
+	LastSeq   uint64
+	Mutations []Mutation
+}
+
+// ReplicationLog keeps the newest mutations of a leader in the order they were applied, numbered from 1. Every log
+// gets a random id when the cluster is created, a follower of a previous run of the leader must bootstrap again.
+//
+// The records of AddRecords and of the imports are logged when their table is installed. On the leader, a write of
+// the same key still in the memtable shadows them, so such concurrent writes may resolve differently on a follower.
+type ReplicationLog struct {
+	id       string
+	capacity int
+	lock     sync.Mutex
+	// mutations holds at least the capacity newest mutations, the oldest ones are trimmed in bulk
+	mutations []Mutation
+	lastSeq   uint64
+	// appended is closed and replaced whenever mutations are appended
+	appended chan struct{}
+}
+
+func newReplicationLog(capacity int) *ReplicationLog {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &ReplicationLog{
+		id:        hex.EncodeToString(id),
+		capacity:  capacity,
+		mutations: make([]Mutation, 0),
+		appended:  make(chan struct{}),
+	}
+}
+
+// prepare encodes the records as mutations, outside of the locks of the cluster. A nil log returns no mutation, so
+// the write paths don't need to know whether replication is enabled.
+func (l *ReplicationLog) prepare(records ...*Record) ([]Mutation, error) {
+	if l == nil {
+		return nil, nil
+	}
+	return encodeMutations(records...)
+}
+
+func encodeMutations(records ...*Record) ([]Mutation, error) {
+	mutations := make([]Mutation, len(records))
+	for i, record := range records {
+		mutations[i] = Mutation{Key: record.Key, ValueType: record.ValueType, TombStone: record.TombStone}
+		if record.TombStone {
+			continue
+		}
+		val, err := MsgpackCodec{}.Encode(record.Val)
+		if err != nil {
+			return nil, fmt.Errorf("encode value of %q as a mutation: %w", record.Key, err)
+		}
+		mutations[i].Val = val
+	}
+	return mutations, nil
+}
+
+// append numbers the mutations and adds them to the log, it must be called while the memtable is locked so the log
+// follows the order of the writes.
+func (l *ReplicationLog) append(mutations []Mutation) {
+	if l == nil || len(mutations) == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now().UnixNano()
+	for i := range mutations {
+		l.lastSeq++
+		mutations[i].Seq = l.lastSeq
+		mutations[i].UnixNano = now
+	}
+	l.mutations = append(l.mutations, mutations...)
+	if len(l.mutations) >= 2*l.capacity {
+		l.mutations = append(make([]Mutation, 0, 2*l.capacity), l.mutations[len(l.mutations)-l.capacity:]...)
+	}
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// position returns the id of the log and the sequence number of its newest mutation.
+func (l *ReplicationLog) position() (string, uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.id, l.lastSeq
+}
+
+// read returns at most max mutations from the sequence number from, waiting up to wait for a first one when the
+// follower is caught up. It returns ErrReplicationLogTruncated when the log doesn't hold from anymore.
+func (l *ReplicationLog) read(ctx context.Context, id string, from uint64, max int, wait time.Duration) (replicationBatch, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		l.lock.Lock()
+		batch := replicationBatch{LogID: l.id, LastSeq: l.lastSeq}
+		firstSeq := l.lastSeq + 1
+		if len(l.mutations) > 0 {
+			firstSeq = l.mutations[0].Seq
+		}
+		if id != l.id || from < firstSeq || from > l.lastSeq+1 {
+			l.lock.Unlock()
+			return batch, fmt.Errorf("%w: mutation %d of log %q asked, log %q holds %d to %d", ErrReplicationLogTruncated, from, id, l.id, firstSeq, l.lastSeq)
+		}
+		if from <= l.lastSeq {
+			start := int(from - firstSeq)
+			end := min(len(l.mutations), start+max)
+			batch.Mutations = append(make([]Mutation, 0, end-start), l.mutations[start:end]...)
+			l.lock.Unlock()
+			return batch, nil
+		}
+		appended := l.appended
+		l.lock.Unlock()
+
+		select {
+		case <-appended:
+		case <-timer.C:
+			return batch, nil
+		case <-ctx.Done():
+			return batch, ctx.Err()
+		}
+	}
+}
+
+// ReplicationHandler serves the replication log and the checkpoints to the followers, it must be mounted on
+// ReplicationHandlerPrefix. The cluster must be created with Config.ReplicationLogSize set.
+func (t *TableCluster) ReplicationHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(replicationLogPath, t.serveReplicationLog)
+	mux.HandleFunc(replicationCheckpoint, t.serveReplicationCheckpoint)
+	return mux
+}
+
+// serveReplicationLog answers GET /replication/log?log_id=&from=&max=&wait= with a msgpack replicationBatch, and
+// with 410 Gone when the follower must bootstrap from a checkpoint.
+func (t *TableCluster) serveReplicationLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if t.replicationLog == nil {
+		http.Error(w, "replication log disabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	from, err := strconv.ParseUint(query.Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "from must be a sequence number", http.StatusBadRequest)
+		return
+	}
+	max, err := strconv.Atoi(query.Get("max"))
+	if err != nil || max <= 0 {
+		max = defaultReplicationBatch
+	}
+	wait, err := time.ParseDuration(query.Get("wait"))
+	if err != nil || wait < 0 {
+		wait = 0
+	}
+	wait = min(wait, maxReplicationPollWait)
+	// the server write timeout is meant for the client requests, not for a long poll
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+
+	batch, err := t.replicationLog.read(r.Context(), query.Get("log_id"), from, max, wait)
+	if errors.Is(err, ErrReplicationLogTruncated) {
+		w.Header().Set(replicationLogIDHeader, batch.LogID)
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		return
+	}
+	body, err := msgpack.Marshal(batch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/msgpack")
+	w.Write(body)
+}
+
+// serveReplicationCheckpoint answers GET /replication/checkpoint with a tar archive of a fresh checkpoint. The
+// headers hold the id of the replication log and the sequence number the follower resumes after. The checkpoint may
+// already hold a few later mutations, replaying them again leaves the same values.
+func (t *TableCluster) serveReplicationCheckpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if t.replicationLog == nil {
+		http.Error(w, "replication log disabled", http.StatusNotFound)
+		return
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// the checkpoint is in the data directory, so its files are hard links
+	dir, err := os.MkdirTemp(t.cfg.DataDir, "replication-checkpoint-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	id, seq := t.replicationLog.position()
+	if err = t.Checkpoint(dir); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set(replicationLogIDHeader, id)
+	w.Header().Set(replicationSeqHeader, strconv.FormatUint(seq, 10))
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		if err = writeTarFile(tw, filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("[ERROR] Sending the replication checkpoint failed: %v\n", err)
+			return
+		}
+	}
+	if err = tw.Close(); err != nil {
+		log.Printf("[ERROR] Sending the replication checkpoint failed: %v\n", err)
+		return
+	}
+	log.Printf("[INFO] Replication checkpoint at mutation %d sent to %s\n", seq, r.RemoteAddr)
+}
+
+func writeTarFile(tw *tar.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(&tar.Header{Name: stat.Name(), Mode: 0644, Size: stat.Size(), ModTime: stat.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
@@ -0,0 +1,272 @@
+package keynest
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplicationPollWait = time.Second
+	replicationRetryDelay      = time.Second
+)
+
+// ReplicationStatus tells how far a follower is behind its leader.
+type ReplicationStatus struct {
+	Leader string `json:"leader"`
+	LogID  string `json:"log_id"`
+	// AppliedSeq is the sequence number of the newest mutation applied, LeaderSeq the one of the newest mutation of
+	// the leader the follower knows of
+	AppliedSeq uint64 `json:"applied_seq"`
+	LeaderSeq  uint64 `json:"leader_seq"`
+	// LagSeconds is how long ago the follower last held every mutation of its leader, 0 while it's caught up. It
+	// counts from the start of the follower until the first bootstrap.
+	LagSeconds  float64   `json:"lag_seconds"`
+	LastContact time.Time `json:"last_contact"`
+	Bootstraps  int       `json:"bootstraps"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Follower keeps a TableCluster in sync with the replication log of a leader, see StartFollower.
+type Follower struct {
+	cluster  *TableCluster
+	leader   string
+	client   *http.Client
+	pollWait time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopped  chan struct{}
+
+	lock       sync.Mutex
+	status     ReplicationStatus
+	caughtUpAt time.Time
+}
+
+// StartFollower makes cluster a read replica of the leader whose ReplicationHandler is served at leaderURL. The
+// follower first bootstraps from a checkpoint of the leader, which replaces the content of the cluster, and then
+// applies the mutations of the replication log as they come. It bootstraps again whenever it falls behind the
+// mutations the leader keeps. Its position is only kept in memory, so a restarted follower always bootstraps. The
+// cluster must not be written to by anything else.
+func StartFollower(cluster *TableCluster, leaderURL string) *Follower {
+	f := newFollower(cluster, leaderURL)
+	go f.run()
+	return f
+}
+
+func newFollower(cluster *TableCluster, leaderURL string) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	pollWait := cluster.cfg.ReplicationPollWait
+	if pollWait <= 0 {
+		pollWait = defaultReplicationPollWait
+	}
+	return &Follower{
+		cluster:    cluster,
+		leader:     strings.TrimSuffix(leaderURL, "/"),
+		client:     &http.Client{},
+		pollWait:   pollWait,
+		ctx:        ctx,
+		cancel:     cancel,
+		stopped:    make(chan struct{}),
+		status:     ReplicationStatus{Leader: leaderURL},
+		caughtUpAt: time.Now(),
+	}
+}
+
+// Close stops the replication, the cluster stays open.
+func (f *Follower) Close() {
+	f.cancel()
+	<-f.stopped
+}
+
+// Status returns the position of the follower in the replication log and its lag.
+func (f *Follower) Status() ReplicationStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status := f.status
+	// an idle leader answers every poll after pollWait, a longer silence may hide new mutations
+	caughtUp := status.LogID != "" && status.AppliedSeq >= status.LeaderSeq
+	if !caughtUp || time.Since(status.LastContact) > 2*f.pollWait {
+		status.LagSeconds = time.Since(f.caughtUpAt).Seconds()
+	}
+	return status
+}
+
+func (f *Follower) run() {
+	defer close(f.stopped)
+	for f.ctx.Err() == nil {
+		err := f.step()
+		if err == nil || f.ctx.Err() != nil {
+			continue
+		}
+		log.Printf("[ERROR] Replication from %s failed: %v\n", f.leader, err)
+		f.lock.Lock()
+		f.status.LastError = err.Error()
+		f.lock.Unlock()
+		select {
+		case <-f.ctx.Done():
+		case <-time.After(replicationRetryDelay):
+		}
+	}
+}
+
+// step bootstraps the follower when it has no position in the replication log, and pulls and applies the next
+// mutations otherwise.
+func (f *Follower) step() error {
+	f.lock.Lock()
+	logID, applied := f.status.LogID, f.status.AppliedSeq
+	f.lock.Unlock()
+	if logID == "" {
+		return f.bootstrap()
+	}
+
+	batch, err := f.pull(logID, applied+1)
+	if errors.Is(err, ErrReplicationLogTruncated) {
+		log.Printf("[WARN] Follower fell behind the replication log of %s, bootstrapping again: %v\n", f.leader, err)
+		f.lock.Lock()
+		f.status.LogID = ""
+		f.lock.Unlock()
+		return f.bootstrap()
+	}
+	if err != nil {
+		return err
+	}
+	for _, mutation := range batch.Mutations {
+		if err = f.cluster.applyMutation(f.ctx, mutation); err != nil {
+			return err
+		}
+		f.lock.Lock()
+		f.status.AppliedSeq = mutation.Seq
+		f.lock.Unlock()
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.status.LeaderSeq = batch.LastSeq
+	f.status.LastContact = time.Now()
+	f.status.LastError = ""
+	if f.status.AppliedSeq >= f.status.LeaderSeq {
+		f.caughtUpAt = f.status.LastContact
+	}
+	return nil
+}
+
+// pull asks the leader for the mutations from the sequence number from, waiting up to pollWait for new ones.
+func (f *Follower) pull(logID string, from uint64) (replicationBatch, error) {
+	query := url.Values{}
+	query.Set("log_id", logID)
+	query.Set("from", strconv.FormatUint(from, 10))
+	query.Set("max", strconv.Itoa(defaultReplicationBatch))
+	query.Set("wait", f.pollWait.String())
+	resp, err := f.get(replicationLogPath + "?" + query.Encode())
+	if err != nil {
+		return replicationBatch{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return replicationBatch{}, fmt.Errorf("read replication log: %w", err)
+	}
+	if resp.StatusCode == http.StatusGone {
+		return replicationBatch{}, fmt.Errorf("%w: %s", ErrReplicationLogTruncated, strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return replicationBatch{}, fmt.Errorf("replication log answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	batch := replicationBatch{}
+	if err = msgpack.Unmarshal(body, &batch); err != nil {
+		return batch, fmt.Errorf("decode replication log: %w", err)
+	}
+	return batch, nil
+}
+
+// bootstrap downloads a checkpoint of the leader and replaces the content of the cluster with it.
+func (f *Follower) bootstrap() error {
+	resp, err := f.get(replicationCheckpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("replication checkpoint answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	logID := resp.Header.Get(replicationLogIDHeader)
+	seq, err := strconv.ParseUint(resp.Header.Get(replicationSeqHeader), 10, 64)
+	if logID == "" || err != nil {
+		return fmt.Errorf("replication checkpoint without a log position")
+	}
+
+	// the files are moved into the data directory, so they are downloaded next to it
+	dir, err := os.MkdirTemp(f.cluster.cfg.DataDir, "replication-bootstrap-")
+	if err != nil {
+		return fmt.Errorf("%w: create bootstrap directory: %w", ErrIO, err)
+	}
+	defer os.RemoveAll(dir)
+	if err = extractTar(resp.Body, dir); err != nil {
+		return err
+	}
+	if err = f.cluster.replaceWithCheckpoint(dir); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.status.LogID = logID
+	f.status.AppliedSeq = seq
+	f.status.LeaderSeq = max(f.status.LeaderSeq, seq)
+	f.status.Bootstraps++
+	f.status.LastContact = time.Now()
+	f.status.LastError = ""
+	log.Printf("[INFO] Follower bootstrapped from %s at mutation %d of log %s\n", f.leader, seq, logID)
+	return nil
+}
+
+func (f *Follower) get(path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return f.client.Do(req)
+}
+
+// extractTar writes the regular files of a checkpoint archive into dir, refusing any name that isn't a plain file
+// name.
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read replication checkpoint: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg || header.Name != filepath.Base(header.Name) || header.Name == ".." {
+			return fmt.Errorf("%w: unexpected entry %q in the replication checkpoint", ErrCorruption, header.Name)
+		}
+		file, err := os.OpenFile(filepath.Join(dir, header.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return fmt.Errorf("%w: create %s: %w", ErrIO, header.Name, err)
+		}
+		_, err = io.Copy(file, tr)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%w: write %s: %w", ErrIO, header.Name, err)
+		}
+	}
+}
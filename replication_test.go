@@ -0,0 +1,114 @@
+package keynest
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLeader(t *testing.T, logSize int) (*TableCluster, *httptest.Server) {
+	t.Helper()
+	leader := newTestTableCluster(t, t.TempDir())
+	leader.cfg.ReplicationLogSize = logSize
+	leader.replicationLog = newReplicationLog(logSize)
+	server := httptest.NewServer(leader.ReplicationHandler())
+	t.Cleanup(server.Close)
+	return leader, server
+}
+
+// checkReplica compares the keys of the leader with the ones of the replica.
+func checkReplica(t *testing.T, leader, replica *TableCluster, keys []string) {
+	t.Helper()
+	for _, key := range keys {
+		want, wantOK, _ := leader.Get(key)
+		val, ok, err := replica.Get(key)
+		if err != nil || ok != wantOK || fmt.Sprint(val) != fmt.Sprint(want) {
+			t.Fatalf("replica Get(%s) = %v, %v, %v, the leader has %v, %v", key, val, ok, err, want, wantOK)
+		}
+	}
+}
+
+func TestFollowerReplicatesLeader(t *testing.T) {
+	leader, server := newTestLeader(t, 100)
+	keys := make([]string, 30)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%02d", i)
+		if err := leader.Put(keys[i], int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Put("key-00", "in the memtable"); err != nil {
+		t.Fatal(err)
+	}
+
+	replica := newTestTableCluster(t, t.TempDir())
+	replica.cfg.ReplicationPollWait = 50 * time.Millisecond
+	if err := replica.Put("stale", "dropped by the bootstrap"); err != nil {
+		t.Fatal(err)
+	}
+	follower := StartFollower(replica, server.URL)
+	defer follower.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := leader.Put(keys[i], []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.Delete(keys[29]); err != nil {
+		t.Fatal(err)
+	}
+	_, seq := leader.replicationLog.position()
+	deadline := time.Now().Add(5 * time.Second)
+	status := follower.Status()
+	for status.AppliedSeq < seq && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		status = follower.Status()
+	}
+	if status.AppliedSeq != seq || status.Bootstraps != 1 || status.LagSeconds != 0 {
+		t.Fatalf("status = %+v, want mutation %d applied after a single bootstrap", status, seq)
+	}
+	checkReplica(t, leader, replica, append(keys, "stale"))
+}
+
+func TestFollowerBootstrapsAgainWhenBehind(t *testing.T) {
+	leader, server := newTestLeader(t, 10)
+	replica := newTestTableCluster(t, t.TempDir())
+	follower := newFollower(replica, server.URL)
+	keys := make([]string, 30)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%02d", i)
+	}
+
+	step := func() {
+		t.Helper()
+		if err := follower.step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	step()
+	for i := 0; i < 5; i++ {
+		if err := leader.Put(keys[i], int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	step()
+	if status := follower.Status(); status.AppliedSeq != 5 || status.Bootstraps != 1 {
+		t.Fatalf("status = %+v, want the 5 mutations applied", status)
+	}
+
+	// the leader only keeps between 10 and 20 mutations
+	for i := 5; i < 30; i++ {
+		if err := leader.Put(keys[i], int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	step()
+	if status := follower.Status(); status.AppliedSeq != 30 || status.Bootstraps != 2 {
+		t.Fatalf("status = %+v, want a second bootstrap", status)
+	}
+	checkReplica(t, leader, replica, keys)
+}
@@ -0,0 +1,108 @@
+package keynest
+
+import (
+	"slices"
+)
+
+// Scan calls fn with every live key within [lower, upper), in the order of Config.Comparator, along with its newest
+// value and its value type. An empty bound is unbounded. The scan stops early when fn returns false.
+//
+// Compactions and value log collections carry on, the files they replace are only destroyed once the scan is over.
+// Flushes and writes carry on too, the writes issued after the scan started may or may not be seen.
+func (t *TableCluster) Scan(lower, upper string, fn func(key string, val any, valueType ValueType) bool) error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	sources := make([]*mergeSource, 0)
+	var segments map[int64]*valueLogSegment
+	release := t.pinFiles(func() {
+		// the records go from the memtables to lvl 0 and then to lvl 1, reading them in that order misses none
+		t.memTableLock.RLock()
+		// the active memtable keeps changing, only a copy of its records can be read without the lock
+		sources = append(sources, &mergeSource{reader: newMemTableReader(t.memtable, t.cfg.comparator(), lower, upper)})
+		for i := len(t.immutables) - 1; i >= 0; i-- {
+			sources = append(sources, &mergeSource{reader: newMemTableReader(t.immutables[i], t.cfg.comparator(), lower, upper)})
+		}
+		t.memTableLock.RUnlock()
+
+		for i := range t.ftablesLock {
+			t.ftablesLock[i].RLock()
+		}
+		for i := len(t.ftables[0]) - 1; i >= 0; i-- {
+			sources = append(sources, &mergeSource{
+				reader: newTableRangeReader([]*FTable{t.ftables[0][i]}, lower, upper, nil),
+			})
+		}
+		for lvl := 1; lvl < len(t.ftables); lvl++ {
+			sources = append(sources, &mergeSource{reader: newTableRangeReader(slices.Clone(t.ftables[lvl]), lower, upper, nil)})
+		}
+		for i := range t.ftablesLock {
+			t.ftablesLock[i].RUnlock()
+		}
+		// a segment is added before the table pointing at it, the segments are listed last
+		segments = t.valueLog.snapshot()
+	})
+	defer release()
+
+	it, err := newMergingIterator(sources, t.cfg.comparator())
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := it.next()
+		if err != nil || record == nil {
+			return err
+		}
+		if record.TombStone {
+			continue
+		}
+		val, valueType := record.Val, record.ValueType
+		if record.Separated {
+			if val, valueType, err = readValue(segments, record.Val.(ValuePointer)); err != nil {
+				return err
+			}
+		}
+		if !fn(record.Key, val, valueType) {
+			return nil
+		}
+	}
+}
+
+// memTableReader reads a copy of the records of a memtable within [lower, upper).
+type memTableReader struct {
+	records []*Record
+}
+
+func newMemTableReader(memtable *MemTable, cmp Comparator, lower, upper string) *memTableReader {
+	r := &memTableReader{}
+	it := memtable.tree.Iterator()
+	for it.Next() {
+		key := it.Key().(string)
+		if lower != "" && compareKeys(cmp, key, lower) < 0 {
+			continue
+		}
+		if upper != "" && compareKeys(cmp, key, upper) >= 0 {
+			break
+		}
+		memRecord := it.Value().(*MemRecord)
+		r.records = append(r.records, &Record{
+			Key: key,
+			Val: memRecord.val,
+			Metadata: Metadata{
+				TombStone: memRecord.tombstone,
+				ValueType: memRecord.valueType,
+			},
+		})
+	}
+	return r
+}
+
+func (r *memTableReader) next() (*Record, error) {
+	if len(r.records) == 0 {
+		return nil, nil
+	}
+	record := r.records[0]
+	r.records = r.records[1:]
+	return record, nil
+}
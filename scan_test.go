@@ -0,0 +1,78 @@
+package keynest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScanDoesNotBlockCompactionsNorCollections(t *testing.T) {
+	tc := newTestTableCluster(t, t.TempDir())
+	tc.cfg.ValueLogThreshold = 64
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20; i++ {
+			if err := tc.Put(fmt.Sprintf("key-%02d", i), bytes.Repeat([]byte{byte(round)}, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lvl0 := tc.ftables[0]
+	segments := tc.valueLog.metadata()
+
+	n := 0
+	err := tc.Scan("", "", func(key string, val any, _ ValueType) bool {
+		if n == 0 {
+			done := make(chan error, 1)
+			go func() {
+				err := tc.TriggerCompaction()
+				if err == nil {
+					_, err = tc.CollectValueLog(0.1)
+				}
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the compaction and the value log collection wait for the scan")
+			}
+			if len(tc.ftables[0]) != 0 || len(tc.valueLog.metadata()) != 1 {
+				t.Fatalf("%d lvl 0 tables and %d value log segments left, want 0 and 1", len(tc.ftables[0]), len(tc.valueLog.metadata()))
+			}
+			// the scan still reads them
+			for _, table := range lvl0 {
+				if _, err := os.Stat(table.dataFile.Name()); err != nil {
+					t.Fatalf("compacted table removed during the scan: %v", err)
+				}
+			}
+		}
+		if key != fmt.Sprintf("key-%02d", n) || !bytes.Equal(val.([]byte), bytes.Repeat([]byte{2}, 100)) {
+			t.Fatalf("Scan gave %s = %v, want key-%02d", key, val, n)
+		}
+		n++
+		return true
+	})
+	if err != nil || n != 20 {
+		t.Fatalf("Scan gave %d keys: %v", n, err)
+	}
+
+	// the last release destroys them
+	for _, table := range lvl0 {
+		if _, err = os.Stat(table.dataFile.Name()); !os.IsNotExist(err) {
+			t.Fatalf("Stat(%s) after the scan = %v, want the compacted table removed", table.fileName(), err)
+		}
+	}
+	for _, segment := range segments[:2] {
+		if _, err = os.Stat(filepath.Join(tc.cfg.DataDir, segment.FileName)); !os.IsNotExist(err) {
+			t.Fatalf("Stat(%s) after the scan = %v, want the collected segment removed", segment.FileName, err)
+		}
+	}
+}
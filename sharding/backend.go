@@ -0,0 +1,136 @@
+package sharding
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"keynest"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// value is a value as the /record API carries it: the body and its content type.
+type value struct {
+	contentType string
+	body        []byte
+}
+
+// backendError is an answer of a backend the router can't act upon, it's passed on to the client.
+type backendError struct {
+	node       string
+	statusCode int
+	reason     string
+}
+
+func (e *backendError) Error() string {
+	return fmt.Sprintf("%s answered %d: %s", e.node, e.statusCode, e.reason)
+}
+
+func (r *Router) newRequest(ctx context.Context, method, node, path string, query url.Values, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	return http.NewRequestWithContext(ctx, method, node+path+"?"+query.Encode(), reader)
+}
+
+// do sends req and returns the answer when its status code is one of ok.
+func (r *Router) do(node string, req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	reason := resp.Header.Get("reason")
+	if reason == "" {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		reason = strings.TrimSpace(string(b))
+	}
+	return nil, &backendError{node: node, statusCode: resp.StatusCode, reason: reason}
+}
+
+// get reads key from node, ok is false when the node doesn't hold it.
+func (r *Router) get(ctx context.Context, node, key string) (val value, ok bool, err error) {
+	req, err := r.newRequest(ctx, http.MethodGet, node, "/record", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return val, false, err
+	}
+	resp, err := r.do(node, req, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return val, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return val, false, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return val, false, fmt.Errorf("read %s from %s: %w", key, node, err)
+	}
+	return value{contentType: resp.Header.Get("Content-Type"), body: body}, true, nil
+}
+
+func (r *Router) put(ctx context.Context, node, key string, val value) error {
+	req, err := r.newRequest(ctx, http.MethodPut, node, "/record", url.Values{"key": {key}}, val.body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", val.contentType)
+	resp, err := r.do(node, req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (r *Router) delete(ctx context.Context, node, key string) error {
+	req, err := r.newRequest(ctx, http.MethodDelete, node, "/record", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(node, req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// scan returns at most limit keys of node after the key after, in the key order of the node.
+func (r *Router) scan(ctx context.Context, node, after string, limit int) ([]keynest.ExportedRecord, error) {
+	query := url.Values{"after": {after}, "limit": {strconv.Itoa(limit)}}
+	req, err := r.newRequest(ctx, http.MethodGet, node, "/scan", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.do(node, req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	records := make([]keynest.ExportedRecord, 0, limit)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, maxScanLine)
+	for scanner.Scan() {
+		record := keynest.ExportedRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("decode scan of %s: %w", node, err)
+		}
+		records = append(records, record)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read scan of %s: %w", node, err)
+	}
+	return records, nil
+}
@@ -0,0 +1,253 @@
+package sharding
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MigrationStatus tells how far the last node change went.
+type MigrationStatus struct {
+	// Change is "add" or "remove"
+	Change     string    `json:"change,omitempty"`
+	Node       string    `json:"node,omitempty"`
+	Scanned    int       `json:"scanned"`
+	Moved      int       `json:"moved"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// NodesStatus is the answer of GET /admin/nodes.
+type NodesStatus struct {
+	Nodes []string `json:"nodes"`
+	// NextNodes are the nodes once the node change in progress is over
+	NextNodes []string        `json:"next_nodes,omitempty"`
+	Migration MigrationStatus `json:"migration"`
+}
+
+// routerState is the content of Config.StateFile.
+type routerState struct {
+	Nodes     []string `json:"nodes"`
+	NextNodes []string `json:"next_nodes,omitempty"`
+}
+
+// errChangeInProgress is returned when a node change is asked while another one isn't over.
+var errChangeInProgress = errors.New("another node change is in progress")
+
+func readRouterState(path string) (routerState, bool, error) {
+	state := routerState{}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, fmt.Errorf("read router state: %w", err)
+	}
+	if err = json.Unmarshal(b, &state); err != nil {
+		return state, false, fmt.Errorf("decode router state %s: %w", path, err)
+	}
+	return state, true, nil
+}
+
+// saveState writes the nodes to the state file, r.lock must be held.
+func (r *Router) saveState() error {
+	if r.cfg.StateFile == "" {
+		return nil
+	}
+	state := routerState{Nodes: r.ring.Nodes()}
+	if r.next != nil {
+		state.NextNodes = r.next.Nodes()
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(r.cfg.StateFile+".tmp", b, 0644); err == nil {
+		err = os.Rename(r.cfg.StateFile+".tmp", r.cfg.StateFile)
+	}
+	if err != nil {
+		return fmt.Errorf("write router state: %w", err)
+	}
+	return nil
+}
+
+func (r *Router) Status() NodesStatus {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	status := NodesStatus{Nodes: r.ring.Nodes(), Migration: r.migration}
+	if r.next != nil {
+		status.NextNodes = r.next.Nodes()
+	}
+	return status
+}
+
+// AddNode adds a node to the ring and moves to it the keys it now owns, from every other node. The node serves
+// its keys as soon as the change starts, the keys not moved yet are read from their previous node.
+func (r *Router) AddNode(ctx context.Context, node string) error {
+	return r.changeNodes(ctx, "add", strings.TrimSuffix(node, "/"))
+}
+
+// RemoveNode moves the keys of a node to the remaining nodes, and removes it from the ring.
+func (r *Router) RemoveNode(ctx context.Context, node string) error {
+	return r.changeNodes(ctx, "remove", strings.TrimSuffix(node, "/"))
+}
+
+// changeNodes starts a node change, or resumes the same change left unfinished, and migrates the keys.
+func (r *Router) changeNodes(ctx context.Context, change, node string) error {
+	next, sources, err := r.startChange(change, node)
+	if err != nil {
+		return err
+	}
+	return r.finishChange(ctx, next, sources)
+}
+
+// finishChange migrates the keys of sources, and replaces the ring with next once they are all moved.
+func (r *Router) finishChange(ctx context.Context, next *Ring, sources []string) error {
+	var err error
+	for _, source := range sources {
+		if err = r.migrate(ctx, source, next); err != nil {
+			break
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.migration.FinishedAt = time.Now()
+	if err != nil {
+		r.migration.Error = err.Error()
+		log.Printf("[ERROR] Migration to %v failed, %d of %d scanned keys moved: %v\n", next.Nodes(), r.migration.Moved, r.migration.Scanned, err)
+		return err
+	}
+	r.ring, r.next = next, nil
+	if err = r.saveState(); err != nil {
+		r.migration.Error = err.Error()
+		return err
+	}
+	log.Printf("[INFO] Nodes are now %v, %d of %d scanned keys moved\n", next.Nodes(), r.migration.Moved, r.migration.Scanned)
+	return nil
+}
+
+// startChange installs the next ring, and returns it along with the nodes whose keys may move.
+func (r *Router) startChange(change, node string) (*Ring, []string, error) {
+	// a write routed by the current ring alone could land behind the scan of its node
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var next *Ring
+	var err error
+	sources := []string{node}
+	if change == "add" {
+		next, err = r.ring.With(node)
+		sources = r.ring.Nodes()
+	} else if next, err = r.ring.Without(node); err == nil && len(next.Nodes()) == 0 {
+		err = fmt.Errorf("node %s is the last one", node)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.next != nil {
+		if !slices.Equal(r.next.Nodes(), next.Nodes()) || r.migration.FinishedAt.IsZero() && r.migration.Change != "" {
+			return nil, nil, errChangeInProgress
+		}
+		next = r.next
+	}
+	r.next = next
+	r.migration = MigrationStatus{Change: change, Node: node, StartedAt: time.Now()}
+	if err = r.saveState(); err != nil {
+		r.next = nil
+		return nil, nil, err
+	}
+	log.Printf("[INFO] Migrating keys from %v to %v\n", r.ring.Nodes(), next.Nodes())
+	return next, sources, nil
+}
+
+// migrate pages through the keys of source and moves the ones next assigns to another node.
+func (r *Router) migrate(ctx context.Context, source string, next *Ring) error {
+	after := ""
+	for {
+		records, err := r.scan(ctx, source, after, r.cfg.MigrationBatch)
+		if err != nil {
+			return err
+		}
+		moved := 0
+		for _, record := range records {
+			if owner := next.Owner(record.Key); owner != source {
+				if err = r.move(ctx, record.Key, source, owner); err != nil {
+					return err
+				}
+				moved++
+			}
+		}
+		r.lock.Lock()
+		r.migration.Scanned += len(records)
+		r.migration.Moved += moved
+		r.lock.Unlock()
+		if len(records) < r.cfg.MigrationBatch {
+			return nil
+		}
+		after = records[len(records)-1].Key
+	}
+}
+
+// move copies the newest value of key from one node to the other and deletes it from the first one. The key is
+// locked, so a write can't be overwritten by the value it replaced.
+func (r *Router) move(ctx context.Context, key, from, to string) error {
+	lock := r.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	val, ok, err := r.get(ctx, from, key)
+	if err != nil || !ok {
+		return err
+	}
+	if err = r.put(ctx, to, key, val); err != nil {
+		return err
+	}
+	return r.delete(ctx, from, key)
+}
+
+// serveNodes answers GET /admin/nodes with the NodesStatus, and starts adding or removing a node on POST and
+// DELETE /admin/nodes?node=URL. The migration runs in the background, its progress is in the status.
+func (r *Router) serveNodes(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Status())
+		return
+	}
+	node := strings.TrimSuffix(req.URL.Query().Get("node"), "/")
+	if node == "" {
+		w.Header().Set("reason", "node must be the base URL of a keynest server")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	change := ""
+	switch req.Method {
+	case http.MethodPost:
+		change = "add"
+	case http.MethodDelete:
+		change = "remove"
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	next, sources, err := r.startChange(change, node)
+	if err != nil {
+		statusCode := http.StatusBadRequest
+		if errors.Is(err, errChangeInProgress) {
+			statusCode = http.StatusConflict
+		}
+		w.Header().Set("reason", err.Error())
+		w.WriteHeader(statusCode)
+		return
+	}
+	go r.finishChange(context.Background(), next, sources)
+	w.WriteHeader(http.StatusAccepted)
+}
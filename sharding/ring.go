@@ -0,0 +1,99 @@
+package sharding
+
+import (
+	"fmt"
+	"github.com/spaolacci/murmur3"
+	"slices"
+	"sort"
+)
+
+// DefaultVirtualNodes is the number of points every node gets on the ring when NewRing is given 0.
+const DefaultVirtualNodes = 128
+
+// Ring assigns every key to a node by consistent hashing: each node owns many points of a 64-bit hash ring, its
+// virtual nodes, and a key belongs to the first point at or after its hash. Adding or removing a node only moves the
+// keys of the points it gains or loses, about 1/N of them. A Ring is immutable.
+type Ring struct {
+	vnodes int
+	nodes  []string
+	points []uint64
+	// owners[i] is the node of points[i]
+	owners []string
+}
+
+// NewRing returns the ring of nodes, with vnodes virtual nodes each.
+func NewRing(nodes []string, vnodes int) (*Ring, error) {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{vnodes: vnodes, nodes: slices.Clone(nodes)}
+	slices.Sort(r.nodes)
+	if slices.Contains(r.nodes, "") {
+		return nil, fmt.Errorf("empty node name")
+	}
+	if len(slices.Compact(slices.Clone(r.nodes))) != len(r.nodes) {
+		return nil, fmt.Errorf("duplicate node in %v", nodes)
+	}
+
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(r.nodes)*vnodes)
+	for _, node := range r.nodes {
+		for i := 0; i < vnodes; i++ {
+			points = append(points, point{hash: murmur3.Sum64([]byte(fmt.Sprintf("%s#%d", node, i))), owner: node})
+		}
+	}
+	// a hash shared by two nodes goes to the first one by name, so every router agrees
+	slices.SortStableFunc(points, func(a, b point) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	r.points = make([]uint64, len(points))
+	r.owners = make([]string, len(points))
+	for i, p := range points {
+		r.points[i], r.owners[i] = p.hash, p.owner
+	}
+	return r, nil
+}
+
+// Nodes returns the nodes of the ring, sorted.
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+// Owner returns the node key belongs to, empty when the ring has no node.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := murmur3.Sum64([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// With returns the ring with node added.
+func (r *Ring) With(node string) (*Ring, error) {
+	if slices.Contains(r.nodes, node) {
+		return nil, fmt.Errorf("node %s is already in the ring", node)
+	}
+	return NewRing(append(r.Nodes(), node), r.vnodes)
+}
+
+// Without returns the ring with node removed.
+func (r *Ring) Without(node string) (*Ring, error) {
+	i := slices.Index(r.nodes, node)
+	if i < 0 {
+		return nil, fmt.Errorf("node %s is not in the ring", node)
+	}
+	return NewRing(slices.Delete(r.Nodes(), i, i+1), r.vnodes)
+}
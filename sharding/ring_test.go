@@ -0,0 +1,42 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingMovesOnlyTheKeysOfTheChangedNode(t *testing.T) {
+	ring, err := NewRing([]string{"a", "b", "c"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grown, err := ring.With("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	const keys = 20000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before, after := ring.Owner(key), grown.Owner(key)
+		if after != before && after != "d" {
+			t.Fatalf("key %s moved from %s to %s, only d gains keys", key, before, after)
+		}
+		counts[after]++
+	}
+	for _, node := range grown.Nodes() {
+		if share := float64(counts[node]) / keys; share < 0.15 || share > 0.35 {
+			t.Fatalf("node %s owns %.2f of the keys: %v", node, share, counts)
+		}
+	}
+
+	shrunk, err := grown.Without("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		if key := fmt.Sprintf("key-%d", i); shrunk.Owner(key) != ring.Owner(key) {
+			t.Fatalf("key %s owned by %s after removing d, %s before adding it", key, shrunk.Owner(key), ring.Owner(key))
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Package sharding spreads the keys of the /record API over several keynest servers by consistent hashing, see
+// Router.
+package sharding
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"keynest"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// fanOut bounds the backend requests a multi-key request runs at once
+	fanOut = 32
+	// keyLockStripes is the number of locks the writes of the keys are spread over
+	keyLockStripes = 1024
+	// maxScanLine is the longest line of a /scan answer, a base64 value of the default keynest MaxValueSize
+	maxScanLine = 128 * 1024 * 1024
+)
+
+type Config struct {
+	// Nodes are the base URLs of the keynest servers, used when StateFile doesn't exist yet
+	Nodes []string
+	// VirtualNodes is the number of points every node gets on the ring, DefaultVirtualNodes when 0. It must not
+	// change while the nodes hold keys, since it moves most of them.
+	VirtualNodes int
+	// StateFile keeps the nodes across restarts of the router, along with a node change left unfinished. The nodes
+	// are only kept in memory when it's empty.
+	StateFile string
+	// MigrationBatch is the number of keys a migration reads from a node at once, 1000 when 0
+	MigrationBatch int
+}
+
+// Router serves the /record API of keynest in front of several keynest servers, every key going to the server the
+// ring assigns it to. It adds multi-key requests on /records, which fan out to the servers, and the node changes on
+// /admin/nodes, which migrate the keys of the changed part of the ring while the router keeps serving.
+//
+// Every write must go through the same router: the router orders the writes of a key with its migration.
+type Router struct {
+	cfg    Config
+	client *http.Client
+	seed   maphash.Seed
+	// keyLocks serialize the writes of a key with its migration
+	keyLocks [keyLockStripes]sync.Mutex
+	// writeLock is held by the writes in shared mode, and by the start of a node change
+	writeLock sync.RWMutex
+
+	lock sync.RWMutex
+	ring *Ring
+	// next is the ring a node change migrates the keys to, nil when no change is in progress. The keys are written
+	// to their owner in next and read from it first, then from their owner in ring.
+	next      *Ring
+	migration MigrationStatus
+}
+
+// NewRouter returns a router over the nodes of cfg, or the ones of its state file. A node change left unfinished by
+// a previous run stays in progress until it's started again.
+func NewRouter(cfg Config) (*Router, error) {
+	if cfg.MigrationBatch <= 0 {
+		cfg.MigrationBatch = 1000
+	}
+	r := &Router{cfg: cfg, client: &http.Client{}, seed: maphash.MakeSeed()}
+	nodes, nextNodes := cfg.Nodes, []string(nil)
+	if cfg.StateFile != "" {
+		state, ok, err := readRouterState(cfg.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			nodes, nextNodes = state.Nodes, state.NextNodes
+		}
+	}
+	for i, node := range nodes {
+		nodes[i] = strings.TrimSuffix(node, "/")
+	}
+	var err error
+	if r.ring, err = NewRing(nodes, cfg.VirtualNodes); err != nil {
+		return nil, err
+	}
+	if nextNodes != nil {
+		if r.next, err = NewRing(nextNodes, cfg.VirtualNodes); err != nil {
+			return nil, err
+		}
+		r.migration = MigrationStatus{Error: "interrupted by a restart of the router"}
+		log.Printf("[WARN] Node change from %v to %v left unfinished, start it again\n", nodes, nextNodes)
+	}
+	return r, nil
+}
+
+// Handler serves /record, /records and /admin/nodes.
+func (r *Router) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/record", r.serveRecord)
+	mux.HandleFunc("/records", r.serveRecords)
+	mux.HandleFunc("/admin/nodes", r.serveNodes)
+	return mux
+}
+
+func (r *Router) keyLock(key string) *sync.Mutex {
+	return &r.keyLocks[maphash.String(r.seed, key)%keyLockStripes]
+}
+
+// owners returns the node a key is written to, and the node it may still be held by while a node change migrates
+// it, empty when it can't be elsewhere.
+func (r *Router) owners(key string) (owner, previous string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	owner = r.ring.Owner(key)
+	if r.next != nil {
+		if next := r.next.Owner(key); next != owner {
+			return next, owner
+		}
+	}
+	return owner, ""
+}
+
+func (r *Router) getKey(ctx context.Context, key string) (value, bool, error) {
+	owner, previous := r.owners(key)
+	if owner == "" {
+		return value{}, false, errNoNode
+	}
+	val, ok, err := r.get(ctx, owner, key)
+	if err != nil || ok || previous == "" {
+		return val, ok, err
+	}
+	if val, ok, err = r.get(ctx, previous, key); err != nil || ok {
+		return val, ok, err
+	}
+	// the key may have moved in between, it's written to its new node before it's deleted from the previous one
+	return r.get(ctx, owner, key)
+}
+
+func (r *Router) putKey(ctx context.Context, key string, val value) error {
+	r.writeLock.RLock()
+	defer r.writeLock.RUnlock()
+	lock := r.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	owner, previous := r.owners(key)
+	if owner == "" {
+		return errNoNode
+	}
+	if err := r.put(ctx, owner, key, val); err != nil {
+		return err
+	}
+	// the migration would copy the previous value over the new one
+	if previous != "" {
+		return r.delete(ctx, previous, key)
+	}
+	return nil
+}
+
+func (r *Router) deleteKey(ctx context.Context, key string) error {
+	r.writeLock.RLock()
+	defer r.writeLock.RUnlock()
+	lock := r.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	owner, previous := r.owners(key)
+	if owner == "" {
+		return errNoNode
+	}
+	if err := r.delete(ctx, owner, key); err != nil {
+		return err
+	}
+	if previous != "" {
+		return r.delete(ctx, previous, key)
+	}
+	return nil
+}
+
+var errNoNode = errors.New("no keynest node to route to")
+
+// writeError passes the answer of a backend on to the client, other errors are a 502 Bad Gateway.
+func writeError(w http.ResponseWriter, err error) {
+	log.Printf("[ERROR] %v", err)
+	statusCode := http.StatusBadGateway
+	if backendErr := (*backendError)(nil); errors.As(err, &backendErr) {
+		statusCode = backendErr.statusCode
+	} else if errors.Is(err, errNoNode) {
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Set("reason", err.Error())
+	w.WriteHeader(statusCode)
+}
+
+// serveRecord forwards GET, PUT and DELETE /record?key= to the node of the key.
+func (r *Router) serveRecord(w http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		val, ok, err := r.getKey(req.Context(), key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", val.contentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(val.body)
+	case http.MethodPut:
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.Header().Set("reason", "invalid request body")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err = r.putKey(req.Context(), key, value{contentType: req.Header.Get("Content-Type"), body: body}); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := r.deleteKey(req.Context(), key); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// RecordsResponse is the answer of /records. Records holds the keys found by a GET, in the order of the request, as
+// the JSON Lines of keynest-dump, Missing the other ones.
+type RecordsResponse struct {
+	Records []keynest.ExportedRecord `json:"records,omitempty"`
+	Missing []string                 `json:"missing,omitempty"`
+	Written int                      `json:"written,omitempty"`
+	Deleted int                      `json:"deleted,omitempty"`
+}
+
+// serveRecords fans multi-key requests out to the nodes: GET and DELETE /records?key=a&key=b, and PUT /records with
+// the JSON Lines of keynest-dump as the body. The keys are independent, a failed request may have applied some of
+// them.
+func (r *Router) serveRecords(w http.ResponseWriter, req *http.Request) {
+	resp := RecordsResponse{}
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		keys := req.URL.Query()["key"]
+		found := make([]*keynest.ExportedRecord, len(keys))
+		err = r.fanOut(req.Context(), len(keys), func(ctx context.Context, i int) error {
+			val, ok, err := r.getKey(ctx, keys[i])
+			if err != nil || !ok {
+				return err
+			}
+			found[i], err = exportValue(keys[i], val)
+			return err
+		})
+		for i, record := range found {
+			if record != nil {
+				resp.Records = append(resp.Records, *record)
+			} else {
+				resp.Missing = append(resp.Missing, keys[i])
+			}
+		}
+	case http.MethodPut:
+		var vals []value
+		var keys []string
+		if keys, vals, err = readRecords(req.Body); err != nil {
+			w.Header().Set("reason", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = r.fanOut(req.Context(), len(keys), func(ctx context.Context, i int) error {
+			return r.putKey(ctx, keys[i], vals[i])
+		})
+		resp.Written = len(keys)
+	case http.MethodDelete:
+		keys := req.URL.Query()["key"]
+		err = r.fanOut(req.Context(), len(keys), func(ctx context.Context, i int) error {
+			return r.deleteKey(ctx, keys[i])
+		})
+		resp.Deleted = len(keys)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// fanOut runs fn for 0 to n-1 with at most fanOut calls at once, and returns the first error.
+func (r *Router) fanOut(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, fanOut)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(ctx, i); err != nil {
+				cancel(err)
+			}
+		}()
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// exportValue returns the JSON Lines form of a value read through the /record API.
+func exportValue(key string, val value) (*keynest.ExportedRecord, error) {
+	valueType, err := keynest.ParseContentType(val.contentType)
+	if err != nil {
+		return nil, fmt.Errorf("value of %s: %w", key, err)
+	}
+	decoded, err := keynest.DecodeValue(valueType, val.body)
+	if err != nil {
+		return nil, fmt.Errorf("value of %s: %w", key, err)
+	}
+	record, err := keynest.NewExportedRecord(key, decoded, valueType)
+	return &record, err
+}
+
+// readRecords reads JSON Lines records into their /record API form. When a key shows up more than once, the last
+// line wins.
+func readRecords(body io.Reader) ([]string, []value, error) {
+	keys, vals := make([]string, 0), make([]value, 0)
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, maxScanLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		exported := keynest.ExportedRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &exported); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		record, err := exported.Record()
+		if err == nil && record.Key == "" {
+			err = fmt.Errorf("empty key")
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		body, err := keynest.EncodeValue(record.ValueType, record.Val)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		val := value{contentType: record.ValueType.ContentType(), body: body}
+		if i, ok := seen[record.Key]; ok {
+			vals[i] = val
+			continue
+		}
+		seen[record.Key] = len(keys)
+		keys = append(keys, record.Key)
+		vals = append(vals, val)
+	}
+	return keys, vals, scanner.Err()
+}
@@ -0,0 +1,180 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"keynest"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testBackend serves the /record and /scan API of keynest from a map.
+type testBackend struct {
+	*httptest.Server
+	lock   sync.Mutex
+	values map[string]value
+}
+
+func newTestBackend(t *testing.T) *testBackend {
+	b := &testBackend{values: make(map[string]value)}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		query := r.URL.Query()
+		key := query.Get("key")
+		switch {
+		case r.URL.Path == "/scan":
+			limit, _ := strconv.Atoi(query.Get("limit"))
+			keys := make([]string, 0)
+			for key := range b.values {
+				if key > query.Get("after") {
+					keys = append(keys, key)
+				}
+			}
+			slices.Sort(keys)
+			for _, key := range keys[:min(limit, len(keys))] {
+				record, err := exportValue(key, b.values[key])
+				if err != nil {
+					t.Error(err)
+				}
+				json.NewEncoder(w).Encode(record)
+			}
+		case r.Method == http.MethodGet:
+			val, ok := b.values[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", val.contentType)
+			w.Write(val.body)
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			b.values[key] = value{contentType: r.Header.Get("Content-Type"), body: body}
+		case r.Method == http.MethodDelete:
+			delete(b.values, key)
+		}
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *testBackend) keys() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	keys := make([]string, 0, len(b.values))
+	for key := range b.values {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// checkPlacement checks that every backend holds exactly the keys the ring of the router assigns it.
+func checkPlacement(t *testing.T, router *Router, backends []*testBackend, total int) {
+	t.Helper()
+	router.lock.RLock()
+	ring := router.ring
+	router.lock.RUnlock()
+	count := 0
+	for _, backend := range backends {
+		for _, key := range backend.keys() {
+			if owner := ring.Owner(key); owner != backend.URL {
+				t.Fatalf("%s holds %s, which belongs to %s", backend.URL, key, owner)
+			}
+			count++
+		}
+	}
+	if count != total {
+		t.Fatalf("the backends hold %d keys, want %d", count, total)
+	}
+}
+
+func TestRouterMigratesKeysOnNodeChanges(t *testing.T) {
+	backends := []*testBackend{newTestBackend(t), newTestBackend(t), newTestBackend(t)}
+	stateFile := filepath.Join(t.TempDir(), "router.json")
+	router, err := NewRouter(Config{Nodes: []string{backends[0].URL, backends[1].URL}, StateFile: stateFile, MigrationBatch: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(router.Handler())
+	defer func() { server.Close() }()
+
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/record?key=key-%03d", server.URL, i), strings.NewReader(strconv.Itoa(i)))
+		req.Header.Set("Content-Type", "plain-text/int64")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("PUT key-%03d: %v, %v", i, resp, err)
+		}
+		resp.Body.Close()
+	}
+	checkPlacement(t, router, backends[:2], keys)
+
+	ctx := context.Background()
+	if err = router.AddNode(ctx, backends[2].URL+"/"); err != nil {
+		t.Fatal(err)
+	}
+	checkPlacement(t, router, backends, keys)
+	if len(backends[2].keys()) == 0 {
+		t.Fatal("no key moved to the new node")
+	}
+	if err = router.RemoveNode(ctx, backends[0].URL); err != nil {
+		t.Fatal(err)
+	}
+	checkPlacement(t, router, backends, keys)
+	if len(backends[0].keys()) != 0 {
+		t.Fatalf("the removed node still holds %d keys", len(backends[0].keys()))
+	}
+
+	// a new router picks the nodes up from the state file
+	router, err = NewRouter(Config{Nodes: []string{backends[0].URL}, StateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := router.Status().Nodes; !slices.Equal(nodes, []string{backends[1].URL, backends[2].URL}) && !slices.Equal(nodes, []string{backends[2].URL, backends[1].URL}) {
+		t.Fatalf("nodes = %v after a restart", nodes)
+	}
+	server.Close()
+	server = httptest.NewServer(router.Handler())
+
+	// multi-key requests fan out to the nodes
+	body := &bytes.Buffer{}
+	for i := 0; i < 10; i++ {
+		record, _ := keynest.NewExportedRecord(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value %d", i), keynest.ValueTypeString)
+		json.NewEncoder(body).Encode(record)
+	}
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/records", body)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT /records: %v, %v", resp, err)
+	}
+	req, _ = http.NewRequest(http.MethodDelete, server.URL+"/records?key=key-000&key=key-050", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /records: %v, %v", resp, err)
+	}
+	resp, err := http.Get(server.URL + "/records?key=key-001&key=key-000&key=key-099&key=key-050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	records := RecordsResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, record := range records.Records {
+		got = append(got, record.Key+"="+string(record.Value))
+	}
+	if want := []string{`key-001="value 1"`, "key-099=99"}; !slices.Equal(got, want) || !slices.Equal(records.Missing, []string{"key-000", "key-050"}) {
+		t.Fatalf("GET /records = %v, missing %v, want %v", got, records.Missing, want)
+	}
+	checkPlacement(t, router, backends, keys-2)
+}
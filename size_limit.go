@@ -0,0 +1,92 @@
+package keynest
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// MaxKeySizeLimit is the longest key the data files can hold, the key size of a record is stored on 16 bits.
+	MaxKeySizeLimit = math.MaxUint16
+	// maxRecordValueSize is the largest value part of a single record, its size is stored on 32 bits. A larger value
+	// is split into chunks.
+	maxRecordValueSize = math.MaxUint32
+)
+
+// SizeLimitError reports a key or a value over its limit. Err is ErrKeyTooLarge or ErrValueTooLarge.
+type SizeLimitError struct {
+	Err   error
+	Size  int64
+	Limit int64
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("%v: %d bytes, the limit is %d bytes", e.Err, e.Size, e.Limit)
+}
+
+func (e *SizeLimitError) Unwrap() error {
+	return e.Err
+}
+
+// maxKeySize returns Config.MaxKeySize, bounded by MaxKeySizeLimit.
+func (c *Config) maxKeySize() int {
+	if c == nil || c.MaxKeySize <= 0 || c.MaxKeySize > MaxKeySizeLimit {
+		return MaxKeySizeLimit
+	}
+	return c.MaxKeySize
+}
+
+// valueChunkSize returns Config.ValueChunkSize, bounded by the size of a single record.
+func (c *Config) valueChunkSize() int {
+	if c == nil || c.ValueChunkSize <= 0 || c.ValueChunkSize > maxRecordValueSize {
+		return maxRecordValueSize
+	}
+	return c.ValueChunkSize
+}
+
+func (c *Config) checkKeySize(key string) error {
+	// a record without a key is a chunk of the value of the record before it
+	if key == "" {
+		return ErrEmptyKey
+	}
+	if limit := c.maxKeySize(); len(key) > limit {
+		return &SizeLimitError{Err: ErrKeyTooLarge, Size: int64(len(key)), Limit: int64(limit)}
+	}
+	return nil
+}
+
+// checkValueSize measures a value the way Config.MaxValueSize describes. Only the values that are neither a string
+// nor a []byte are encoded, and only when there is a limit.
+func (c *Config) checkValueSize(val any) error {
+	if c.MaxValueSize <= 0 {
+		return nil
+	}
+	var size int64
+	switch v := val.(type) {
+	case string:
+		size = int64(len(v))
+	case []byte:
+		size = int64(len(v))
+	default:
+		b, err := c.valueCodec().Encode(val)
+		if err != nil {
+			return fmt.Errorf("encode value: %w", err)
+		}
+		size = int64(len(b))
+	}
+	if size > c.MaxValueSize {
+		return &SizeLimitError{Err: ErrValueTooLarge, Size: size, Limit: c.MaxValueSize}
+	}
+	return nil
+}
+
+// checkRecordSize checks the key and, unless it's a tombstone, the value of a record.
+func (c *Config) checkRecordSize(record *Record) error {
+	if err := c.checkKeySize(record.Key); err != nil {
+		return err
+	}
+	if record.TombStone {
+		return nil
+	}
+	return c.checkValueSize(record.Val)
+}
@@ -0,0 +1,90 @@
+package keynest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSizeLimits(t *testing.T) {
+	tc := newTestTableCluster(t, t.TempDir())
+	tc.cfg.MaxKeySize = 8
+	tc.cfg.MaxValueSize = 16
+
+	var limitErr *SizeLimitError
+	err := tc.Put("too-long-key", "v")
+	if !errors.Is(err, ErrKeyTooLarge) || !errors.As(err, &limitErr) || limitErr.Size != 12 || limitErr.Limit != 8 {
+		t.Fatalf("Put with a long key = %v, want ErrKeyTooLarge", err)
+	}
+	if err = tc.Delete("too-long-key"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Delete with a long key = %v, want ErrKeyTooLarge", err)
+	}
+	if err = tc.Put("key", strings.Repeat("v", 17)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Put with a long value = %v, want ErrValueTooLarge", err)
+	}
+	if err = tc.Put("key", map[string]any{"field": strings.Repeat("v", 16)}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Put with a large JSON value = %v, want ErrValueTooLarge", err)
+	}
+	if err = tc.Put("key", strings.Repeat("v", 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	tc.cfg.MaxKeySize = 0
+	if err = tc.Put(strings.Repeat("k", MaxKeySizeLimit+1), "v"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Put with a key over MaxKeySizeLimit = %v, want ErrKeyTooLarge", err)
+	}
+}
+
+func TestLargeValuesAreChunked(t *testing.T) {
+	dir := t.TempDir()
+	tc := newTestTableCluster(t, dir)
+	tc.cfg.ValueChunkSize = 100
+
+	large := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 50+i*37)
+	}
+	for round := 0; round < 3; round++ {
+		for i := round; i < 30; i += 3 {
+			if err := tc.Put(fmt.Sprintf("key-%02d", i), large(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunked := false
+	it := tc.ftables[1][0].NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		chunked = chunked || it.Chunks() > 0
+	}
+	if err := it.Err(); err != nil || !chunked {
+		t.Fatalf("iterating over the compacted table: chunked=%t, %v", chunked, err)
+	}
+	for i := 0; i < 30; i++ {
+		val, ok, err := tc.Get(fmt.Sprintf("key-%02d", i))
+		got, _ := val.([]byte)
+		if err != nil || !ok || !bytes.Equal(got, large(i)) {
+			t.Fatalf("Get(key-%02d) = %d bytes, %v, %v", i, len(got), ok, err)
+		}
+	}
+	// the chunks have no key, an empty key would be taken for one
+	if err := tc.Put("", "v"); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("Put with an empty key = %v, want ErrEmptyKey", err)
+	}
+	if err := tc.Delete(""); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("Delete with an empty key = %v, want ErrEmptyKey", err)
+	}
+	if val, ok, err := tc.Get(""); err != nil || ok {
+		t.Fatalf("Get with an empty key = %v, %v, %v, want nothing", val, ok, err)
+	}
+	if report, err := tc.Verify(); err != nil || !report.OK() {
+		t.Fatalf("Verify = %+v, %v", report, err)
+	}
+}
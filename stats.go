@@ -0,0 +1,91 @@
+package keynest
+
+type TableStats struct {
+	FileName       string `json:"file_name"`
+	NRecords       int    `json:"n_records"`
+	SizeInBytes    int64  `json:"size_in_bytes"`
+	MinKey         string `json:"min_key"`
+	MaxKey         string `json:"max_key"`
+	BloomSizeBits  uint   `json:"bloom_size_bits"`
+	BloomHashFuncs uint   `json:"bloom_hash_funcs"`
+	SparseIndexLen int    `json:"sparse_index_len"`
+}
+
+type LevelStats struct {
+	Level       int          `json:"level"`
+	NRecords    int          `json:"n_records"`
+	SizeInBytes int64        `json:"size_in_bytes"`
+	Tables      []TableStats `json:"tables"`
+}
+
+// ClusterStats describes the current shape of the LSM tree.
+type ClusterStats struct {
+	Levels          []LevelStats `json:"levels"`
+	MemTableEntries int          `json:"memtable_entries"`
+	// ImmutableMemTables is the number of memtables waiting to be flushed to lvl 0
+	ImmutableMemTables int    `json:"immutable_memtables"`
+	WriteStall         string `json:"write_stall"`
+	WriteStallReason   string `json:"write_stall_reason,omitempty"`
+	// CompactionPending is true when lvl 0 holds more tables than Config.Lvl0MaxTableNum
+	CompactionPending bool `json:"compaction_pending"`
+	// PendingCompactionBytes estimates how many bytes the next lvl 0 compaction has to rewrite: every lvl 0 table
+	// plus the lvl 1 tables overlapping their key range.
+	PendingCompactionBytes int64 `json:"pending_compaction_bytes"`
+}
+
+func (t *TableCluster) Stats() ClusterStats {
+	stats := ClusterStats{}
+
+	t.memTableLock.RLock()
+	stats.MemTableEntries = t.memtable.tree.Size()
+	stats.ImmutableMemTables = len(t.immutables)
+	t.memTableLock.RUnlock()
+	stall, reason := t.WriteStall()
+	stats.WriteStall, stats.WriteStallReason = stall.String(), reason
+
+	for i := range t.ftables {
+		t.ftablesLock[i].RLock()
+		lvl := LevelStats{
+			Level:  i,
+			Tables: make([]TableStats, 0, len(t.ftables[i])),
+		}
+		for _, ftable := range t.ftables[i] {
+			metadata := ftable.GetSnapshotTableMetadata()
+			lvl.NRecords += metadata.NRecords
+			lvl.SizeInBytes += metadata.SizeInBytes
+			lvl.Tables = append(lvl.Tables, TableStats{
+				FileName:       metadata.FileName,
+				NRecords:       metadata.NRecords,
+				SizeInBytes:    metadata.SizeInBytes,
+				MinKey:         metadata.MinKey,
+				MaxKey:         metadata.MaxKey,
+				BloomSizeBits:  metadata.BloomFilter.Size,
+				BloomHashFuncs: metadata.BloomFilter.HashFuncs,
+				SparseIndexLen: len(metadata.SparseIndex),
+			})
+		}
+		t.ftablesLock[i].RUnlock()
+		stats.Levels = append(stats.Levels, lvl)
+	}
+
+	lvl0 := stats.Levels[0]
+	stats.CompactionPending = len(lvl0.Tables) > t.cfg.Lvl0MaxTableNum
+	if len(lvl0.Tables) == 0 {
+		return stats
+	}
+	stats.PendingCompactionBytes = lvl0.SizeInBytes
+	cmp := t.cfg.comparator()
+	minKey, maxKey := lvl0.Tables[0].MinKey, lvl0.Tables[0].MaxKey
+	for _, table := range lvl0.Tables[1:] {
+		minKey = minKeyOf(cmp, minKey, table.MinKey)
+		maxKey = maxKeyOf(cmp, maxKey, table.MaxKey)
+	}
+	if len(stats.Levels) > 1 {
+		for _, table := range stats.Levels[1].Tables {
+			if compareKeys(cmp, table.MaxKey, minKey) >= 0 && compareKeys(cmp, table.MinKey, maxKey) <= 0 {
+				stats.PendingCompactionBytes += table.SizeInBytes
+			}
+		}
+	}
+	return stats
+}
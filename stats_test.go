@@ -0,0 +1,53 @@
+package keynest
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStatsDescribesTheLevels(t *testing.T) {
+	tc := newTestTableCluster(t, t.TempDir())
+	stats := tc.Stats()
+	if len(stats.Levels) != levelNum || stats.CompactionPending || stats.PendingCompactionBytes != 0 || stats.WriteStall != "none" {
+		t.Fatalf("Stats() of an empty cluster = %+v", stats)
+	}
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			if err := tc.Put(fmt.Sprintf("key-%02d", i*3+round), "v"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putKeys(t, tc, "mem", 4)
+
+	stats = tc.Stats()
+	lvl0 := stats.Levels[0]
+	if stats.MemTableEntries != 4 || stats.ImmutableMemTables != 0 || len(lvl0.Tables) != 3 || lvl0.NRecords != 30 {
+		t.Fatalf("Stats() = %+v, want 4 memtable entries and 3 lvl 0 tables of 10 records", stats)
+	}
+	// Lvl0MaxTableNum is 2
+	if !stats.CompactionPending || stats.PendingCompactionBytes != lvl0.SizeInBytes {
+		t.Fatalf("Stats() = %+v, want a pending compaction of the %d bytes of lvl 0", stats, lvl0.SizeInBytes)
+	}
+	for _, table := range lvl0.Tables {
+		if table.NRecords != 10 || table.MinKey > table.MaxKey || table.BloomSizeBits == 0 || table.SparseIndexLen == 0 {
+			t.Fatalf("lvl 0 table stats = %+v", table)
+		}
+	}
+
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	stats = tc.Stats()
+	if len(stats.Levels) != 2 || len(stats.Levels[0].Tables) != 0 || stats.CompactionPending || stats.PendingCompactionBytes != 0 {
+		t.Fatalf("Stats() after a compaction = %+v, want an empty lvl 0", stats)
+	}
+	lvl1 := stats.Levels[1]
+	if len(lvl1.Tables) != 1 || lvl1.NRecords != 30 || lvl1.Tables[0].MinKey != "key-00" || lvl1.Tables[0].MaxKey != "key-29" {
+		t.Fatalf("lvl 1 stats = %+v, want a single table of key-00 to key-29", lvl1)
+	}
+}
@@ -3,19 +3,55 @@ package keynest
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"keynest/bloom"
-	"log"
 	"os"
+	"path/filepath"
 	"slices"
 	"sort"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	SizeOfMetadata = int64(binary.Size(Metadata{}))
+
+	lastFileTimestamp atomic.Int64
 )
 
+// nextFileTimestamp returns the creation time of a new file in milliseconds. The timestamp is bumped when several
+// files are created within the same millisecond, so the names built from it are unique.
+func nextFileTimestamp() int64 {
+	for {
+		last := lastFileTimestamp.Load()
+		ts := max(time.Now().UnixMilli(), last+1)
+		if lastFileTimestamp.CompareAndSwap(last, ts) {
+			return ts
+		}
+	}
+}
+
+// nextDataFileName names the data file of a new table after its level and creation time.
+func nextDataFileName(lvl int) string {
+	return fmt.Sprintf("%d-%d.kv", lvl, nextFileTimestamp())
+}
+
+// createDataFile creates the data file of a new table in dir, an existing file is never overwritten.
+func createDataFile(dir string, lvl int) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(filepath.Join(dir, nextDataFileName(lvl)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: create data file: %w", ErrIO, err)
+		}
+		return file, nil
+	}
+}
+
 type FTable struct {
 	dataFile    *os.File
 	sizeInBytes int64
@@ -25,87 +61,154 @@ type FTable struct {
 	cfg         *Config
 	minKey      string
 	maxKey      string
+	// limiter throttles the writes while the table is being built, nil means unlimited
+	limiter *RateLimiter
+	// codec encoded the values of the table, it may differ from Config.ValueCodec
+	codec ValueCodec
+	// cmp orders the keys of the table, it's Config.Comparator
+	cmp Comparator
 }
 
-func NewFTableWithUnsortedRecord(lvl int, records []*Record, cfg *Config) *FTable {
-	ftable := &FTable{
-		cfg:      cfg,
-		nRecords: len(records),
-	}
+func NewFTableWithUnsortedRecord(lvl int, records []*Record, cfg *Config) (*FTable, error) {
+	return newFTableWithUnsortedRecord(lvl, records, cfg, nil)
+}
 
+func newFTableWithUnsortedRecord(lvl int, records []*Record, cfg *Config, limiter *RateLimiter) (*FTable, error) {
+	cmp := cfg.comparator()
 	slices.SortFunc(records, func(a, b *Record) int {
-		if a.Key < b.Key {
-			return -1
-		}
-		if a.Key > b.Key {
-			return 1
-		}
-		return 0
+		return compareKeys(cmp, a.Key, b.Key)
 	})
 
-	//#1. Write to a file and init sparseIndex
-	offset := int64(0)
-	ftable.dataFile, _ = os.Create(fmt.Sprintf("%d-%d.kv", lvl, time.Now().UnixMilli()))
-	buf := new(bytes.Buffer)
-	ftable.minKey = records[0].Key
-	ftable.maxKey = records[len(records)-1].Key
+	builder, err := newFTableBuilder(lvl, cfg, limiter)
+	if err != nil {
+		return nil, err
+	}
 	for i := range records {
-		ftable.writeRecordToFile(records[i], buf, i, &offset)
-
+		if err = builder.add(records[i]); err != nil {
+			builder.abort()
+			return nil, err
+		}
 	}
+	return builder.finish()
+}
 
-	ftable.sizeInBytes = offset
-	if buf.Len() > 0 {
-		ftable.dataFile.Write(buf.Bytes())
+// OpenFTable opens the data file of an existing table, described by its metadata, in dataDir. A metadata without
+// bloom filter is only good for iterating over the table.
+func OpenFTable(dataDir string, metadata TableMetadata, cfg *Config) (*FTable, error) {
+	codec, err := ValueCodecByName(metadata.ValueCodec)
+	if err != nil {
+		return nil, err
+	}
+	dataFile, err := os.Open(filepath.Join(dataDir, metadata.FileName))
+	if err != nil {
+		return nil, fmt.Errorf("%w: open data file: %w", ErrIO, err)
 	}
+	return &FTable{
+		codec:       codec,
+		cmp:         cfg.comparator(),
+		cfg:         cfg,
+		nRecords:    metadata.NRecords,
+		sizeInBytes: metadata.SizeInBytes,
+		minKey:      metadata.MinKey,
+		maxKey:      metadata.MaxKey,
+		dataFile:    dataFile,
+		bloomFilter: &metadata.BloomFilter,
+		sparseIndex: metadata.SparseIndex,
+	}, nil
+}
 
-	//#2. init bloom filter
-	ftable.bloomFilter = bloom.NewBloomFilter(uint(len(records)), cfg.FalsePositiveRate)
-	for _, r := range records {
-		ftable.bloomFilter.Add(r.Key)
+// NewFTableWithSortedRecordCh consumes recordCh until it is closed. The channel is always drained, even when an
+// error occurs, so the producer never blocks forever. nRecords is only a hint, the bloom filter is sized from the
+// records actually received.
+func NewFTableWithSortedRecordCh(lvl int, recordCh chan *Record, nRecords int, cfg *Config) (*FTable, error) {
+	return newFTableWithSortedRecordCh(lvl, recordCh, nRecords, cfg, nil)
+}
+
+func newFTableWithSortedRecordCh(lvl int, recordCh chan *Record, nRecords int, cfg *Config, limiter *RateLimiter) (*FTable, error) {
+	builder, err := newFTableBuilder(lvl, cfg, limiter)
+	for record := range recordCh {
+		if err != nil {
+			continue
+		}
+		err = builder.add(record)
+	}
+	if err != nil {
+		if builder != nil {
+			builder.abort()
+		}
+		return nil, err
 	}
+	return builder.finish()
+}
 
-	return ftable
+// ftableBuilder writes records, given in sorted order, into the data file of a new table. The bloom filter is
+// built once all the records are known, so it's sized for the exact number of keys.
+type ftableBuilder struct {
+	ftable *FTable
+	buf    *bytes.Buffer
+	offset int64
+	keys   []string
 }
 
-func NewFTableWithSortedRecordCh(lvl int, recordCh chan *Record, nRecords int, cfg *Config) *FTable {
-	ftable := &FTable{
-		cfg:      cfg,
-		nRecords: nRecords,
+func newFTableBuilder(lvl int, cfg *Config, limiter *RateLimiter) (*ftableBuilder, error) {
+	dataFile, err := createDataFile(cfg.DataDir, lvl)
+	if err != nil {
+		return nil, err
 	}
+	return &ftableBuilder{
+		ftable: &FTable{
+			cfg:      cfg,
+			dataFile: dataFile,
+			limiter:  limiter,
+			codec:    cfg.valueCodec(),
+			cmp:      cfg.comparator(),
+		},
+		buf: new(bytes.Buffer),
+	}, nil
+}
 
-	//#1. Write to a file and init sparseIndex
-	offset := int64(0)
-	ftable.dataFile, _ = os.Create(fmt.Sprintf("%d-%d.kv", lvl, time.Now().UnixMilli()))
-	buf := new(bytes.Buffer)
-	i := 0
-	ftable.bloomFilter = bloom.NewBloomFilter(uint(nRecords), cfg.FalsePositiveRate)
-	for record := range recordCh {
-		ftable.writeRecordToFile(record, buf, i, &offset)
-		ftable.bloomFilter.Add(record.Key)
+func (b *ftableBuilder) add(record *Record) error {
+	if err := b.ftable.writeRecordToFile(record, b.buf, len(b.keys), &b.offset); err != nil {
+		return err
+	}
+	if len(b.keys) == 0 {
+		b.ftable.minKey = record.Key
+	}
+	b.ftable.maxKey = record.Key
+	b.keys = append(b.keys, record.Key)
+	return nil
+}
 
-		if i == 0 {
-			ftable.minKey = record.Key
-			ftable.maxKey = record.Key
-		} else {
-			ftable.maxKey = record.Key
-		}
-		i++
+// size returns the number of bytes written so far, buffered ones included.
+func (b *ftableBuilder) size() int64 {
+	return b.offset
+}
+
+func (b *ftableBuilder) finish() (*FTable, error) {
+	if err := b.ftable.flushBuffer(b.buf); err != nil {
+		b.abort()
+		return nil, err
 	}
-	ftable.nRecords = i
-	ftable.sizeInBytes = offset
-	if buf.Len() > 0 {
-		ftable.dataFile.Write(buf.Bytes())
+	b.ftable.nRecords = len(b.keys)
+	b.ftable.sizeInBytes = b.offset
+	b.ftable.bloomFilter = bloom.NewBloomFilter(uint(len(b.keys)), b.ftable.cfg.FalsePositiveRate)
+	for _, key := range b.keys {
+		b.ftable.bloomFilter.Add(key)
 	}
+	b.ftable.limiter = nil
+	return b.ftable, nil
+}
 
-	return ftable
+// abort removes the partially written data file.
+func (b *ftableBuilder) abort() {
+	b.ftable.Destroy()
 }
 
-func (s *FTable) writeRecordToFile(record *Record, buf *bytes.Buffer, i int, offset *int64) {
-	metadata, err := record.Marshal(buf)
+func (s *FTable) writeRecordToFile(record *Record, buf *bytes.Buffer, i int, offset *int64) error {
+	before := buf.Len()
+	metadata, err := record.Marshal(buf, s.codec, s.cfg.valueChunkSize())
 	if err != nil {
-		log.Printf("error marshalling record: %v, Skip the record.", err)
-		return
+		return fmt.Errorf("marshal record %q: %w", record.Key, err)
 	}
 
 	if (i+1)%s.cfg.IndexSkipNum == 0 {
@@ -118,25 +221,69 @@ func (s *FTable) writeRecordToFile(record *Record, buf *bytes.Buffer, i int, off
 			Offset: *offset,
 		})
 	}
-	*offset += SizeOfMetadata + int64(metadata.KeySize) + int64(metadata.ValSize)
+	// the chunk records of a large value follow the record
+	*offset += int64(buf.Len() - before)
 
 	if buf.Len() > s.cfg.WriteBufferSize {
-		_, err = s.dataFile.Write(buf.Bytes())
-		if err != nil {
-			log.Printf("error writing to data file: %v", err)
+		return s.flushBuffer(buf)
+	}
+	return nil
+}
+
+func (s *FTable) flushBuffer(buf *bytes.Buffer) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+	s.limiter.Wait(buf.Len())
+	if _, err := s.dataFile.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("%w: write to data file %s: %w", ErrIO, s.dataFile.Name(), err)
+	}
+	buf.Reset()
+	return nil
+}
+
+// readAt reads exactly len(b) bytes at offset. Reading past the end of the file means the file is shorter than
+// its metadata claims, hence it is reported as corruption.
+func (s *FTable) readAt(b []byte, offset int64) error {
+	if _, err := s.dataFile.ReadAt(b, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: unexpected end of %s at offset %d", ErrCorruption, s.dataFile.Name(), offset)
 		}
-		buf.Reset()
+		return fmt.Errorf("%w: read %s at offset %d: %w", ErrIO, s.dataFile.Name(), offset, err)
+	}
+	return nil
+}
+
+// lookupResult describes the outcome of probing a single table for a key.
+type lookupResult struct {
+	val       any
+	valueType ValueType
+	// found is true when the table holds a record of the key, even if the record is a tombstone
+	found     bool
+	tombstone bool
+	// separated is true when val is the ValuePointer of a value in the value log
+	separated bool
+	// bloomSkipped is true when the bloom filter ruled the key out without touching the data file
+	bloomSkipped bool
+}
+
+// Get returns the value of key in the table, the ValuePointer of a value moved to the value log.
+func (s *FTable) Get(key string) (val any, ok bool, err error) {
+	res, err := s.lookup(key)
+	if err != nil || !res.found || res.tombstone {
+		return nil, false, err
 	}
+	return res.val, true, nil
 }
 
-func (s *FTable) Get(key string) (val any, ok bool) {
+func (s *FTable) lookup(key string) (lookupResult, error) {
 	if !s.bloomFilter.MightContains(key) {
-		return nil, false
+		return lookupResult{bloomSkipped: true}, nil
 	}
 
 	// Binary search in the sparse index
 	idx := sort.Search(len(s.sparseIndex), func(i int) bool {
-		return s.sparseIndex[i].Key >= key
+		return s.compare(s.sparseIndex[i].Key, key) >= 0
 	})
 
 	// Determine the starting offset
@@ -144,7 +291,7 @@ func (s *FTable) Get(key string) (val any, ok bool) {
 	var maxOffset int64
 	if idx < len(s.sparseIndex) && s.sparseIndex[idx].Key == key {
 		if s.sparseIndex[idx].Tombstone {
-			return nil, false
+			return lookupResult{found: true, tombstone: true}, nil
 		}
 		startOffset = s.sparseIndex[idx].Offset
 		idx++
@@ -163,56 +310,108 @@ func (s *FTable) Get(key string) (val any, ok bool) {
 		// Read metadata
 		metadata := Metadata{}
 		headerBytes := make([]byte, SizeOfMetadata)
-		if _, err := s.dataFile.ReadAt(headerBytes, curOffset); err != nil {
-			log.Printf("error reading metadata at offset %d: %v", curOffset, err)
-			return nil, false
+		if err := s.readAt(headerBytes, curOffset); err != nil {
+			return lookupResult{}, err
+		}
+		if err := metadata.UnMarshal(headerBytes); err != nil {
+			return lookupResult{}, fmt.Errorf("%w: decode metadata of %s at offset %d: %w", ErrCorruption, s.dataFile.Name(), curOffset, err)
 		}
-		metadata.UnMarshal(headerBytes)
 		curOffset += SizeOfMetadata
 
 		// Read key
 		keyBytes := make([]byte, metadata.KeySize)
-		if _, err := s.dataFile.ReadAt(keyBytes, curOffset); err != nil {
-			return nil, false
+		if err := s.readAt(keyBytes, curOffset); err != nil {
+			return lookupResult{}, err
 		}
 		curOffset += int64(metadata.KeySize)
-		r := Record{}
+		r := Record{Metadata: metadata}
 		r.UnMarshalKey(keyBytes)
 		if r.Key == key {
 			if metadata.TombStone {
-				return nil, false
+				return lookupResult{found: true, tombstone: true}, nil
 			}
 			// Read value
 			valBytes := make([]byte, metadata.ValSize)
-			if _, err := s.dataFile.ReadAt(valBytes, curOffset); err != nil {
-				return nil, false
+			if err := s.readAt(valBytes, curOffset); err != nil {
+				return lookupResult{}, err
 			}
-			err := r.UnMarshalVal(valBytes)
+			valBytes, _, err := s.readChunks(curOffset+int64(metadata.ValSize), metadata.Chunks, valBytes)
 			if err != nil {
-				return nil, true
+				return lookupResult{}, err
+			}
+			if err := r.UnMarshalVal(valBytes, s.codec); err != nil {
+				return lookupResult{}, fmt.Errorf("%w: decode value of %q in %s: %w", ErrCorruption, key, s.dataFile.Name(), err)
 			}
 
-			return r.Val, true
+			return lookupResult{val: r.Val, valueType: r.ValueType, found: true, separated: r.Separated}, nil
 		}
 		curOffset += int64(metadata.ValSize)
+		if metadata.Chunks > 0 {
+			var err error
+			if _, curOffset, err = s.readChunks(curOffset, metadata.Chunks, nil); err != nil {
+				return lookupResult{}, err
+			}
+		}
 	}
-	return nil, false
+	return lookupResult{}, nil
 }
 
-func (s *FTable) Destroy() {
+// readChunks reads the n chunk records starting at offset and appends their values to val, it returns the offset
+// following the last chunk. A nil val skips the chunks without reading their values.
+func (s *FTable) readChunks(offset int64, n uint32, val []byte) ([]byte, int64, error) {
+	headerBytes := make([]byte, SizeOfMetadata)
+	for i := uint32(0); i < n; i++ {
+		metadata := Metadata{}
+		if err := s.readAt(headerBytes, offset); err != nil {
+			return nil, 0, err
+		}
+		if err := metadata.UnMarshal(headerBytes); err != nil {
+			return nil, 0, fmt.Errorf("%w: decode metadata of %s at offset %d: %w", ErrCorruption, s.dataFile.Name(), offset, err)
+		}
+		if !metadata.isChunk() {
+			return nil, 0, fmt.Errorf("%w: chunk %d of %d expected at offset %d of %s", ErrCorruption, i+1, n, offset, s.dataFile.Name())
+		}
+		offset += SizeOfMetadata
+		if val != nil {
+			start := len(val)
+			val = slices.Grow(val, int(metadata.ValSize))[:start+int(metadata.ValSize)]
+			if err := s.readAt(val[start:], offset); err != nil {
+				return nil, 0, err
+			}
+		}
+		offset += int64(metadata.ValSize)
+	}
+	return val, offset, nil
+}
+
+// compare orders two keys like the records of the table.
+func (s *FTable) compare(a, b string) int {
+	return compareKeys(s.cmp, a, b)
+}
+
+// Close closes the data file, the table can't be read anymore.
+func (s *FTable) Close() error {
+	return s.dataFile.Close()
+}
+
+func (s *FTable) Destroy() error {
 	s.dataFile.Close()
-	os.Remove(s.dataFile.Name())
 	clear(s.sparseIndex)
+	if err := os.Remove(s.dataFile.Name()); err != nil {
+		return fmt.Errorf("%w: remove data file: %w", ErrIO, err)
+	}
+	return nil
 }
 
 func (s *FTable) GetSnapshotTableMetadata() TableMetadata {
 	return TableMetadata{
-		FileName:    s.dataFile.Name(),
+		FileName:    filepath.Base(s.dataFile.Name()),
 		NRecords:    s.nRecords,
 		SizeInBytes: s.sizeInBytes,
 		MinKey:      s.minKey,
 		MaxKey:      s.maxKey,
 		BloomFilter: *s.bloomFilter,
 		SparseIndex: s.sparseIndex,
+		ValueCodec:  s.codec.Name(),
 	}
 }
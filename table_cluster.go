@@ -1,64 +1,263 @@
 package keynest
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// levelNum is the number of levels of tables, the lvl 0 flushed from the memtables and the lvl 1 compacted from lvl 0
+const levelNum = 2
+
 type TableCluster struct {
 	//first dimension is level, second is horizontal partition. L0 is the first level that might contains overlap between partition
 	//the L1 and above don't contain overlap between partition
-	memtable     *MemTable
+	memtable *MemTable
+	// immutables are the memtables waiting to be flushed to lvl 0, ordered from the oldest to the newest
+	immutables   []*MemTable
 	ftables      [][]*FTable
 	ftablesLock  []sync.RWMutex
-	memTableLock sync.Mutex
-	cfg          *Config
+	memTableLock sync.RWMutex
+	// flushLock serializes the flushes so the lvl 0 tables are appended in the same order as the immutables
+	flushLock      sync.Mutex
+	compactionLock sync.Mutex
+	metadataLock   sync.Mutex
+	cfg            *Config
+	closed         atomic.Bool
+	done           chan struct{}
+	// jobs are the background goroutines, Close waits for them before closing the files
+	jobs    sync.WaitGroup
+	pins    filePins
+	metrics *Metrics
+	// ioLimiter throttles the disk I/O of memtable flushes and compactions
+	ioLimiter *RateLimiter
+
+	flushKick      chan struct{}
+	compactionKick chan struct{}
+	// stallCh is closed and replaced whenever a flush or a compaction may have changed the write stall state
+	stallCh   chan struct{}
+	stallLock sync.Mutex
+
+	lastMemTableID atomic.Uint64
+	// flushedMemTableID is the id of the newest memtable written to lvl 0
+	flushedMemTableID atomic.Uint64
+	backupLock        sync.Mutex
+
+	valueLog *ValueLog
+	// valueLogGCLock serializes the value log collections
+	valueLogGCLock sync.Mutex
+	// replicationLog is nil when Config.ReplicationLogSize is 0
+	replicationLog *ReplicationLog
 }
 
 func NewTableCluster(cfg *Config) *TableCluster {
 	tc := &TableCluster{
-		cfg:      cfg,
-		ftables:  make([][]*FTable, 1),
-		memtable: NewMemTable(),
+		cfg:            cfg,
+		ftables:        make([][]*FTable, levelNum),
+		done:           make(chan struct{}),
+		metrics:        NewMetrics(),
+		flushKick:      make(chan struct{}, 1),
+		compactionKick: make(chan struct{}, 1),
+		stallCh:        make(chan struct{}),
+	}
+	tc.ioLimiter = NewRateLimiter(cfg.BackgroundIORate)
+	tc.pins.released = sync.NewCond(&tc.pins.lock)
+	tc.valueLog = newValueLog(cfg.DataDir)
+	if cfg.ReplicationLogSize > 0 {
+		tc.replicationLog = newReplicationLog(cfg.ReplicationLogSize)
+	}
+	tc.memtable = tc.newMemTable()
+	for i := range tc.ftables {
+		tc.ftables[i] = make([]*FTable, 0)
 	}
-	tc.ftables[0] = make([]*FTable, 0)
-	tc.ftablesLock = []sync.RWMutex{{}}
+	tc.ftablesLock = make([]sync.RWMutex, levelNum)
 	tc.runMemTableFlushJob()
 	tc.runFTableCompactionJob()
+	tc.runMemTableBackupJob()
+	tc.runValueLogGCJob()
 	return tc
 }
 
-func (t *TableCluster) AddRecords(records []*Record) {
+func (t *TableCluster) AddRecords(records []*Record) error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
 	if len(records) == 0 {
-		return
+		return nil
+	}
+	for _, record := range records {
+		if err := t.cfg.checkRecordSize(record); err != nil {
+			return err
+		}
+	}
+	if err := t.waitForWriteStall(); err != nil {
+		return err
+	}
+	// the records are copied, the values moved to the value log must not change the ones of the caller
+	copied := make([]*Record, len(records))
+	for i, record := range records {
+		c := *record
+		copied[i] = &c
+	}
+	records = copied
+	mutations, err := t.replicationLog.prepare(records...)
+	if err != nil {
+		return err
+	}
+	return t.installLvl0Table(records, mutations, nil)
+}
+
+// installLvl0Table writes records into a new lvl 0 table, their large values into a new value log segment, and
+// appends their mutations to the replication log once the table is installed.
+func (t *TableCluster) installLvl0Table(records []*Record, mutations []Mutation, limiter *RateLimiter) error {
+	// the segment must be installed along with its table before the value log is collected
+	t.flushLock.Lock()
+	defer t.flushLock.Unlock()
+	segment, err := t.separateValues(records)
+	if err != nil {
+		return err
+	}
+	ftable, err := newFTableWithUnsortedRecord(0, records, t.cfg, limiter)
+	if err != nil {
+		t.dropValueLogSegment(segment)
+		return err
 	}
 	t.ftablesLock[0].Lock()
-	t.ftables[0] = append(t.ftables[0], NewFTableWithUnsortedRecord(0, records, t.cfg))
+	t.ftables[0] = append(t.ftables[0], ftable)
 	t.ftablesLock[0].Unlock()
+	t.memTableLock.Lock()
+	t.replicationLog.append(mutations)
+	t.memTableLock.Unlock()
+	return nil
+}
+
+// Put writes val with the value type inferred from its Go type, see ValueTypeOf.
+func (t *TableCluster) Put(key string, val any) error {
+	return t.PutTyped(key, val, ValueTypeOf(val))
 }
 
-func (t *TableCluster) Put(key string, val any) {
+// PutTyped writes val along with its value type, which is given back by GetTyped. val must have the Go type of the
+// value type, except for ValueTypeJSON which accepts any value encodable by Config.ValueCodec. A key or a value over
+// its limit in Config fails with a *SizeLimitError.
+func (t *TableCluster) PutTyped(key string, val any, valueType ValueType) error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+	if codec := t.cfg.valueCodec(); !codec.Accepts(valueType) {
+		return fmt.Errorf("%w: %s values can't be stored by the %s codec", ErrUnsupportedContentType, valueType, codec.Name())
+	}
+	if err := t.cfg.checkKeySize(key); err != nil {
+		return err
+	}
+	if err := t.cfg.checkValueSize(val); err != nil {
+		return err
+	}
+	mutations, err := t.replicationLog.prepare(&Record{Key: key, Val: val, Metadata: Metadata{ValueType: valueType}})
+	if err != nil {
+		return err
+	}
+	if err = t.waitForWriteStall(); err != nil {
+		return err
+	}
 	t.memTableLock.Lock()
-	t.memtable.Put(key, val)
+	t.memtable.Put(key, val, valueType)
+	t.replicationLog.append(mutations)
 	t.memTableLock.Unlock()
+	return nil
 }
 
-func (t *TableCluster) Delete(key string) {
+func (t *TableCluster) Delete(key string) error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+	if err := t.cfg.checkKeySize(key); err != nil {
+		return err
+	}
+	mutations, err := t.replicationLog.prepare(&Record{Key: key, Metadata: Metadata{TombStone: true}})
+	if err != nil {
+		return err
+	}
+	if err = t.waitForWriteStall(); err != nil {
+		return err
+	}
 	t.memTableLock.Lock()
 	t.memtable.Delete(key)
+	t.replicationLog.append(mutations)
 	t.memTableLock.Unlock()
+	return nil
+}
+
+// Get returns the latest value of key. ok is false when the key doesn't exist or has been deleted, err is only set
+// when one of the tables couldn't be read.
+func (t *TableCluster) Get(key string) (val any, ok bool, err error) {
+	val, _, ok, err = t.GetTyped(key)
+	return val, ok, err
 }
 
-func (t *TableCluster) Get(key string) (any, bool) {
-	val, ok := t.memtable.Get(key)
-	if ok {
-		return val, true
+// GetTyped returns the latest value of key along with the value type it was written with.
+func (t *TableCluster) GetTyped(key string) (val any, valueType ValueType, ok bool, err error) {
+	if t.closed.Load() {
+		return nil, ValueTypeUnknown, false, ErrClosed
 	}
+	// an empty key can't be written, the records without a key are chunks
+	if key == "" {
+		return nil, ValueTypeUnknown, false, nil
+	}
+	start := time.Now()
+	source := GetSourceNotFound
+	defer func() {
+		t.metrics.GetLatency[source].ObserveDuration(start)
+	}()
+
+	for {
+		var res lookupResult
+		res, source, err = t.lookup(key)
+		if err != nil || !res.found || res.tombstone {
+			source = GetSourceNotFound
+			return nil, ValueTypeUnknown, false, err
+		}
+		if !res.separated {
+			return res.val, res.valueType, true, nil
+		}
+		val, valueType, err = t.valueLog.read(res.val.(ValuePointer))
+		// the segment was collected after the record was read, a newer record now holds the value
+		if errors.Is(err, errValueLogSegmentRemoved) {
+			continue
+		}
+		if err != nil {
+			return nil, ValueTypeUnknown, false, err
+		}
+		return val, valueType, true, nil
+	}
+}
+
+// lookup returns the newest record of key and where it was found. The tables are probed from the newest to the
+// oldest: the memtable, the immutable memtables, lvl 0 and then lvl 1. The first record found, tombstone included,
+// is the answer.
+func (t *TableCluster) lookup(key string) (lookupResult, GetSource, error) {
+	t.memTableLock.RLock()
+	res := t.lookupMemTables(key)
+	t.memTableLock.RUnlock()
+	if res.found {
+		return res, GetSourceMemTable, nil
+	}
+	return t.lookupTables(key)
+}
+
+// lookupMemTables probes the memtable and then the immutable memtables, memTableLock must be held.
+func (t *TableCluster) lookupMemTables(key string) lookupResult {
+	res := t.memtable.lookup(key)
+	for i := len(t.immutables) - 1; i >= 0 && !res.found; i-- {
+		res = t.immutables[i].lookup(key)
+	}
+	return res
+}
 
+// lookupTables probes lvl 0 and then the other levels.
+func (t *TableCluster) lookupTables(key string) (lookupResult, GetSource, error) {
 	t.ftablesLock[0].RLock()
 	lvl0Unlock := false
 	defer func() {
@@ -66,10 +265,10 @@ func (t *TableCluster) Get(key string) (any, bool) {
 			t.ftablesLock[0].RUnlock()
 		}
 	}()
-	for i, _ := range t.ftables[0] {
-		val, ok := t.ftables[0][i].Get(key)
-		if ok {
-			return val, true
+	for i := len(t.ftables[0]) - 1; i >= 0; i-- {
+		res, err := t.probe(t.ftables[0][i], key)
+		if err != nil || res.found {
+			return res, GetSourceLvl0, err
 		}
 	}
 	t.ftablesLock[0].RUnlock()
@@ -86,298 +285,239 @@ func (t *TableCluster) Get(key string) (any, bool) {
 		}
 
 		for j := minI; j < maxI; j++ {
-			val, ok := t.ftables[i][j].Get(key)
-			if ok {
-				return val, true
+			res, err := t.probe(t.ftables[i][j], key)
+			if err != nil || res.found {
+				return res, GetSourceLvl1, err
 			}
 		}
 	}
 
-	return nil, false
+	return lookupResult{}, GetSourceNotFound, nil
 }
 
-func (t *TableCluster) TriggerCompaction() {
-	t.compactingLvl0()
+// PutBytes, GetBytes and DeleteBytes take binary keys. A key is stored as a string, which holds any byte sequence, so
+// they behave like Put, Get and Delete with string(key), and the keys given back by Scan are the same bytes.
+func (t *TableCluster) PutBytes(key []byte, val any) error {
+	return t.Put(string(key), val)
 }
 
-func (t *TableCluster) TriggerMemFlush() {
-	t.flushMemTableToFTable()
+func (t *TableCluster) GetBytes(key []byte) (val any, ok bool, err error) {
+	return t.Get(string(key))
 }
 
-func (t *TableCluster) runFTableCompactionJob() {
-	go func() {
-		for range time.Tick(t.cfg.CompactionInterval) {
-			t.compactingLvl0()
-		}
-	}()
+func (t *TableCluster) DeleteBytes(key []byte) error {
+	return t.Delete(string(key))
 }
 
-func (t *TableCluster) runMemTableFlushJob() {
-	go func() {
-		for range time.Tick(t.cfg.MemFlushInterval) {
-			if t.memtable.tree.Size() > t.cfg.MemMaxNum {
-				t.flushMemTableToFTable()
-			}
-		}
-	}()
-}
-
-func (t *TableCluster) flushMemTableToFTable() {
-	t.memTableLock.Lock()
-	defer t.memTableLock.Unlock()
-	defer t.SnapshotTableClusterMetadata()
-
-	values := t.memtable.tree.Values()
-	if len(values) == 0 {
-		return
+// probe looks the key up in a single table and records how useful its bloom filter was.
+func (t *TableCluster) probe(ftable *FTable, key string) (lookupResult, error) {
+	res, err := ftable.lookup(key)
+	if err != nil {
+		return res, err
 	}
-	keys := t.memtable.tree.Keys()
-	sortedRecords := make([]*Record, len(values))
-	for i, v := range values {
-		memRecord := v.(*MemRecord)
-		sortedRecords[i] = &Record{
-			Key: keys[i].(string),
-			Val: memRecord.val,
-			Metadata: Metadata{
-				TombStone: memRecord.tombstone,
-			},
-		}
+	if res.bloomSkipped {
+		t.metrics.BloomUseful.Inc()
+	} else if !res.found {
+		t.metrics.BloomFalsePositive.Inc()
 	}
-
-	t.AddRecords(sortedRecords)
-	t.memtable.tree.Clear()
+	return res, nil
 }
 
-func readRecordFromFTable(file *os.File, offset *int64) (*Record, error) {
-	record := Record{}
-	b := make([]byte, SizeOfMetadata)
-	n, err := file.ReadAt(b, *offset)
-	if err != nil {
-		return nil, err
-	}
-	*offset += int64(n)
-	err = record.Metadata.UnMarshal(b)
-	if err != nil {
-		return nil, err
-	}
-	b = make([]byte, record.ContentSize())
-	file.ReadAt(b, *offset)
-	*offset += int64(record.ContentSize())
+// compare orders two keys with Config.Comparator.
+func (t *TableCluster) compare(a, b string) int {
+	return compareKeys(t.cfg.comparator(), a, b)
+}
 
-	record.UnMarshalKey(b[:record.Metadata.KeySize])
-	err = record.UnMarshalVal(b[record.Metadata.KeySize:])
-	if err != nil {
-		return nil, err
+func (t *TableCluster) TriggerCompaction() error {
+	if t.closed.Load() {
+		return ErrClosed
 	}
-	return &record, nil
+	return t.compactingLvl0()
 }
 
-func (t *TableCluster) compactingLvl0() {
-	if len(t.ftables[0]) <= t.cfg.Lvl0MaxTableNum {
-		return
+func (t *TableCluster) TriggerMemFlush() error {
+	if t.closed.Load() {
+		return ErrClosed
 	}
-	defer t.SnapshotTableClusterMetadata()
-
-	//since the lvl 0 might be appended during compaction,
-	//so we need to lock the last index of which the compaction will start from index 0 till the last index
-	lastIndex := len(t.ftables[0])
+	return t.flushMemTableToFTable()
+}
 
-	log.Printf("[INFO] Start compaction job for %d ftables at %d\n", lastIndex, time.Now().UnixMilli())
+// SetBackgroundIORate changes the bytes per second allowed for memtable flushes and compactions, 0 means unlimited.
+func (t *TableCluster) SetBackgroundIORate(bytesPerSec int64) {
+	t.ioLimiter.SetRate(bytesPerSec)
+}
 
-	totalRecords := 0
+func (t *TableCluster) BackgroundIORate() int64 {
+	return t.ioLimiter.Rate()
+}
 
-	for i := range lastIndex {
-		totalRecords += t.ftables[0][i].nRecords
+// Close stops the background jobs, flushes the memtables to disk and closes every data file. Any later call returns
+// ErrClosed.
+func (t *TableCluster) Close() error {
+	if !t.closed.CompareAndSwap(false, true) {
+		return ErrClosed
 	}
-	lvl0records := make([]*Record, 0, totalRecords)
-
-	// merge all records from level 0 to lvl0records in sorted order
-	offsets := make([]int64, lastIndex)
-	curRecords := make([]*Record, lastIndex)
-	for {
-		var minRecord *Record
-		for i := max(lastIndex-1, 0); i >= 0; i-- {
-			if offsets[i] >= t.ftables[0][i].sizeInBytes {
-				continue
-			}
-			if curRecords[i] != nil {
-				continue
-			}
-			tmpRecord, err := readRecordFromFTable(t.ftables[0][i].dataFile, &offsets[i])
-			if err != nil {
-				log.Printf("[ERROR] Error reading record from file: %v\n", err)
-				continue
+	close(t.done)
+	t.jobs.Wait()
+
+	err := t.flushMemTableToFTable()
+
+	t.compactionLock.Lock()
+	defer t.compactionLock.Unlock()
+	// the scans, backups and checkpoints still running are waited for
+	t.whenUnpinned(func() {
+		for i := range t.ftables {
+			t.ftablesLock[i].Lock()
+			for _, ftable := range t.ftables[i] {
+				ftable.dataFile.Close()
 			}
-			curRecords[i] = tmpRecord
+			t.ftablesLock[i].Unlock()
 		}
+		t.valueLog.close()
+	})
+	return err
+}
 
-		var minRecordPointerOfPointer **Record
-		for i := max(lastIndex-1, 0); i >= 0; i-- {
-			if curRecords[i] == nil {
-				continue
-			}
-			if minRecord == nil {
-				minRecord = curRecords[i]
-				minRecordPointerOfPointer = &curRecords[i]
-				continue
+func (t *TableCluster) runFTableCompactionJob() {
+	if t.cfg.CompactionInterval <= 0 {
+		return
+	}
+	t.jobs.Add(1)
+	go func() {
+		defer t.jobs.Done()
+		ticker := time.NewTicker(t.cfg.CompactionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+			case <-t.compactionKick:
 			}
-
-			if minRecord.Key > curRecords[i].Key {
-				minRecord = curRecords[i]
-				minRecordPointerOfPointer = &curRecords[i]
-			} else if minRecord.Key == curRecords[i].Key { //if duplicate found
-				curRecords[i] = nil //remove duplicate
+			if err := t.compactingLvl0(); err != nil {
+				log.Printf("[ERROR] Compaction job failed: %v\n", err)
 			}
 		}
-		if minRecord == nil {
-			break
-		}
-		lvl0records = append(lvl0records, minRecord)
-		minRecord = nil
-		*minRecordPointerOfPointer = nil
-	}
+	}()
+}
 
-	var ftable *FTable
-	minI, maxI, isOverlap := t.findOverlapTablesRange(1, lvl0records[0].Key, lvl0records[len(lvl0records)-1].Key)
-	if isOverlap {
-		for _, table := range t.ftables[1][minI:maxI] {
-			totalRecords += table.nRecords
-		}
-		minRecordCh := make(chan *Record)
-
-		go func() {
-			defer close(minRecordCh)
-			offset := int64(0)
-			lvl1Idx := minI
-			lvl0Idx := 0
-			var lvl1Record *Record
-
-			//merge the sorted records from lvl0 and lvl1
-			for lvl1Idx < maxI && lvl0Idx < len(lvl0records) {
-				if lvl1Record == nil {
-					if offset <= t.ftables[1][lvl1Idx].sizeInBytes {
-						tmp, err := readRecordFromFTable(t.ftables[1][lvl1Idx].dataFile, &offset)
-						if err != nil {
-							fmt.Printf("[ERROR] Error reading record from file: %v\n", err)
-							continue
-						}
-						lvl1Record = tmp
-					} else if lvl1Idx+1 < maxI {
-						lvl1Idx++
-						offset = 0
-						continue
-					} else {
-						break
-					}
-				}
-
-				if lvl0records[lvl0Idx].Key < lvl1Record.Key {
-					minRecordCh <- lvl0records[lvl0Idx]
-					lvl0Idx++
-				} else if lvl0records[lvl0Idx].Key > lvl1Record.Key {
-					minRecordCh <- lvl1Record
-					lvl1Record = nil
-				} else { //if same, skip lvl1 data as the lvl 0 is the latest one.
-					minRecordCh <- lvl1Record
-					lvl1Record = nil
-					//TODO: provide option strategy to deal with deletion: should we put a tombstone or discard it?
-					if !lvl0records[lvl0Idx].TombStone {
-						minRecordCh <- lvl0records[lvl0Idx]
-					}
-					lvl0Idx++
-				}
+func (t *TableCluster) runMemTableFlushJob() {
+	if t.cfg.MemFlushInterval <= 0 {
+		return
+	}
+	t.jobs.Add(1)
+	go func() {
+		defer t.jobs.Done()
+		ticker := time.NewTicker(t.cfg.MemFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+			case <-t.flushKick:
 			}
-
-			//accumulate the rest of the records
-			for lvl1Idx < maxI { //139266
-				if offset < t.ftables[1][lvl1Idx].sizeInBytes {
-					lvl1Record = &Record{}
-					tmp, err := readRecordFromFTable(t.ftables[1][lvl1Idx].dataFile, &offset)
-					if err != nil {
-						fmt.Printf("[ERROR] Error reading record from file: %v\n", err)
-						continue
-					}
-					lvl1Record = tmp
-					minRecordCh <- lvl1Record
-				} else if lvl1Idx+1 < maxI {
-					lvl1Idx++
-					offset = 0
-					continue
-				} else {
-					break
-				}
+			t.memTableLock.RLock()
+			memEntries := t.memtable.tree.Size()
+			t.memTableLock.RUnlock()
+			// a stop trigger at or under MemMaxNum would block the writes forever without a rotation
+			if memEntries > t.cfg.MemMaxNum || triggerReached(memEntries, t.cfg.MemStopNum) {
+				t.rotateMemTable()
 			}
-			for lvl0Idx < len(lvl0records) {
-				minRecordCh <- lvl0records[lvl0Idx]
-				lvl0Idx++
+			if err := t.flushImmutableMemTables(); err != nil {
+				log.Printf("[ERROR] Memtable flush job failed: %v\n", err)
 			}
-		}()
-
-		ftable = NewFTableWithSortedRecordCh(1, minRecordCh, totalRecords, t.cfg)
-
-	} else {
-		ftable = NewFTableWithUnsortedRecord(1, lvl0records, t.cfg)
-	}
-
-	fmt.Println("[INFO] New table created")
-	t.ftablesLock[0].Lock()
-	if len(t.ftablesLock) == 1 {
-		t.ftablesLock = append(t.ftablesLock, sync.RWMutex{})
-		t.ftables = append(t.ftables, []*FTable{})
-	}
-
-	t.ftablesLock[1].Lock()
-
-	if isOverlap {
-		for i := minI; i < maxI; i++ {
-			log.Printf("[INFO] Destroy table[%d][%d]\n", 1, i)
-			t.ftables[1][i].Destroy()
 		}
-		t.ftables[1] = append(t.ftables[1][:minI], append([]*FTable{ftable}, t.ftables[1][maxI:]...)...)
-	} else {
-		t.ftables[1] = append(t.ftables[1], ftable)
-	}
-	fmt.Println("[INFO] New table added at lvl 1")
+	}()
+}
 
-	for i := 0; i < lastIndex; i++ {
-		log.Printf("[INFO] Destroy table[%d][%d]\n", 0, i)
-		t.ftables[0][i].Destroy()
-	}
-	t.ftables[0] = t.ftables[0][lastIndex:]
-	t.ftablesLock[1].Unlock()
-	t.ftablesLock[0].Unlock()
-	log.Printf("[INFO] Compaction job done at %d for %d ftables\n", time.Now().UnixMilli(), lastIndex)
+// flushMemTableToFTable flushes the active memtable along with every immutable memtable to lvl 0.
+func (t *TableCluster) flushMemTableToFTable() error {
+	t.rotateMemTable()
+	return t.flushImmutableMemTables()
 }
 
-// find overlap tables given a min-max keys. the interpretation of minI-maxI is similar to golang slice [minI-maxI] which means all elements
-// from index minI till maxI-1 are included
-func (t *TableCluster) findOverlapTablesRange(lvl int, minKey, maxKey string) (minI, maxI int, isOverlap bool) {
+func (t *TableCluster) newMemTable() *MemTable {
+	memtable := NewMemTableWithComparator(t.cfg.comparator())
+	memtable.id = t.lastMemTableID.Add(1)
+	return memtable
+}
 
-	if lvl <= 0 || lvl >= len(t.ftables) || len(t.ftables[lvl]) == 0 {
-		return -1, -1, false
+// rotateMemTable turns the active memtable into an immutable one and replaces it with an empty memtable, so the
+// writes are not blocked while it's being flushed.
+func (t *TableCluster) rotateMemTable() {
+	t.memTableLock.Lock()
+	defer t.memTableLock.Unlock()
+	if t.memtable.tree.Size() == 0 {
+		return
 	}
+	t.immutables = append(t.immutables, t.memtable)
+	t.memtable = t.newMemTable()
+}
 
-	minI = sort.Search(len(t.ftables[lvl]), func(i int) bool {
-		return minKey < t.ftables[lvl][i].minKey
-	})
+// flushImmutableMemTables writes the immutable memtables to lvl 0, from the oldest to the newest. A memtable is
+// only dropped once its table is installed, so a failed flush doesn't lose any write.
+func (t *TableCluster) flushImmutableMemTables() error {
+	t.flushLock.Lock()
+	defer t.flushLock.Unlock()
 
-	maxI = sort.Search(len(t.ftables[lvl]), func(i int) bool {
-		return maxKey < t.ftables[lvl][i].maxKey
-	})
-
-	minI = max(minI-1, 0)
-	maxI = min(maxI, len(t.ftables[lvl])-1)
-	if t.ftables[lvl][minI].maxKey < minKey {
-		minI = min(minI+1, len(t.ftables[lvl])-1)
-	}
+	flushed := false
+	defer func() {
+		if flushed {
+			t.notifyWriteStallChange()
+		}
+	}()
+	for {
+		t.memTableLock.RLock()
+		if len(t.immutables) == 0 {
+			t.memTableLock.RUnlock()
+			break
+		}
+		memtable := t.immutables[0]
+		t.memTableLock.RUnlock()
+
+		start := time.Now()
+		values := memtable.tree.Values()
+		keys := memtable.tree.Keys()
+		sortedRecords := make([]*Record, len(values))
+		for i, v := range values {
+			memRecord := v.(*MemRecord)
+			sortedRecords[i] = &Record{
+				Key: keys[i].(string),
+				Val: memRecord.val,
+				Metadata: Metadata{
+					TombStone: memRecord.tombstone,
+					ValueType: memRecord.valueType,
+				},
+			}
+		}
 
-	if t.ftables[lvl][maxI].minKey < maxKey {
-		maxI = min(maxI+1, len(t.ftables[lvl])-1)
+		segment, err := t.separateValues(sortedRecords)
+		if err != nil {
+			return err
+		}
+		ftable, err := newFTableWithUnsortedRecord(0, sortedRecords, t.cfg, t.ioLimiter)
+		if err != nil {
+			t.dropValueLogSegment(segment)
+			return err
+		}
+		// install the table before dropping the memtable, so a concurrent Get always finds the records
+		t.ftablesLock[0].Lock()
+		t.ftables[0] = append(t.ftables[0], ftable)
+		t.ftablesLock[0].Unlock()
+		t.flushedMemTableID.Store(memtable.id)
+		t.memTableLock.Lock()
+		t.immutables = t.immutables[1:]
+		t.memTableLock.Unlock()
+		flushed = true
+
+		t.metrics.FlushCount.Inc()
+		t.metrics.FlushBytes.Add(uint64(ftable.sizeInBytes))
+		t.metrics.FlushDuration.ObserveDuration(start)
 	}
 
-	isOverlap = t.ftables[lvl][minI].minKey <= minKey && maxKey <= t.ftables[lvl][maxI].maxKey
-	if isOverlap && minI == maxI {
-		maxI++
+	if !flushed {
+		return nil
 	}
-	return minI, maxI, isOverlap
+	return t.SnapshotTableClusterMetadata()
 }
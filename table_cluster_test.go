@@ -0,0 +1,80 @@
+package keynest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func newTestTableCluster(t *testing.T, dir string) *TableCluster {
+	t.Helper()
+	tc := NewTableCluster(&Config{
+		DataDir:           dir,
+		IndexSkipNum:      4,
+		WriteBufferSize:   1024,
+		FalsePositiveRate: 0.01,
+		Lvl0MaxTableNum:   2,
+		MemMaxNum:         1000,
+	})
+	t.Cleanup(func() { tc.Close() })
+	return tc
+}
+
+func putKeys(t *testing.T, tc *TableCluster, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := tc.Put(fmt.Sprintf("%s-%02d", prefix, i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestErrorsReachCallers(t *testing.T) {
+	dir := t.TempDir()
+	// a data directory without metadata fails on the file system
+	err := newTestTableCluster(t, dir).LoadTableClusterMetadata()
+	if !errors.Is(err, ErrIO) || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("LoadTableClusterMetadata without metadata = %v, want ErrIO and fs.ErrNotExist", err)
+	}
+
+	tc := newTestTableCluster(t, dir)
+	putKeys(t, tc, "key", 20)
+	if err = tc.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	path := tc.ftables[0][0].dataFile.Name()
+	if err = tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tc.Put("key", "v"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Put after Close = %v, want ErrClosed", err)
+	}
+	if _, _, err = tc.Get("key-00"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Get after Close = %v, want ErrClosed", err)
+	}
+	if err = tc.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("second Close = %v, want ErrClosed", err)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(path, stat.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	reopened := newTestTableCluster(t, dir)
+	if err = reopened.LoadTableClusterMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	// the last records of the table are gone
+	if _, _, err = reopened.Get("key-19"); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Get from a truncated table = %v, want ErrCorruption", err)
+	}
+	if report, err := reopened.Verify(); err != nil || report.OK() {
+		t.Fatalf("Verify of a truncated table = %+v, %v, want an issue", report, err)
+	}
+}
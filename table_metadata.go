@@ -1,19 +1,56 @@
 package keynest
 
 import (
+	"errors"
 	"fmt"
 	"github.com/vmihailenco/msgpack/v5"
 	"keynest/bloom"
 	"log"
 	"os"
-	"sync"
+	"path/filepath"
 )
 
+// MetadataFileName is the name of the file, inside Config.DataDir, holding the TableClusterMetadata.
+const MetadataFileName = "master-metadata"
+
+// formatVersion is the on-disk format of the data files. Version 0, never recorded, has records without the value
+// type, the chunks and the value log pointers. A data directory of another version is refused.
+const formatVersion = 1
+
 type TableClusterMetadata struct {
+	// FormatVersion is the on-disk format of the tables and value log segments, see formatVersion
+	FormatVersion  int
 	FTableMetadata [][]TableMetadata
+	// FlushedMemTableID is the id of the newest memtable already written to lvl 0
+	FlushedMemTableID uint64
+	// Comparator is the name of the comparator ordering the keys, an empty name is bytewise
+	Comparator string
+	// ValueLogSegments are the value log segments the tables may point at, from the oldest to the newest
+	ValueLogSegments []ValueLogSegmentMetadata
+}
+
+// dataFileRef is a file of the data directory referred to by the metadata.
+type dataFileRef struct {
+	FileName    string
+	SizeInBytes int64
+}
+
+// dataFiles returns the files the metadata refers to, the tables by level and then the value log segments.
+func (m TableClusterMetadata) dataFiles() []dataFileRef {
+	files := make([]dataFileRef, 0)
+	for i := range m.FTableMetadata {
+		for _, metadata := range m.FTableMetadata[i] {
+			files = append(files, dataFileRef{FileName: metadata.FileName, SizeInBytes: metadata.SizeInBytes})
+		}
+	}
+	for _, segment := range m.ValueLogSegments {
+		files = append(files, dataFileRef{FileName: segment.FileName, SizeInBytes: segment.SizeInBytes})
+	}
+	return files
 }
 
 type TableMetadata struct {
+	// FileName is the name of the data file relative to the data directory
 	FileName    string
 	NRecords    int
 	SizeInBytes int64
@@ -21,72 +58,166 @@ type TableMetadata struct {
 	MaxKey      string
 	BloomFilter bloom.BloomFilter
 	SparseIndex []Index
+	// ValueCodec is the name of the codec of the values, an empty name is msgpack
+	ValueCodec string
 }
 
-func (t *TableCluster) SnapshotTableClusterMetadata() {
+func (t *TableCluster) SnapshotTableClusterMetadata() error {
+	t.metadataLock.Lock()
+	defer t.metadataLock.Unlock()
 
-	clusterMetadata := TableClusterMetadata{}
+	return WriteTableClusterMetadata(t.cfg.DataDir, t.getTableClusterMetadata())
+}
 
+func (t *TableCluster) getTableClusterMetadata() TableClusterMetadata {
+	// a flush installs its table before updating the id, reading the id first guarantees the table is listed
+	clusterMetadata := TableClusterMetadata{
+		FormatVersion:     formatVersion,
+		FlushedMemTableID: t.flushedMemTableID.Load(),
+		Comparator:        t.cfg.comparator().Name(),
+	}
+
+	// a compaction installs its tables in every level at once, the levels are read at once so no table is listed twice
+	for i := range t.ftablesLock {
+		t.ftablesLock[i].RLock()
+	}
 	for i, _ := range t.ftables {
 		clusterMetadata.FTableMetadata = append(clusterMetadata.FTableMetadata, []TableMetadata{})
 		for j, _ := range t.ftables[i] {
 			clusterMetadata.FTableMetadata[i] = append(clusterMetadata.FTableMetadata[i], t.ftables[i][j].GetSnapshotTableMetadata())
 		}
 	}
+	for i := range t.ftablesLock {
+		t.ftablesLock[i].RUnlock()
+	}
+	// a segment is added before the table pointing at it, listing the segments last guarantees they are all listed
+	clusterMetadata.ValueLogSegments = t.valueLog.metadata()
+	return clusterMetadata
+}
+
+// openFTables opens the tables listed in the metadata, there is always at least lvl 0. Nothing stays open on error.
+func (t *TableCluster) openFTables(clusterMetadata TableClusterMetadata) ([][]*FTable, error) {
+	ftables := make([][]*FTable, len(clusterMetadata.FTableMetadata))
+	for i, _ := range clusterMetadata.FTableMetadata {
+		ftables[i] = make([]*FTable, 0, len(clusterMetadata.FTableMetadata[i]))
+		for j, _ := range clusterMetadata.FTableMetadata[i] {
+			ftable, err := OpenFTable(t.cfg.DataDir, clusterMetadata.FTableMetadata[i][j], t.cfg)
+			if err != nil {
+				closeFTables(ftables)
+				return nil, err
+			}
+			log.Printf("[INFO] Loading table metadata: %v\n", ftable.dataFile.Name())
+			ftables[i] = append(ftables[i], ftable)
+		}
+	}
+	if len(ftables) > levelNum {
+		closeFTables(ftables)
+		return nil, fmt.Errorf("%w: metadata holds %d levels, at most %d are known", ErrCorruption, len(ftables), levelNum)
+	}
+	for len(ftables) < levelNum {
+		ftables = append(ftables, []*FTable{})
+	}
+	return ftables, nil
+}
+
+func closeFTables(ftables [][]*FTable) {
+	for i := range ftables {
+		for _, ftable := range ftables[i] {
+			ftable.dataFile.Close()
+		}
+	}
+}
 
+// WriteTableClusterMetadata writes the metadata file of dir. The content is written to a temporary file first and
+// renamed over the previous one, so a crash never leaves a half written metadata file.
+func WriteTableClusterMetadata(dir string, clusterMetadata TableClusterMetadata) error {
 	bytes, err := msgpack.Marshal(clusterMetadata)
 	if err != nil {
-		log.Printf("[ERROR] Error marshalling cluster metadata: %v\n", err)
-		return
+		return fmt.Errorf("marshal cluster metadata: %w", err)
 	}
 
-	file, err := os.Create(fmt.Sprintf("master-metadata"))
+	path := filepath.Join(dir, MetadataFileName)
+	file, err := os.Create(path + ".tmp")
 	if err != nil {
-		log.Printf("[ERROR] Error creating file: %v\n", err)
-		return
+		return fmt.Errorf("%w: create metadata file: %w", ErrIO, err)
 	}
 	defer file.Close()
 	_, err = file.Write(bytes)
+	if err == nil {
+		err = file.Sync()
+	}
 	if err != nil {
-		log.Printf("[ERROR] Error writing to file: %v\n", err)
+		os.Remove(file.Name())
+		return fmt.Errorf("%w: write metadata file: %w", ErrIO, err)
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("%w: rename metadata file: %w", ErrIO, err)
 	}
+	return nil
 }
 
-func (t *TableCluster) LoadTableClusterMetadata() {
-	file, err := os.OpenFile("master-metadata", os.O_RDONLY, 0644)
-	defer file.Close()
-	if err != nil {
-		log.Printf("[ERROR] Error opening file: %v\n", err)
-		return
+// checkFormatVersion refuses the metadata of data files this version of keynest can't read.
+func checkFormatVersion(version int) error {
+	if version != formatVersion {
+		return fmt.Errorf("%w: data files have format version %d, this version of keynest reads version %d, export "+
+			"them with the version of keynest that wrote them and import them into a new data directory",
+			ErrUnsupportedFormat, version, formatVersion)
 	}
-	defer file.Close()
+	return nil
+}
 
+// ReadTableClusterMetadata reads the metadata file of dir. The metadata of another format version fails with
+// ErrUnsupportedFormat.
+func ReadTableClusterMetadata(dir string) (TableClusterMetadata, error) {
 	clusterMetadata := TableClusterMetadata{}
-	decoder := msgpack.NewDecoder(file)
-	err = decoder.Decode(&clusterMetadata)
+	file, err := os.Open(filepath.Join(dir, MetadataFileName))
 	if err != nil {
-		log.Printf("[ERROR] Error decoding file: %v\n", err)
-		return
+		return clusterMetadata, fmt.Errorf("%w: open metadata file: %w", ErrIO, err)
 	}
+	defer file.Close()
 
-	t.ftablesLock = make([]sync.RWMutex, len(clusterMetadata.FTableMetadata))
-	t.ftables = make([][]*FTable, len(clusterMetadata.FTableMetadata))
-	for i, _ := range clusterMetadata.FTableMetadata {
-		t.ftables[i] = make([]*FTable, len(clusterMetadata.FTableMetadata[i]))
-		t.ftablesLock[i] = sync.RWMutex{}
-		for j, _ := range clusterMetadata.FTableMetadata[i] {
-			dataFile, _ := os.Open(clusterMetadata.FTableMetadata[i][j].FileName)
-			log.Printf("[INFO] Loading table metadata: %v\n", dataFile.Name())
-			t.ftables[i][j] = &FTable{
-				cfg:         t.cfg,
-				nRecords:    clusterMetadata.FTableMetadata[i][j].NRecords,
-				sizeInBytes: clusterMetadata.FTableMetadata[i][j].SizeInBytes,
-				minKey:      clusterMetadata.FTableMetadata[i][j].MinKey,
-				maxKey:      clusterMetadata.FTableMetadata[i][j].MaxKey,
-				dataFile:    dataFile,
-				bloomFilter: &clusterMetadata.FTableMetadata[i][j].BloomFilter,
-				sparseIndex: clusterMetadata.FTableMetadata[i][j].SparseIndex,
-			}
+	if err = msgpack.NewDecoder(file).Decode(&clusterMetadata); err != nil {
+		return clusterMetadata, fmt.Errorf("%w: decode metadata file: %w", ErrCorruption, err)
+	}
+	return clusterMetadata, checkFormatVersion(clusterMetadata.FormatVersion)
+}
+
+// LoadTableClusterMetadata replaces the in-memory table layout with the one stored in master-metadata. The current
+// layout is kept untouched if any of the metadata or data files can't be read, or if the keys are ordered by another
+// comparator than Config.Comparator. The memtables found in the memtable
+// backup and not flushed yet are then restored.
+func (t *TableCluster) LoadTableClusterMetadata() error {
+	clusterMetadata, err := ReadTableClusterMetadata(t.cfg.DataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		// nothing was flushed before the previous run stopped, the backed up memtables are all there is
+		if _, statErr := os.Stat(filepath.Join(t.cfg.DataDir, MemTableBackupFileName)); statErr == nil {
+			return t.restoreMemTableBackup()
 		}
 	}
+	if err != nil {
+		return err
+	}
+	if err = t.cfg.checkComparator(clusterMetadata.Comparator); err != nil {
+		return err
+	}
+
+	ftables, err := t.openFTables(clusterMetadata)
+	if err != nil {
+		return err
+	}
+	if err = t.valueLog.load(clusterMetadata.ValueLogSegments); err != nil {
+		closeFTables(ftables)
+		return err
+	}
+
+	for i := range t.ftablesLock {
+		t.ftablesLock[i].Lock()
+	}
+	t.ftables = ftables
+	for i := range t.ftablesLock {
+		t.ftablesLock[i].Unlock()
+	}
+	t.flushedMemTableID.Store(clusterMetadata.FlushedMemTableID)
+	return t.restoreMemTableBackup()
 }
@@ -0,0 +1,176 @@
+package keynest
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"sync"
+)
+
+// ValueCodec turns the values into the bytes stored in the data files. The codec of a table is recorded in its
+// metadata, so the tables written before Config.ValueCodec changed are still decoded with their own codec.
+type ValueCodec interface {
+	// Name identifies the codec in the table metadata, it must never change
+	Name() string
+	// Accepts tells whether values of the type can be encoded, it's checked before a value is written
+	Accepts(valueType ValueType) bool
+	Encode(val any) ([]byte, error)
+	// Decode returns the value in the Go type of valueType. data must not be retained, unless the codec documents
+	// that it doesn't copy.
+	Decode(data []byte, valueType ValueType) (any, error)
+}
+
+var (
+	valueCodecs     = map[string]ValueCodec{}
+	valueCodecsLock sync.RWMutex
+)
+
+func init() {
+	for _, codec := range []ValueCodec{MsgpackCodec{}, JSONCodec{}, GobCodec{}, RawCodec{}} {
+		RegisterValueCodec(codec)
+	}
+	// the JSON values nest these types in interface values
+	gob.Register(map[string]any{})
+	gob.Register([]any{})
+}
+
+// RegisterValueCodec makes a custom codec known, so the tables it wrote can be opened. The built-in codecs are
+// always registered.
+func RegisterValueCodec(codec ValueCodec) {
+	valueCodecsLock.Lock()
+	defer valueCodecsLock.Unlock()
+	valueCodecs[codec.Name()] = codec
+}
+
+// ValueCodecByName returns a registered codec. An empty name is msgpack, the codec of the tables written before the
+// codecs were recorded.
+func ValueCodecByName(name string) (ValueCodec, error) {
+	if name == "" {
+		return MsgpackCodec{}, nil
+	}
+	valueCodecsLock.RLock()
+	defer valueCodecsLock.RUnlock()
+	codec, ok := valueCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown value codec %q, it must be registered with RegisterValueCodec", name)
+	}
+	return codec, nil
+}
+
+// valueCodec returns Config.ValueCodec, msgpack when it isn't set.
+func (c *Config) valueCodec() ValueCodec {
+	if c == nil || c.ValueCodec == nil {
+		return MsgpackCodec{}
+	}
+	return c.ValueCodec
+}
+
+// MsgpackCodec is the default codec.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string { return "msgpack" }
+
+func (MsgpackCodec) Accepts(ValueType) bool { return true }
+
+func (MsgpackCodec) Encode(val any) ([]byte, error) {
+	return msgpack.Marshal(val)
+}
+
+func (MsgpackCodec) Decode(data []byte, valueType ValueType) (any, error) {
+	var val any
+	if err := msgpack.Unmarshal(data, &val); err != nil {
+		return nil, err
+	}
+	return normalizeValue(valueType, val), nil
+}
+
+// JSONCodec stores the values as JSON, which keeps the data files readable by other tools. Raw bytes are stored as
+// base64 strings.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string { return "json" }
+
+func (JSONCodec) Accepts(ValueType) bool { return true }
+
+func (JSONCodec) Encode(val any) ([]byte, error) {
+	return json.Marshal(val)
+}
+
+func (JSONCodec) Decode(data []byte, valueType ValueType) (any, error) {
+	var err error
+	switch valueType {
+	case ValueTypeString:
+		var val string
+		err = json.Unmarshal(data, &val)
+		return val, err
+	case ValueTypeInt32:
+		var val int32
+		err = json.Unmarshal(data, &val)
+		return val, err
+	case ValueTypeInt64:
+		var val int64
+		err = json.Unmarshal(data, &val)
+		return val, err
+	case ValueTypeBytes:
+		var val []byte
+		err = json.Unmarshal(data, &val)
+		return val, err
+	}
+	var val any
+	err = json.Unmarshal(data, &val)
+	return val, err
+}
+
+// GobCodec stores the values with encoding/gob. A custom Go type held in a JSON value must be registered with
+// gob.Register.
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Accepts(ValueType) bool { return true }
+
+func (GobCodec) Encode(val any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	// encoding a pointer to the interface records the concrete type, which Decode needs
+	if err := gob.NewEncoder(buf).Encode(&val); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, valueType ValueType) (any, error) {
+	var val any
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&val); err != nil {
+		return nil, err
+	}
+	return normalizeValue(valueType, val), nil
+}
+
+// RawCodec stores []byte and string values as they are, without any encoding. Decode doesn't copy, the returned
+// []byte shares the buffer read from the data file, which is never reused.
+type RawCodec struct{}
+
+func (RawCodec) Name() string { return "raw" }
+
+func (RawCodec) Accepts(valueType ValueType) bool {
+	return valueType == ValueTypeBytes || valueType == ValueTypeString
+}
+
+func (RawCodec) Encode(val any) ([]byte, error) {
+	switch v := val.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("%w: the raw codec only stores []byte and string values, got %T", ErrUnsupportedContentType, val)
+}
+
+func (RawCodec) Decode(data []byte, valueType ValueType) (any, error) {
+	if valueType == ValueTypeString {
+		return string(data), nil
+	}
+	return data, nil
+}
@@ -0,0 +1,68 @@
+package keynest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestValueCodecsRoundTrip(t *testing.T) {
+	values := []any{"text", int32(-7), int64(1) << 50, []byte{0, 1, 0xff}, map[string]any{"a": []any{"b", true}}}
+	for _, codec := range []ValueCodec{MsgpackCodec{}, JSONCodec{}, GobCodec{}, RawCodec{}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			for _, val := range values {
+				valueType := ValueTypeOf(val)
+				if !codec.Accepts(valueType) {
+					continue
+				}
+				data, err := codec.Encode(val)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := codec.Decode(data, valueType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, val) {
+					t.Fatalf("decoded %#v, want %#v", got, val)
+				}
+			}
+		})
+	}
+}
+
+func TestTablesKeepTheirValueCodec(t *testing.T) {
+	dir := t.TempDir()
+	tc := newTestTableCluster(t, dir)
+	for i, codec := range []ValueCodec{MsgpackCodec{}, JSONCodec{}, GobCodec{}, RawCodec{}} {
+		tc.cfg.ValueCodec = codec
+		for j := 0; j < 10; j++ {
+			if err := tc.Put(fmt.Sprintf("key-%02d-%d", j, i), []byte(codec.Name())); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.Put("int", int64(1)); !errors.Is(err, ErrUnsupportedContentType) {
+		t.Fatalf("Put of an int64 with the raw codec = %v, want ErrUnsupportedContentType", err)
+	}
+
+	// the compaction reads the four codecs and writes the raw one
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := newTestTableCluster(t, dir)
+	if err := reopened.LoadTableClusterMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	for i, codec := range []string{"msgpack", "json", "gob", "raw"} {
+		key := fmt.Sprintf("key-05-%d", i)
+		val, ok, err := reopened.Get(key)
+		if err != nil || !ok || string(val.([]byte)) != codec {
+			t.Fatalf("Get(%s) = %v, %v, %v, want %s", key, val, ok, err, codec)
+		}
+	}
+}
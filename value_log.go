@@ -0,0 +1,395 @@
+package keynest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// The value log keeps the large values out of the tables, like WiscKey: a flush moves every value encoded in
+// Config.ValueLogThreshold bytes or more to a new value log segment, and the table only holds a ValuePointer, so the
+// compactions rewrite the pointer instead of the value. Like a data file, a segment is never modified once written.
+// The values still referenced by the tables are moved out of the mostly dead segments by CollectValueLog.
+
+// valueLogSegmentPrefix and valueLogSegmentSuffix surround the creation time of a segment in its file name.
+const (
+	valueLogSegmentPrefix = "vlog-"
+	valueLogSegmentSuffix = ".log"
+)
+
+// sizeOfValueLogEntryHeader is the size of the key size, value size, value type and codec name size of an entry,
+// which are followed by the codec name, the key and the encoded value.
+const sizeOfValueLogEntryHeader = 2 + 4 + 1 + 1
+
+// errValueLogSegmentRemoved is returned when a pointer refers to a segment removed by CollectValueLog. It only
+// happens to a record read just before a newer one shadowed it, the lookup is retried.
+var errValueLogSegmentRemoved = fmt.Errorf("%w: value log segment removed", ErrCorruption)
+
+func valueLogSegmentName(id int64) string {
+	return fmt.Sprintf("%s%d%s", valueLogSegmentPrefix, id, valueLogSegmentSuffix)
+}
+
+// parseValueLogSegmentName returns the id of a segment named by valueLogSegmentName.
+func parseValueLogSegmentName(name string) (int64, bool) {
+	var id int64
+	if _, err := fmt.Sscanf(name, valueLogSegmentPrefix+"%d"+valueLogSegmentSuffix, &id); err != nil {
+		return 0, false
+	}
+	return id, name == valueLogSegmentName(id)
+}
+
+// ValuePointer locates the entry of a value in the value log.
+type ValuePointer struct {
+	Segment int64
+	Offset  int64
+	// Size is the size of the whole entry
+	Size uint32
+}
+
+var sizeOfValuePointer = binary.Size(ValuePointer{})
+
+func (p ValuePointer) marshal() []byte {
+	b, _ := binary.Append(make([]byte, 0, sizeOfValuePointer), binary.LittleEndian, p)
+	return b
+}
+
+func unmarshalValuePointer(b []byte) (ValuePointer, error) {
+	p := ValuePointer{}
+	if len(b) != sizeOfValuePointer {
+		return p, fmt.Errorf("value pointer of %d bytes, want %d", len(b), sizeOfValuePointer)
+	}
+	_, err := binary.Decode(b, binary.LittleEndian, &p)
+	return p, err
+}
+
+type ValueLogSegmentMetadata struct {
+	// FileName is the name of the segment file relative to the data directory
+	FileName    string
+	SizeInBytes int64
+}
+
+type valueLogSegment struct {
+	file        *os.File
+	sizeInBytes int64
+}
+
+// valueLogEntry is a value read back from a segment, along with the key it was written for.
+type valueLogEntry struct {
+	pointer   ValuePointer
+	key       string
+	valueType ValueType
+	codec     string
+	val       []byte
+}
+
+// ValueLog holds the segments of a data directory, indexed by id.
+type ValueLog struct {
+	dir      string
+	lock     sync.RWMutex
+	segments map[int64]*valueLogSegment
+}
+
+func newValueLog(dir string) *ValueLog {
+	return &ValueLog{
+		dir:      dir,
+		segments: make(map[int64]*valueLogSegment),
+	}
+}
+
+// load replaces the segments with the ones listed in the metadata. The current segments are kept if one of them
+// can't be opened.
+func (v *ValueLog) load(segments []ValueLogSegmentMetadata) error {
+	opened := make(map[int64]*valueLogSegment, len(segments))
+	for _, metadata := range segments {
+		id, ok := parseValueLogSegmentName(metadata.FileName)
+		var file *os.File
+		var err error
+		if !ok {
+			err = fmt.Errorf("%w: %s is not named like a value log segment", ErrCorruption, metadata.FileName)
+		} else if file, err = os.Open(filepath.Join(v.dir, metadata.FileName)); err != nil {
+			err = fmt.Errorf("%w: open value log segment: %w", ErrIO, err)
+		}
+		if err != nil {
+			for _, segment := range opened {
+				segment.file.Close()
+			}
+			return err
+		}
+		opened[id] = &valueLogSegment{file: file, sizeInBytes: metadata.SizeInBytes}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, segment := range v.segments {
+		segment.file.Close()
+	}
+	v.segments = opened
+	return nil
+}
+
+// metadata lists the segments from the oldest to the newest.
+func (v *ValueLog) metadata() []ValueLogSegmentMetadata {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	segments := make([]ValueLogSegmentMetadata, 0, len(v.segments))
+	for _, id := range slices.Sorted(maps.Keys(v.segments)) {
+		segments = append(segments, ValueLogSegmentMetadata{
+			FileName:    valueLogSegmentName(id),
+			SizeInBytes: v.segments[id].sizeInBytes,
+		})
+	}
+	return segments
+}
+
+// writeSegment moves the values encoded in threshold bytes or more to a new segment, their records then hold a
+// ValuePointer. The segment is synced before it's returned, so it's on disk before any table points at it. No
+// segment is created when no value is large enough, the returned id is then 0.
+func (v *ValueLog) writeSegment(records []*Record, codec ValueCodec, threshold int, limiter *RateLimiter) (int64, error) {
+	var file *os.File
+	var writer *bufio.Writer
+	id := int64(0)
+	offset := int64(0)
+	abort := func(err error) (int64, error) {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		return 0, err
+	}
+
+	for _, record := range records {
+		if record.TombStone || record.Separated {
+			continue
+		}
+		// a string or a []byte is barely larger once encoded, it's only encoded when it may reach the threshold
+		switch val := record.Val.(type) {
+		case string:
+			if len(val) < threshold {
+				continue
+			}
+		case []byte:
+			if len(val) < threshold {
+				continue
+			}
+		}
+		val, err := codec.Encode(record.Val)
+		if err != nil {
+			return abort(fmt.Errorf("marshal record %q: %w", record.Key, err))
+		}
+		if len(val) < threshold {
+			continue
+		}
+		if len(record.Key) > MaxKeySizeLimit || len(val) > maxRecordValueSize-sizeOfValueLogEntryHeader-len(codec.Name())-len(record.Key) {
+			return abort(&SizeLimitError{Err: ErrValueTooLarge, Size: int64(len(val)), Limit: maxRecordValueSize})
+		}
+		if file == nil {
+			id = nextFileTimestamp()
+			if file, err = os.OpenFile(filepath.Join(v.dir, valueLogSegmentName(id)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+				return 0, fmt.Errorf("%w: create value log segment: %w", ErrIO, err)
+			}
+			writer = bufio.NewWriter(file)
+		}
+
+		if record.ValueType == ValueTypeUnknown {
+			record.ValueType = ValueTypeOf(record.Val)
+		}
+		entry := make([]byte, 0, sizeOfValueLogEntryHeader+len(codec.Name())+len(record.Key)+len(val))
+		entry = binary.LittleEndian.AppendUint16(entry, uint16(len(record.Key)))
+		entry = binary.LittleEndian.AppendUint32(entry, uint32(len(val)))
+		entry = append(entry, byte(record.ValueType), byte(len(codec.Name())))
+		entry = append(entry, codec.Name()...)
+		entry = append(entry, record.Key...)
+		entry = append(entry, val...)
+		limiter.Wait(len(entry))
+		if _, err = writer.Write(entry); err != nil {
+			return abort(fmt.Errorf("%w: write value log segment: %w", ErrIO, err))
+		}
+
+		record.Val = ValuePointer{Segment: id, Offset: offset, Size: uint32(len(entry))}
+		record.Separated = true
+		offset += int64(len(entry))
+	}
+	if file == nil {
+		return 0, nil
+	}
+
+	err := writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return abort(fmt.Errorf("%w: write value log segment: %w", ErrIO, err))
+	}
+	readFile, err := os.Open(file.Name())
+	if err != nil {
+		os.Remove(file.Name())
+		return 0, fmt.Errorf("%w: open value log segment: %w", ErrIO, err)
+	}
+	v.lock.Lock()
+	v.segments[id] = &valueLogSegment{file: readFile, sizeInBytes: offset}
+	v.lock.Unlock()
+	return id, nil
+}
+
+// read returns the value a pointer refers to.
+func (v *ValueLog) read(ptr ValuePointer) (any, ValueType, error) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return readValue(v.segments, ptr)
+}
+
+// snapshot returns the segments in use, their files stay open as long as they are pinned, see filePins.
+func (v *ValueLog) snapshot() map[int64]*valueLogSegment {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return maps.Clone(v.segments)
+}
+
+// readValue returns the value a pointer refers to within segments.
+func readValue(segments map[int64]*valueLogSegment, ptr ValuePointer) (any, ValueType, error) {
+	segment, ok := segments[ptr.Segment]
+	if !ok {
+		return nil, ValueTypeUnknown, fmt.Errorf("%w: %s", errValueLogSegmentRemoved, valueLogSegmentName(ptr.Segment))
+	}
+	if ptr.Offset+int64(ptr.Size) > segment.sizeInBytes {
+		return nil, ValueTypeUnknown, fmt.Errorf("%w: pointer to offset %d of %s, past its %d bytes", ErrCorruption, ptr.Offset, segment.file.Name(), segment.sizeInBytes)
+	}
+	b := make([]byte, ptr.Size)
+	if _, err := segment.file.ReadAt(b, ptr.Offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ValueTypeUnknown, fmt.Errorf("%w: unexpected end of %s at offset %d", ErrCorruption, segment.file.Name(), ptr.Offset)
+		}
+		return nil, ValueTypeUnknown, fmt.Errorf("%w: read %s at offset %d: %w", ErrIO, segment.file.Name(), ptr.Offset, err)
+	}
+	entry, err := decodeValueLogEntry(bytes.NewReader(b))
+	if err == nil && int(ptr.Size) != entrySize(entry) {
+		err = fmt.Errorf("entry of %d bytes, the pointer claims %d", entrySize(entry), ptr.Size)
+	}
+	if err != nil {
+		return nil, ValueTypeUnknown, fmt.Errorf("%w: decode value log entry of %s at offset %d: %w", ErrCorruption, segment.file.Name(), ptr.Offset, err)
+	}
+	val, err := entry.decode()
+	if err != nil {
+		return nil, ValueTypeUnknown, fmt.Errorf("%w: decode value of %q in %s: %w", ErrCorruption, entry.key, segment.file.Name(), err)
+	}
+	return val, entry.valueType, nil
+}
+
+// scanSegment calls fn with every entry of a segment, in the order they were written.
+func (v *ValueLog) scanSegment(id int64, fn func(entry valueLogEntry) error) error {
+	v.lock.RLock()
+	segment, ok := v.segments[id]
+	v.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", errValueLogSegmentRemoved, valueLogSegmentName(id))
+	}
+	reader := bufio.NewReader(io.NewSectionReader(segment.file, 0, segment.sizeInBytes))
+	for offset := int64(0); offset < segment.sizeInBytes; {
+		entry, err := decodeValueLogEntry(reader)
+		if err != nil {
+			return fmt.Errorf("%w: decode value log entry of %s at offset %d: %w", ErrCorruption, segment.file.Name(), offset, err)
+		}
+		entry.pointer = ValuePointer{Segment: id, Offset: offset, Size: uint32(entrySize(entry))}
+		if err = fn(entry); err != nil {
+			return err
+		}
+		offset += int64(entrySize(entry))
+	}
+	return nil
+}
+
+// remove forgets the segments and returns them, their files are left open for the caller to close.
+func (v *ValueLog) remove(ids []int64) []*valueLogSegment {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	removed := make([]*valueLogSegment, 0, len(ids))
+	for _, id := range ids {
+		if segment, ok := v.segments[id]; ok {
+			removed = append(removed, segment)
+			delete(v.segments, id)
+		}
+	}
+	return removed
+}
+
+func (v *ValueLog) close() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, segment := range v.segments {
+		segment.file.Close()
+	}
+}
+
+// repairValueLogSegment truncates a segment after its last complete entry, a crash while it was written leaves an
+// incomplete one behind. It returns the size of the segment and the number of truncated bytes.
+func repairValueLogSegment(path string) (int64, int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: open value log segment: %w", ErrIO, err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: stat value log segment: %w", ErrIO, err)
+	}
+	reader := bufio.NewReader(file)
+	size := int64(0)
+	for size < stat.Size() {
+		entry, err := decodeValueLogEntry(reader)
+		if err != nil {
+			break
+		}
+		size += int64(entrySize(entry))
+	}
+	if size == stat.Size() {
+		return size, 0, nil
+	}
+	if err = file.Truncate(size); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: truncate value log segment: %w", ErrIO, err)
+	}
+	return size, stat.Size() - size, nil
+}
+
+func decodeValueLogEntry(r io.Reader) (valueLogEntry, error) {
+	header := make([]byte, sizeOfValueLogEntryHeader)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return valueLogEntry{}, err
+	}
+	keySize := binary.LittleEndian.Uint16(header)
+	valSize := binary.LittleEndian.Uint32(header[2:])
+	entry := valueLogEntry{valueType: ValueType(header[6])}
+	b := make([]byte, int(header[7])+int(keySize)+int(valSize))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return valueLogEntry{}, err
+	}
+	entry.codec = string(b[:header[7]])
+	entry.key = string(b[header[7] : int(header[7])+int(keySize)])
+	entry.val = b[int(header[7])+int(keySize):]
+	return entry, nil
+}
+
+func entrySize(entry valueLogEntry) int {
+	return sizeOfValueLogEntryHeader + len(entry.codec) + len(entry.key) + len(entry.val)
+}
+
+func (e valueLogEntry) decode() (any, error) {
+	codec, err := ValueCodecByName(e.codec)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(e.val, e.valueType)
+}
@@ -0,0 +1,184 @@
+package keynest
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultValueLogGCDiscardRatio = 0.5
+
+type ValueLogGCReport struct {
+	// Segments is the number of segments examined
+	Segments int `json:"segments"`
+	// Collected are the file names of the removed segments
+	Collected       []string `json:"collected"`
+	RewrittenValues int      `json:"rewritten_values"`
+	RewrittenBytes  int64    `json:"rewritten_bytes"`
+	ReclaimedBytes  int64    `json:"reclaimed_bytes"`
+}
+
+// separateValues moves the large values of records to a new value log segment, see Config.ValueLogThreshold. It
+// returns the id of the segment, 0 when none was written. flushLock must be held until the table of the records is
+// installed.
+func (t *TableCluster) separateValues(records []*Record) (int64, error) {
+	if t.cfg.ValueLogThreshold <= 0 {
+		return 0, nil
+	}
+	return t.valueLog.writeSegment(records, t.cfg.valueCodec(), t.cfg.ValueLogThreshold, t.ioLimiter)
+}
+
+// dropValueLogSegment removes the segment written for a table that couldn't be built.
+func (t *TableCluster) dropValueLogSegment(id int64) {
+	if id == 0 {
+		return
+	}
+	for _, segment := range t.valueLog.remove([]int64{id}) {
+		segment.file.Close()
+	}
+	os.Remove(filepath.Join(t.cfg.DataDir, valueLogSegmentName(id)))
+}
+
+func (t *TableCluster) runValueLogGCJob() {
+	if t.cfg.ValueLogGCInterval <= 0 {
+		return
+	}
+	discardRatio := t.cfg.ValueLogGCDiscardRatio
+	if discardRatio <= 0 {
+		discardRatio = defaultValueLogGCDiscardRatio
+	}
+	t.jobs.Add(1)
+	go func() {
+		defer t.jobs.Done()
+		ticker := time.NewTicker(t.cfg.ValueLogGCInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+				if _, err := t.CollectValueLog(discardRatio); err != nil && !errors.Is(err, ErrClosed) {
+					log.Printf("[ERROR] Value log collection job failed: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// CollectValueLog reclaims the value log segments whose share of dead bytes, the values no table points at anymore,
+// is at least discardRatio. The live values of such a segment are written again through the memtable, which is
+// flushed to move them to a new segment, and the segment is then removed once no scan, backup or checkpoint reads
+// it. A discardRatio of 1 only removes the segments without any live value.
+func (t *TableCluster) CollectValueLog(discardRatio float64) (ValueLogGCReport, error) {
+	report := ValueLogGCReport{}
+	if t.closed.Load() {
+		return report, ErrClosed
+	}
+	t.valueLogGCLock.Lock()
+	defer t.valueLogGCLock.Unlock()
+
+	collected := make([]int64, 0)
+	for _, metadata := range t.valueLog.metadata() {
+		// Close waits for the collection job, which gives up at the next segment
+		if t.closed.Load() {
+			return report, ErrClosed
+		}
+		id, _ := parseValueLogSegmentName(metadata.FileName)
+		report.Segments++
+
+		// a first pass measures the live bytes without blocking anything
+		live := int64(0)
+		err := t.valueLog.scanSegment(id, func(entry valueLogEntry) error {
+			res, _, err := t.lookup(entry.key)
+			if err == nil && isLiveValueLogEntry(res, entry) {
+				live += int64(entry.pointer.Size)
+			}
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+		if metadata.SizeInBytes > 0 && float64(metadata.SizeInBytes-live)/float64(metadata.SizeInBytes) < discardRatio {
+			continue
+		}
+
+		// no flush may add a table pointing at the segment while its live values are written again
+		t.flushLock.Lock()
+		err = t.valueLog.scanSegment(id, func(entry valueLogEntry) error {
+			return t.rewriteValueLogEntry(entry, &report)
+		})
+		t.flushLock.Unlock()
+		if err != nil {
+			return report, err
+		}
+		collected = append(collected, id)
+		report.ReclaimedBytes += metadata.SizeInBytes
+	}
+	if len(collected) == 0 {
+		return report, nil
+	}
+
+	// the rewritten values must be in the tables before the segments are removed
+	if err := t.flushMemTableToFTable(); err != nil {
+		return report, err
+	}
+	var segments []*valueLogSegment
+	t.retireFiles(func() {
+		segments = t.valueLog.remove(collected)
+	})
+	// the files are kept when the metadata still listing them can't be replaced, and they are only removed once the
+	// scans, backups and checkpoints reading them are over
+	err := t.SnapshotTableClusterMetadata()
+	t.destroyUnpinned(func() {
+		for _, segment := range segments {
+			segment.file.Close()
+			if err == nil {
+				if err := os.Remove(segment.file.Name()); err != nil {
+					log.Printf("[ERROR] Remove value log segment %s: %v\n", segment.file.Name(), err)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, id := range collected {
+		report.Collected = append(report.Collected, valueLogSegmentName(id))
+	}
+	log.Printf("[INFO] %d value log segments collected, %d values rewritten\n", len(collected), report.RewrittenValues)
+	return report, nil
+}
+
+// rewriteValueLogEntry puts the value of the entry back in the memtable if the newest record of its key still points
+// at it. The memtable stays locked meanwhile, so a concurrent write of the key is never overwritten.
+func (t *TableCluster) rewriteValueLogEntry(entry valueLogEntry, report *ValueLogGCReport) error {
+	t.memTableLock.Lock()
+	defer t.memTableLock.Unlock()
+	if t.lookupMemTables(entry.key).found {
+		return nil
+	}
+	res, _, err := t.lookupTables(entry.key)
+	if err != nil || !isLiveValueLogEntry(res, entry) {
+		return err
+	}
+	val, err := entry.decode()
+	if err != nil {
+		return fmt.Errorf("%w: decode value of %q in %s: %w", ErrCorruption, entry.key, valueLogSegmentName(entry.pointer.Segment), err)
+	}
+	t.memtable.Put(entry.key, val, entry.valueType)
+	report.RewrittenValues++
+	report.RewrittenBytes += int64(len(entry.val))
+	return nil
+}
+
+// isLiveValueLogEntry tells whether the newest record of the key of the entry points at it.
+func isLiveValueLogEntry(res lookupResult, entry valueLogEntry) bool {
+	if !res.found || res.tombstone || !res.separated {
+		return false
+	}
+	ptr, ok := res.val.(ValuePointer)
+	return ok && ptr == entry.pointer
+}
@@ -0,0 +1,202 @@
+package keynest
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValueLogSeparatesAndCollects(t *testing.T) {
+	dir := t.TempDir()
+	tc := newTestTableCluster(t, dir)
+	tc.cfg.ValueLogThreshold = 64
+
+	large := func(i, round int) []byte {
+		return bytes.Repeat([]byte{byte(i + round)}, 100+i)
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 40; i++ {
+			if err := tc.Put(fmt.Sprintf("key-%02d", i), large(i, round)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.Put(fmt.Sprintf("small-%02d", i), int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tc.valueLog.metadata()); n != 2 {
+		t.Fatalf("%d value log segments, want 2", n)
+	}
+
+	check := func(tc *TableCluster) {
+		t.Helper()
+		for i := 0; i < 40; i++ {
+			val, ok, err := tc.Get(fmt.Sprintf("key-%02d", i))
+			if !ok || err != nil || !bytes.Equal(val.([]byte), large(i, 1)) {
+				t.Fatalf("Get(key-%02d) = %v, %v", i, ok, err)
+			}
+		}
+		n := 0
+		err := tc.Scan("key-", "key-~", func(key string, val any, _ ValueType) bool {
+			if !bytes.Equal(val.([]byte), large(n, 1)) {
+				t.Fatalf("Scan gave a wrong value for %s", key)
+			}
+			n++
+			return true
+		})
+		if err != nil || n != 40 {
+			t.Fatalf("Scan gave %d values: %v", n, err)
+		}
+		if val, ok, err := tc.Get("small-07"); !ok || err != nil || val != int64(7) {
+			t.Fatalf("Get(small-07) = %v, %v, %v", val, ok, err)
+		}
+	}
+	check(tc)
+
+	// the first segment only holds overwritten values, the second one is entirely live
+	first := tc.valueLog.metadata()[0].FileName
+	report, err := tc.CollectValueLog(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collected) != 1 || report.Collected[0] != first || report.RewrittenValues != 0 {
+		t.Fatalf("CollectValueLog = %+v, want %s collected without rewrite", report, first)
+	}
+	if _, err = os.Stat(filepath.Join(dir, first)); !os.IsNotExist(err) {
+		t.Fatalf("%s is still on disk: %v", first, err)
+	}
+	check(tc)
+
+	// every live value is rewritten to a new segment
+	second := tc.valueLog.metadata()[0].FileName
+	if report, err = tc.CollectValueLog(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collected) != 1 || report.Collected[0] != second || report.RewrittenValues != 40 {
+		t.Fatalf("CollectValueLog = %+v, want %s collected with 40 values rewritten", report, second)
+	}
+	check(tc)
+	if err = tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newTestTableCluster(t, dir)
+	if err = reopened.LoadTableClusterMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	check(reopened)
+	if report, err := reopened.Verify(); err != nil || !report.OK() {
+		t.Fatalf("Verify = %+v, %v", report, err)
+	}
+}
+
+func TestValueLogCollectionRacesWithWritesAndCheckpoints(t *testing.T) {
+	tc := newTestTableCluster(t, t.TempDir())
+	tc.cfg.ValueLogThreshold = 64
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	background := func(fn func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := fn(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	background(func(int) error {
+		_, err := tc.CollectValueLog(0.1)
+		return err
+	})
+	checkpoints := t.TempDir()
+	background(func(i int) error {
+		return tc.Checkpoint(filepath.Join(checkpoints, fmt.Sprint(i)))
+	})
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 30; i++ {
+			if err := tc.Put(fmt.Sprintf("key-%02d", i), bytes.Repeat([]byte{byte(round)}, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.TriggerCompaction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		val, ok, err := tc.Get(fmt.Sprintf("key-%02d", i))
+		if err != nil || !ok || !bytes.Equal(val.([]byte), bytes.Repeat([]byte{4}, 100)) {
+			t.Fatalf("Get(key-%02d) = %v, %v, %v", i, val, ok, err)
+		}
+	}
+}
+
+func TestCloseWaitsForBackgroundJobs(t *testing.T) {
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	for i := 0; i < 20; i++ {
+		tc := NewTableCluster(&Config{
+			DataDir:                t.TempDir(),
+			IndexSkipNum:           4,
+			WriteBufferSize:        1024,
+			FalsePositiveRate:      0.01,
+			Lvl0MaxTableNum:        2,
+			MemMaxNum:              10,
+			CompactionInterval:     time.Millisecond,
+			MemFlushInterval:       time.Millisecond,
+			MemBackupInterval:      time.Millisecond,
+			ValueLogThreshold:      64,
+			ValueLogGCInterval:     time.Millisecond,
+			ValueLogGCDiscardRatio: 0.01,
+		})
+		for j := 0; j < 100; j++ {
+			if err := tc.Put(fmt.Sprintf("key-%02d", j%30), bytes.Repeat([]byte{byte(j)}, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// let the jobs flush, compact and collect before closing in the middle of them
+		time.Sleep(time.Duration(i) * time.Millisecond)
+		if err := tc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a job still running after Close would fail on the closed files
+	time.Sleep(20 * time.Millisecond)
+	log.SetOutput(os.Stderr)
+	if strings.Contains(logs.String(), "[ERROR]") {
+		t.Fatalf("background jobs failed after Close:\n%s", logs)
+	}
+}
@@ -0,0 +1,173 @@
+package keynest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// The content types of the HTTP API, they tell how a value is represented as text.
+const (
+	ContentTypeString = "plain-text/string"
+	ContentTypeInt32  = "plain-text/int32"
+	ContentTypeInt64  = "plain-text/int64"
+	ContentTypeJSON   = "application/json"
+	ContentTypeBytes  = "application/octet-stream"
+)
+
+// ValueType is the type of a value, stored along with every record so a value is read back with the Go type and the
+// content type it was written with.
+type ValueType uint8
+
+const (
+	// ValueTypeUnknown is the type of tombstones, a value of unknown type is served as JSON
+	ValueTypeUnknown ValueType = iota
+	ValueTypeString
+	ValueTypeInt32
+	ValueTypeInt64
+	ValueTypeJSON
+	ValueTypeBytes
+)
+
+func (v ValueType) ContentType() string {
+	switch v {
+	case ValueTypeString:
+		return ContentTypeString
+	case ValueTypeInt32:
+		return ContentTypeInt32
+	case ValueTypeInt64:
+		return ContentTypeInt64
+	case ValueTypeBytes:
+		return ContentTypeBytes
+	default:
+		return ContentTypeJSON
+	}
+}
+
+func (v ValueType) String() string {
+	return v.ContentType()
+}
+
+// ParseContentType returns the value type of a content type of the HTTP API.
+func ParseContentType(contentType string) (ValueType, error) {
+	switch contentType {
+	case ContentTypeString:
+		return ValueTypeString, nil
+	case ContentTypeInt32:
+		return ValueTypeInt32, nil
+	case ContentTypeInt64:
+		return ValueTypeInt64, nil
+	case ContentTypeJSON:
+		return ValueTypeJSON, nil
+	case ContentTypeBytes:
+		return ValueTypeBytes, nil
+	}
+	return ValueTypeUnknown, fmt.Errorf("%w: %q", ErrUnsupportedContentType, contentType)
+}
+
+// ValueTypeOf infers the value type from the Go type of a value. Any value that is neither a string, an int32, an
+// int64 nor a []byte is a JSON value.
+func ValueTypeOf(val any) ValueType {
+	switch val.(type) {
+	case string:
+		return ValueTypeString
+	case int32:
+		return ValueTypeInt32
+	case int64:
+		return ValueTypeInt64
+	case []byte:
+		return ValueTypeBytes
+	default:
+		return ValueTypeJSON
+	}
+}
+
+// normalizeValue converts a value decoded by msgpack, which picks the smallest fitting Go type, back to the Go type
+// of its value type.
+func normalizeValue(valueType ValueType, val any) any {
+	switch valueType {
+	case ValueTypeInt32, ValueTypeInt64:
+		var n int64
+		switch v := val.(type) {
+		case int8:
+			n = int64(v)
+		case int16:
+			n = int64(v)
+		case int32:
+			n = int64(v)
+		case int64:
+			n = v
+		case uint8:
+			n = int64(v)
+		case uint16:
+			n = int64(v)
+		case uint32:
+			n = int64(v)
+		case uint64:
+			n = int64(v)
+		default:
+			return val
+		}
+		if valueType == ValueTypeInt32 {
+			return int32(n)
+		}
+		return n
+	case ValueTypeBytes:
+		if s, ok := val.(string); ok {
+			return []byte(s)
+		}
+	}
+	return val
+}
+
+// EncodeValue returns the text representation of a value, which is the body served by the HTTP API.
+func EncodeValue(valueType ValueType, val any) ([]byte, error) {
+	switch v := val.(type) {
+	case string:
+		if valueType == ValueTypeString {
+			return []byte(v), nil
+		}
+	case int32:
+		if valueType == ValueTypeInt32 {
+			return strconv.AppendInt(nil, int64(v), 10), nil
+		}
+	case int64:
+		if valueType == ValueTypeInt64 {
+			return strconv.AppendInt(nil, v, 10), nil
+		}
+	case []byte:
+		if valueType == ValueTypeBytes {
+			return v, nil
+		}
+	}
+	body, err := json.Marshal(val)
+	if err != nil {
+		return nil, fmt.Errorf("marshal json value: %w", err)
+	}
+	return body, nil
+}
+
+// DecodeValue parses the text representation of a value of the given type, it's the inverse of EncodeValue.
+func DecodeValue(valueType ValueType, body []byte) (any, error) {
+	switch valueType {
+	case ValueTypeString:
+		return string(body), nil
+	case ValueTypeInt32:
+		n, err := strconv.ParseInt(string(body), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		return int32(n), nil
+	case ValueTypeInt64:
+		return strconv.ParseInt(string(body), 10, 64)
+	case ValueTypeJSON:
+		var val any
+		if err := json.Unmarshal(body, &val); err != nil {
+			return nil, err
+		}
+		return val, nil
+	case ValueTypeBytes:
+		return append([]byte(nil), body...), nil
+	}
+	return nil, fmt.Errorf("%w: value type %d", ErrUnsupportedContentType, valueType)
+}
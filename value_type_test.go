@@ -0,0 +1,66 @@
+package keynest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValueTypeSurvivesFlushAndCompaction(t *testing.T) {
+	tc := newTestTableCluster(t, t.TempDir())
+	values := []struct {
+		key       string
+		val       any
+		valueType ValueType
+	}{
+		{"bytes", []byte("raw\x00bytes"), ValueTypeBytes},
+		{"int32", int32(7), ValueTypeInt32},
+		{"int64", int64(7), ValueTypeInt64},
+		{"json-string", "looks like plain text", ValueTypeJSON},
+		{"json-number", float64(7), ValueTypeJSON},
+		{"string", "text", ValueTypeString},
+	}
+	check := func(stage string) {
+		t.Helper()
+		for _, v := range values {
+			val, valueType, ok, err := tc.GetTyped(v.key)
+			if err != nil || !ok {
+				t.Fatalf("%s: GetTyped(%s) = %v, %v", stage, v.key, ok, err)
+			}
+			if valueType != v.valueType || !reflect.DeepEqual(val, v.val) {
+				t.Fatalf("%s: GetTyped(%s) = %#v of %s, want %#v of %s", stage, v.key, val, valueType, v.val, v.valueType)
+			}
+		}
+	}
+
+	for _, v := range values {
+		if err := tc.PutTyped(v.key, v.val, v.valueType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("memtable")
+	for i := 0; i < 3; i++ {
+		if err := tc.TriggerMemFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("lvl 0")
+	if err := tc.Put("padding", int64(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Put("padding", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.TriggerCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tc.ftables[0]) != 0 {
+		t.Fatalf("%d lvl 0 tables left after compaction", len(tc.ftables[0]))
+	}
+	check("lvl 1")
+}
@@ -0,0 +1,193 @@
+package keynest
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+)
+
+// The checks run by Verify, they name the invariant a VerifyIssue breaks.
+const (
+	CheckRead        = "read"
+	CheckOrder       = "order"
+	CheckKeyRange    = "key_range"
+	CheckRecordCount = "record_count"
+	CheckSize        = "size"
+	CheckBloomFilter = "bloom_filter"
+	CheckSparseIndex = "sparse_index"
+	CheckLevelOrder  = "level_order"
+)
+
+type VerifyIssue struct {
+	Level    int    `json:"level"`
+	FileName string `json:"file_name"`
+	Check    string `json:"check"`
+	Message  string `json:"message"`
+}
+
+type VerifyReport struct {
+	Tables  int           `json:"tables"`
+	Records int           `json:"records"`
+	Issues  []VerifyIssue `json:"issues"`
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *VerifyReport) addIssue(lvl int, fileName, check, format string, args ...any) {
+	r.Issues = append(r.Issues, VerifyIssue{
+		Level:    lvl,
+		FileName: fileName,
+		Check:    check,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Verify reads every table of the cluster and checks the invariants of the LSM tree:
+//   - the records of a table are sorted without duplicated keys,
+//   - the key range, record count and size of a table match its data file,
+//   - the bloom filter of a table contains every key of the table,
+//   - every sparse index entry points at the record of its key,
+//   - the tables of lvl 1 and above are ordered by key and don't overlap.
+//
+// A broken invariant is reported as an issue, the error is only set when the verification couldn't run. Compactions
+// wait until the verification is over.
+func (t *TableCluster) Verify() (VerifyReport, error) {
+	if t.closed.Load() {
+		return VerifyReport{}, ErrClosed
+	}
+	t.compactionLock.Lock()
+	defer t.compactionLock.Unlock()
+
+	ftables := make([][]*FTable, len(t.ftables))
+	for i := range t.ftables {
+		t.ftablesLock[i].RLock()
+		ftables[i] = slices.Clone(t.ftables[i])
+		t.ftablesLock[i].RUnlock()
+	}
+	return verifyTables(ftables), nil
+}
+
+// VerifyDataDir runs the checks of TableCluster.Verify on the tables listed in the metadata file of dataDir, without
+// modifying any file. The keys are ordered by the comparator recorded in the metadata, which must be registered. The
+// data directory must not be modified meanwhile.
+func VerifyDataDir(dataDir string) (VerifyReport, error) {
+	clusterMetadata, err := ReadTableClusterMetadata(dataDir)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	cmp, err := ComparatorByName(clusterMetadata.Comparator)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	cfg := &Config{DataDir: dataDir, Comparator: cmp}
+	ftables := make([][]*FTable, len(clusterMetadata.FTableMetadata))
+	defer func() {
+		for i := range ftables {
+			for _, ftable := range ftables[i] {
+				ftable.Close()
+			}
+		}
+	}()
+	for i := range clusterMetadata.FTableMetadata {
+		for _, metadata := range clusterMetadata.FTableMetadata[i] {
+			ftable, err := OpenFTable(dataDir, metadata, cfg)
+			if err != nil {
+				return VerifyReport{}, err
+			}
+			ftables[i] = append(ftables[i], ftable)
+		}
+	}
+	return verifyTables(ftables), nil
+}
+
+func verifyTables(ftables [][]*FTable) VerifyReport {
+	report := VerifyReport{}
+	for lvl := range ftables {
+		for i, ftable := range ftables[lvl] {
+			verifyTable(&report, lvl, ftable)
+			if lvl == 0 || i == 0 {
+				continue
+			}
+			prev := ftables[lvl][i-1]
+			if ftable.compare(prev.minKey, ftable.minKey) > 0 {
+				report.addIssue(lvl, ftable.fileName(), CheckLevelOrder, "table starts at %q, before the previous table %s starting at %q", ftable.minKey, prev.fileName(), prev.minKey)
+			} else if ftable.compare(prev.maxKey, ftable.minKey) >= 0 {
+				report.addIssue(lvl, ftable.fileName(), CheckLevelOrder, "table starts at %q, it overlaps the previous table %s ending at %q", ftable.minKey, prev.fileName(), prev.maxKey)
+			}
+		}
+	}
+	return report
+}
+
+func verifyTable(report *VerifyReport, lvl int, ftable *FTable) {
+	name := ftable.fileName()
+	report.Tables++
+
+	if stat, err := ftable.dataFile.Stat(); err != nil {
+		report.addIssue(lvl, name, CheckRead, "stat data file: %v", err)
+	} else if stat.Size() != ftable.sizeInBytes {
+		report.addIssue(lvl, name, CheckSize, "data file holds %d bytes, the metadata claims %d", stat.Size(), ftable.sizeInBytes)
+	}
+
+	indexed := make(map[int64]Index, len(ftable.sparseIndex))
+	for i, index := range ftable.sparseIndex {
+		if i > 0 && ftable.compare(ftable.sparseIndex[i-1].Key, index.Key) >= 0 {
+			report.addIssue(lvl, name, CheckSparseIndex, "entry %q comes after %q", index.Key, ftable.sparseIndex[i-1].Key)
+		}
+		indexed[index.Offset] = index
+	}
+
+	nRecords := 0
+	var firstKey, lastKey string
+	end := int64(0)
+	it := ftable.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := it.Key()
+		if nRecords == 0 {
+			firstKey = key
+		} else if c := ftable.compare(key, lastKey); c == 0 {
+			report.addIssue(lvl, name, CheckOrder, "key %q is duplicated at offset %d", key, it.Offset())
+		} else if c < 0 {
+			report.addIssue(lvl, name, CheckOrder, "key %q at offset %d comes after %q", key, it.Offset(), lastKey)
+		}
+		if ftable.bloomFilter != nil && !ftable.bloomFilter.MightContains(key) {
+			report.addIssue(lvl, name, CheckBloomFilter, "key %q is missing from the bloom filter", key)
+		}
+		if index, ok := indexed[it.Offset()]; ok {
+			if index.Key != key || index.Tombstone != it.Tombstone() || index.ValSize != it.ValueSize() {
+				report.addIssue(lvl, name, CheckSparseIndex, "entry %q at offset %d points at the record of %q", index.Key, index.Offset, key)
+			}
+			delete(indexed, it.Offset())
+		}
+		nRecords++
+		lastKey = key
+		end = it.offset
+	}
+	if err := it.Err(); err != nil {
+		report.addIssue(lvl, name, CheckRead, "%v", err)
+	} else if end != ftable.sizeInBytes {
+		report.addIssue(lvl, name, CheckSize, "records end at offset %d, the metadata claims %d bytes", end, ftable.sizeInBytes)
+	}
+	report.Records += nRecords
+
+	dangling := slices.SortedFunc(maps.Values(indexed), func(a, b Index) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	for _, index := range dangling {
+		report.addIssue(lvl, name, CheckSparseIndex, "entry %q at offset %d doesn't point at the start of a record", index.Key, index.Offset)
+	}
+	if nRecords != ftable.nRecords {
+		report.addIssue(lvl, name, CheckRecordCount, "table holds %d records, the metadata claims %d", nRecords, ftable.nRecords)
+	}
+	if firstKey != ftable.minKey || lastKey != ftable.maxKey {
+		report.addIssue(lvl, name, CheckKeyRange, "records span %q .. %q, the metadata claims %q .. %q", firstKey, lastKey, ftable.minKey, ftable.maxKey)
+	}
+}
+
+func (s *FTable) fileName() string {
+	return filepath.Base(s.dataFile.Name())
+}
@@ -0,0 +1,33 @@
+package keynest
+
+import (
+	"testing"
+)
+
+func TestVerifyReportsBrokenInvariants(t *testing.T) {
+	ftable := newTestFTable(t, 40)
+	report := verifyTables([][]*FTable{{ftable}})
+	if !report.OK() || report.Tables != 1 || report.Records != 40 {
+		t.Fatalf("report of a sound table = %+v", report)
+	}
+
+	ftable.nRecords++
+	ftable.maxKey = "zzz"
+	ftable.sparseIndex[1].Offset++
+	report = verifyTables([][]*FTable{{}, {ftable, ftable}})
+	checks := map[string]int{}
+	for _, issue := range report.Issues {
+		checks[issue.Check]++
+	}
+	want := map[string]int{
+		CheckRecordCount: 2,
+		CheckKeyRange:    2,
+		CheckSparseIndex: 2,
+		CheckLevelOrder:  1,
+	}
+	for check, n := range want {
+		if checks[check] != n {
+			t.Errorf("%d %s issues, want %d: %+v", checks[check], check, n, report.Issues)
+		}
+	}
+}
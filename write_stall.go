@@ -0,0 +1,124 @@
+package keynest
+
+import (
+	"fmt"
+	"time"
+)
+
+// WriteStall is the state of the write path. Writes are delayed on WriteStallSlowdown and blocked on
+// WriteStallStop until flushes and compactions catch up.
+type WriteStall int
+
+const (
+	WriteStallNone WriteStall = iota
+	WriteStallSlowdown
+	WriteStallStop
+)
+
+func (w WriteStall) String() string {
+	switch w {
+	case WriteStallSlowdown:
+		return "slowdown"
+	case WriteStallStop:
+		return "stop"
+	default:
+		return "none"
+	}
+}
+
+const defaultWriteSlowdownDelay = time.Millisecond
+
+func triggerReached(n, trigger int) bool {
+	return trigger > 0 && n >= trigger
+}
+
+// WriteStall returns the current state of the write path along with the trigger that caused it.
+func (t *TableCluster) WriteStall() (WriteStall, string) {
+	t.ftablesLock[0].RLock()
+	lvl0Tables := len(t.ftables[0])
+	t.ftablesLock[0].RUnlock()
+
+	t.memTableLock.RLock()
+	memEntries := t.memtable.tree.Size()
+	immutables := len(t.immutables)
+	t.memTableLock.RUnlock()
+
+	switch {
+	case triggerReached(lvl0Tables, t.cfg.Lvl0StopTableNum):
+		return WriteStallStop, fmt.Sprintf("lvl 0 has %d tables", lvl0Tables)
+	case triggerReached(memEntries, t.cfg.MemStopNum):
+		return WriteStallStop, fmt.Sprintf("memtable has %d entries", memEntries)
+	case triggerReached(immutables, t.cfg.ImmutableMemStopNum):
+		return WriteStallStop, fmt.Sprintf("%d immutable memtables are waiting to be flushed", immutables)
+	case triggerReached(lvl0Tables, t.cfg.Lvl0SlowdownTableNum):
+		return WriteStallSlowdown, fmt.Sprintf("lvl 0 has %d tables", lvl0Tables)
+	case triggerReached(memEntries, t.cfg.MemSlowdownNum):
+		return WriteStallSlowdown, fmt.Sprintf("memtable has %d entries", memEntries)
+	case triggerReached(immutables, t.cfg.ImmutableMemSlowdownNum):
+		return WriteStallSlowdown, fmt.Sprintf("%d immutable memtables are waiting to be flushed", immutables)
+	}
+	return WriteStallNone, ""
+}
+
+// notifyWriteStallChange wakes up the writes blocked by a stop trigger so they can re-evaluate the stall state.
+func (t *TableCluster) notifyWriteStallChange() {
+	t.stallLock.Lock()
+	close(t.stallCh)
+	t.stallCh = make(chan struct{})
+	t.stallLock.Unlock()
+}
+
+// waitForWriteStall delays the caller on a slowdown trigger and blocks it on a stop trigger. A blocked write gives
+// up with ErrWriteStall after Config.WriteStopTimeout, or waits indefinitely if the timeout is 0.
+func (t *TableCluster) waitForWriteStall() error {
+	var timeout <-chan time.Time
+	if t.cfg.WriteStopTimeout > 0 {
+		timer := time.NewTimer(t.cfg.WriteStopTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	stopped := false
+	for {
+		// take the channel before evaluating the state, so a change in between is not missed
+		t.stallLock.Lock()
+		stallCh := t.stallCh
+		t.stallLock.Unlock()
+
+		stall, _ := t.WriteStall()
+		switch stall {
+		case WriteStallNone:
+			return nil
+		case WriteStallSlowdown:
+			t.metrics.WriteSlowdownCount.Inc()
+			delay := t.cfg.WriteSlowdownDelay
+			if delay == 0 {
+				delay = defaultWriteSlowdownDelay
+			}
+			time.Sleep(delay)
+			return nil
+		}
+
+		if !stopped {
+			stopped = true
+			t.metrics.WriteStopCount.Inc()
+		}
+		t.kick(t.flushKick)
+		t.kick(t.compactionKick)
+		select {
+		case <-stallCh:
+		case <-timeout:
+			return ErrWriteStall
+		case <-t.done:
+			return ErrClosed
+		}
+	}
+}
+
+// kick wakes up a background job without waiting for its next tick.
+func (t *TableCluster) kick(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
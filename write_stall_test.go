@@ -0,0 +1,113 @@
+package keynest
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestStallTableCluster(t *testing.T, configure func(cfg *Config)) *TableCluster {
+	t.Helper()
+	cfg := &Config{
+		DataDir:            t.TempDir(),
+		IndexSkipNum:       4,
+		WriteBufferSize:    1024,
+		FalsePositiveRate:  0.01,
+		Lvl0MaxTableNum:    4,
+		MemMaxNum:          1000,
+		CompactionInterval: time.Hour,
+		MemFlushInterval:   time.Hour,
+	}
+	configure(cfg)
+	tc := NewTableCluster(cfg)
+	t.Cleanup(func() { tc.Close() })
+	return tc
+}
+
+func TestWriteStallSlowsDownWrites(t *testing.T) {
+	tc := newTestStallTableCluster(t, func(cfg *Config) {
+		cfg.MemSlowdownNum = 5
+		cfg.WriteSlowdownDelay = 20 * time.Millisecond
+	})
+	putKeys(t, tc, "key", 5)
+	if stall, reason := tc.WriteStall(); stall != WriteStallSlowdown || reason != "memtable has 5 entries" {
+		t.Fatalf("WriteStall() = %v, %q", stall, reason)
+	}
+	start := time.Now()
+	if err := tc.Put("late", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("Put took %v, want the slowdown delay", elapsed)
+	}
+	if got := tc.metrics.WriteSlowdownCount.Value(); got != 1 {
+		t.Fatalf("WriteSlowdownCount = %d, want 1", got)
+	}
+
+	if err := tc.TriggerMemFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if stall, _ := tc.WriteStall(); stall != WriteStallNone {
+		t.Fatalf("WriteStall() after a flush = %v", stall)
+	}
+}
+
+// The stop triggers are under MemMaxNum and Lvl0MaxTableNum, the blocked writes are released by the background
+// jobs acting on the triggers themselves.
+func TestWriteStallStopIsReleasedByBackgroundJobs(t *testing.T) {
+	tc := newTestStallTableCluster(t, func(cfg *Config) {
+		cfg.MemStopNum = 5
+		cfg.Lvl0StopTableNum = 2
+		cfg.WriteStopTimeout = 5 * time.Second
+	})
+	putKeys(t, tc, "mem", 5)
+	if stall, reason := tc.WriteStall(); stall != WriteStallStop || reason != "memtable has 5 entries" {
+		t.Fatalf("WriteStall() = %v, %q", stall, reason)
+	}
+	if err := tc.Put("mem-late", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.metrics.WriteStopCount.Value(); got != 1 {
+		t.Fatalf("WriteStopCount = %d, want 1", got)
+	}
+
+	// the flush of the memtable made the first lvl 0 table, a second one stops the writes again
+	if err := tc.AddRecords([]*Record{{Key: "lvl0", Val: "v", Metadata: Metadata{ValueType: ValueTypeString}}}); err != nil {
+		t.Fatal(err)
+	}
+	if stall, reason := tc.WriteStall(); stall != WriteStallStop || reason != "lvl 0 has 2 tables" {
+		t.Fatalf("WriteStall() = %v, %q", stall, reason)
+	}
+	if err := tc.Put("lvl0-late", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.metrics.WriteStopCount.Value(); got != 2 {
+		t.Fatalf("WriteStopCount = %d, want 2", got)
+	}
+	for _, key := range []string{"mem-00", "mem-late", "lvl0", "lvl0-late"} {
+		if _, ok, err := tc.Get(key); err != nil || !ok {
+			t.Fatalf("Get(%s) = %v, %v", key, ok, err)
+		}
+	}
+}
+
+func TestWriteStallStopTimesOut(t *testing.T) {
+	tc := newTestStallTableCluster(t, func(cfg *Config) {
+		cfg.Lvl0StopTableNum = 1
+		cfg.WriteStopTimeout = 50 * time.Millisecond
+	})
+	if err := tc.AddRecords([]*Record{{Key: "a", Val: "v", Metadata: Metadata{ValueType: ValueTypeString}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// no compaction can run while the lock is held
+	tc.compactionLock.Lock()
+	err := tc.Put("b", "v")
+	tc.compactionLock.Unlock()
+	if !errors.Is(err, ErrWriteStall) {
+		t.Fatalf("Put while compactions are blocked = %v, want ErrWriteStall", err)
+	}
+	if err = tc.Put("b", "v"); err != nil {
+		t.Fatalf("Put once compactions can run = %v", err)
+	}
+}